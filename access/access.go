@@ -0,0 +1,248 @@
+package access
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// Grant lets an ip through the firewall for the routes of its permission group
+type Grant struct {
+	IP      string    `json:"ip"` //a cidr for manual entries
+	User    string    `json:"user"`
+	GroupID int       `json:"group_id"`
+	Expires time.Time `json:"expires_at,omitzero"` //zero means until revoked
+	Note    string    `json:"note,omitempty"`
+	Source  string    `json:"source,omitempty"` //empty for logins, SourceConfig or SourceManual
+	Logins  []Login   `json:"logins,omitempty"` //every user logged in from this ip, User and GroupID are the newest of them
+	//A config or manual entry keeps its GroupID when users log in on its ip, this is when the entry itself ends.
+	//Expires also covers the logins then. Only set while there are logins, without them Expires is the end of the entry
+	EntryExpires time.Time `json:"entry_expires_at,omitzero"`
+}
+
+// Login is one user that whitelisted an ip, users behind the same nat share the grant of that ip
+type Login struct {
+	User    string    `json:"user"`
+	GroupID int       `json:"group_id"`
+	Expires time.Time `json:"expires_at,omitzero"` //zero means until the user logs out
+}
+
+const (
+	SourceConfig = "config" //static_whitelist in config.json
+	SourceManual = "manual" //added on the command line or admin api
+)
+
+func (g Grant) Expired(now time.Time) bool {
+	return !g.Expires.IsZero() && !now.Before(g.Expires)
+}
+
+// Groups are the permission groups this grant lets in, the union over its logins.
+// Config and manual entries add their own group as long as the entry runs
+func (g Grant) Groups() []int {
+	if len(g.Logins) == 0 {
+		return []int{g.GroupID}
+	}
+	now := time.Now()
+	var groups []int
+	if end := g.entryEnds(); g.Source != "" && (end.IsZero() || now.Before(end)) {
+		groups = append(groups, g.GroupID)
+	}
+	for _, l := range g.Logins {
+		if l.Expires.IsZero() || now.Before(l.Expires) {
+			groups = append(groups, l.GroupID)
+		}
+	}
+	return groups
+}
+
+// WithLogin adds or replaces the login of a user, the grant lives as long as its longest login
+func (g Grant) WithLogin(l Login) Grant {
+	logins := []Login{}
+	for _, other := range g.Logins {
+		if other.User != l.User {
+			logins = append(logins, other)
+		}
+	}
+	return g.withLogins(append(logins, l))
+}
+
+// WithoutLogin drops the login of a user, false when nothing is left and the grant should go.
+// A config or manual entry stays when its last login leaves
+func (g Grant) WithoutLogin(user string) (Grant, bool) {
+	var logins []Login
+	for _, other := range g.Logins {
+		if other.User != user {
+			logins = append(logins, other)
+		}
+	}
+	if len(logins) == 0 {
+		if g.Source == "" {
+			return Grant{}, false
+		}
+		return g.Entry(), true
+	}
+	return g.withLogins(logins), true
+}
+
+// WithEntry puts a config or manual entry on the ip of the grant, the logins on it stay
+func (g Grant) WithEntry(entry Grant) Grant {
+	entry.IP, entry.User, entry.Logins, entry.EntryExpires = g.IP, "", nil, time.Time{}
+	if len(g.Logins) == 0 {
+		return entry
+	}
+	return entry.withLogins(g.Logins)
+}
+
+// WithoutEntry drops the config or manual entry and keeps the logins, false when there are none and the grant should go
+func (g Grant) WithoutEntry() (Grant, bool) {
+	if len(g.Logins) == 0 {
+		return Grant{}, false
+	}
+	return Grant{IP: g.IP}.withLogins(g.Logins), true
+}
+
+// Entry is the config or manual entry of the grant without the logins on top of it
+func (g Grant) Entry() Grant {
+	return Grant{IP: g.IP, GroupID: g.GroupID, Expires: g.entryEnds(), Note: g.Note, Source: g.Source}
+}
+
+func (g Grant) entryEnds() time.Time {
+	if len(g.Logins) == 0 {
+		return g.Expires
+	}
+	return g.EntryExpires
+}
+
+func (g Grant) withLogins(logins []Login) Grant {
+	newest := logins[len(logins)-1]
+	ends := make([]time.Time, 0, len(logins)+1)
+	if g.Source != "" {
+		g.EntryExpires = g.entryEnds()
+		ends = append(ends, g.EntryExpires)
+	} else {
+		g.GroupID = newest.GroupID
+	}
+	g.User, g.Logins = newest.User, logins
+	for _, l := range logins {
+		ends = append(ends, l.Expires)
+	}
+	g.Expires = lastEnd(ends)
+	return g
+}
+
+// lastEnd is the latest of the times, zero (never) when one of them is
+func lastEnd(ends []time.Time) time.Time {
+	var last time.Time
+	for _, end := range ends {
+		if end.IsZero() {
+			return time.Time{}
+		}
+		if end.After(last) {
+			last = end
+		}
+	}
+	return last
+}
+
+// Ban blocks an ip or cidr everywhere, even when the firewall is off or default_allow is on
+type Ban struct {
+	Target  string    `json:"target"` //ip or cidr
+	Reason  string    `json:"reason,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires_at,omitzero"` //zero means until unbanned
+	prefix  netip.Prefix
+}
+
+// NewBan checks the target, a plain ip becomes a single host ban
+func NewBan(target, reason string, duration time.Duration) (Ban, error) {
+	b := Ban{Target: target, Reason: reason, Created: time.Now()}
+	if duration > 0 {
+		b.Expires = b.Created.Add(duration)
+	}
+	return b.parse()
+}
+
+func (b Ban) parse() (Ban, error) {
+	target, prefix, err := ParseTarget(b.Target)
+	if err != nil {
+		return b, err
+	}
+	b.Target, b.prefix = target, prefix
+	return b, nil
+}
+
+// ParseTarget reads an ip or cidr and returns it in its normal form, a plain ip is a single host prefix
+func ParseTarget(target string) (string, netip.Prefix, error) {
+	var prefix netip.Prefix
+	if strings.Contains(target, "/") {
+		p, err := netip.ParsePrefix(target)
+		if err != nil {
+			return "", prefix, err
+		}
+		prefix = p.Masked()
+	} else {
+		addr, err := netip.ParseAddr(target)
+		if err != nil {
+			return "", prefix, err
+		}
+		addr = addr.Unmap()
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+	if prefix.IsSingleIP() {
+		return prefix.Addr().String(), prefix, nil
+	}
+	return prefix.String(), prefix, nil
+}
+
+func (b Ban) Expired(now time.Time) bool {
+	return !b.Expires.IsZero() && !now.Before(b.Expires)
+}
+
+func (b Ban) Matches(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && b.prefix.Contains(addr.Unmap())
+}
+
+type EventType string
+
+const (
+	EventGrant  EventType = "grant"
+	EventRevoke EventType = "revoke"
+	EventExpire EventType = "expire"
+	EventBan    EventType = "ban"
+	EventUnban  EventType = "unban"
+)
+
+// Event is sent to every subscriber after the store changed
+type Event struct {
+	Type  EventType `json:"type"`
+	Grant Grant     `json:"grant,omitzero"`
+	Ban   Ban       `json:"ban,omitzero"`
+}
+
+// Store holds who is allowed in and which connections they have open.
+// Firewall, proxy and webserver only go through this, so tests and other backends can swap it out
+type Store interface {
+	// Grant adds or replaces the grant of an ip
+	Grant(g Grant)
+	// Revoke removes the grant and closes the open conns of that ip
+	Revoke(ip string) (Grant, bool)
+	// Lookup returns the grant of an ip, expired grants and banned ips count as missing
+	Lookup(ip string) (Grant, bool)
+	// TrackConn adds the conn when the ip has a grant that allow accepts and isn't banned, checked and added in one step
+	TrackConn(ip string, conn net.Conn, allow func(Grant) bool) bool
+	UntrackConn(ip string, conn net.Conn)
+	// Conns is the number of open conns of an ip
+	Conns(ip string) int
+	List() []Grant
+	// Prune revokes every expired grant and lifts expired bans, returns the grants
+	Prune() []Grant
+	// Ban revokes the grants the ban covers, Banned reports the ban that covers an ip
+	Ban(b Ban) error
+	Unban(target string) (Ban, bool)
+	Banned(ip string) (Ban, bool)
+	Bans() []Ban
+	// Subscribe returns a channel of changes, call the func to stop. Slow subscribers miss events instead of blocking the store
+	Subscribe() (<-chan Event, func())
+}
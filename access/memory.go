@@ -0,0 +1,288 @@
+package access
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+type MemoryStore struct {
+	mu     sync.RWMutex
+	grants map[string]Grant
+	nets   map[string]netip.Prefix //the grants that are a cidr
+	conns  map[string][]net.Conn   //keyed by the real ip, also for conns let in by a cidr grant
+	bans   map[string]Ban          //target -> ban
+
+	subMu  sync.Mutex
+	nextID int
+	subs   map[int]chan Event
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		grants: make(map[string]Grant),
+		nets:   make(map[string]netip.Prefix),
+		conns:  make(map[string][]net.Conn),
+		bans:   make(map[string]Ban),
+		subs:   make(map[int]chan Event),
+	}
+}
+
+func (s *MemoryStore) Grant(g Grant) {
+	s.mu.Lock()
+	s.putLocked(g)
+	s.mu.Unlock()
+	s.publish(Event{Type: EventGrant, Grant: g})
+}
+
+func (s *MemoryStore) putLocked(g Grant) {
+	s.grants[g.IP] = g
+	if _, prefix, err := ParseTarget(g.IP); err == nil && !prefix.IsSingleIP() {
+		s.nets[g.IP] = prefix
+	}
+}
+
+func (s *MemoryStore) Revoke(ip string) (Grant, bool) {
+	s.mu.Lock()
+	g, ok := s.revokeLocked(ip)
+	s.mu.Unlock()
+	if ok {
+		s.publish(Event{Type: EventRevoke, Grant: g})
+	}
+	return g, ok
+}
+
+// revokeLocked closes the conns the grant let in, unless another grant still covers their ip
+func (s *MemoryStore) revokeLocked(key string) (Grant, bool) {
+	g, ok := s.grants[key]
+	delete(s.grants, key)
+	prefix, isNet := s.nets[key]
+	delete(s.nets, key)
+
+	for ip, conns := range s.conns {
+		if ip != key && !(isNet && prefixContains(prefix, ip)) {
+			continue
+		}
+		if _, covered := s.grantForLocked(ip); covered {
+			continue
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		delete(s.conns, ip)
+	}
+	return g, ok
+}
+
+func prefixContains(prefix netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	return err == nil && prefix.Contains(addr.Unmap())
+}
+
+// grantForLocked finds the grant of an ip itself first and then a cidr that contains it
+func (s *MemoryStore) grantForLocked(ip string) (Grant, bool) {
+	if s.bannedLocked(ip) {
+		return Grant{}, false
+	}
+	now := time.Now()
+	if g, ok := s.grants[ip]; ok && !g.Expired(now) {
+		return g, true
+	}
+	for key, prefix := range s.nets {
+		if g := s.grants[key]; !g.Expired(now) && prefixContains(prefix, ip) {
+			return g, true
+		}
+	}
+	return Grant{}, false
+}
+
+func (s *MemoryStore) Lookup(ip string) (Grant, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.grantForLocked(ip)
+}
+
+func (s *MemoryStore) TrackConn(ip string, conn net.Conn, allow func(Grant) bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, ok := s.grantForLocked(ip)
+	if !ok || (allow != nil && !allow(g)) {
+		return false
+	}
+	s.conns[ip] = append(s.conns[ip], conn)
+	return true
+}
+
+func (s *MemoryStore) UntrackConn(ip string, conn net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conns := s.conns[ip]
+	for i, c := range conns {
+		if c == conn {
+			s.conns[ip] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(s.conns[ip]) == 0 {
+		delete(s.conns, ip)
+	}
+}
+
+func (s *MemoryStore) Conns(ip string) int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.conns[ip])
+}
+
+func (s *MemoryStore) List() []Grant {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	list := make([]Grant, 0, len(s.grants))
+	for _, g := range s.grants {
+		if !g.Expired(now) {
+			list = append(list, g)
+		}
+	}
+	return list
+}
+
+func (s *MemoryStore) Prune() []Grant {
+	s.mu.Lock()
+	now := time.Now()
+	var expired []Grant
+	for ip, g := range s.grants {
+		if g.Expired(now) {
+			s.revokeLocked(ip)
+			expired = append(expired, g)
+		}
+	}
+	var lifted []Ban
+	for target, b := range s.bans {
+		if b.Expired(now) {
+			delete(s.bans, target)
+			lifted = append(lifted, b)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, g := range expired {
+		s.publish(Event{Type: EventExpire, Grant: g})
+	}
+	for _, b := range lifted {
+		s.publish(Event{Type: EventUnban, Ban: b})
+	}
+	return expired
+}
+
+func (s *MemoryStore) Ban(b Ban) error {
+	b, err := b.parse()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.bans[b.Target] = b
+	var revoked []Grant
+	for ip := range s.grants {
+		if b.Matches(ip) {
+			g, _ := s.revokeLocked(ip)
+			revoked = append(revoked, g)
+		}
+	}
+	//Conns let in by a cidr grant that stays
+	for ip, conns := range s.conns {
+		if b.Matches(ip) {
+			for _, conn := range conns {
+				conn.Close()
+			}
+			delete(s.conns, ip)
+		}
+	}
+	s.mu.Unlock()
+
+	s.publish(Event{Type: EventBan, Ban: b})
+	for _, g := range revoked {
+		s.publish(Event{Type: EventRevoke, Grant: g})
+	}
+	return nil
+}
+
+func (s *MemoryStore) Unban(target string) (Ban, bool) {
+	if parsed, err := (Ban{Target: target}).parse(); err == nil {
+		target = parsed.Target
+	}
+	s.mu.Lock()
+	b, ok := s.bans[target]
+	delete(s.bans, target)
+	s.mu.Unlock()
+	if ok {
+		s.publish(Event{Type: EventUnban, Ban: b})
+	}
+	return b, ok
+}
+
+func (s *MemoryStore) Banned(ip string) (Ban, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.banFor(ip)
+}
+
+func (s *MemoryStore) banFor(ip string) (Ban, bool) {
+	now := time.Now()
+	for _, b := range s.bans {
+		if !b.Expired(now) && b.Matches(ip) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+func (s *MemoryStore) bannedLocked(ip string) bool {
+	_, banned := s.banFor(ip)
+	return banned
+}
+
+func (s *MemoryStore) Bans() []Ban {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	list := make([]Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		if !b.Expired(now) {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+func (s *MemoryStore) Subscribe() (<-chan Event, func()) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	id := s.nextID
+	s.nextID++
+	ch := make(chan Event, 64)
+	s.subs[id] = ch
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.subMu.Lock()
+			defer s.subMu.Unlock()
+			delete(s.subs, id)
+			close(ch)
+		})
+	}
+}
+
+func (s *MemoryStore) publish(e Event) {
+	s.subMu.Lock()
+	defer s.subMu.Unlock()
+	for _, ch := range s.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package access
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+)
+
+// SQLiteStore keeps the grants in the db so they outlive the process, conns only exist in memory
+type SQLiteStore struct {
+	*MemoryStore
+	db *sql.DB
+}
+
+// NewSQLiteStore creates the grants table when needed and loads what is in it
+func NewSQLiteStore(db *sql.DB) (*SQLiteStore, error) {
+	_, err := db.Exec(`
+    CREATE TABLE IF NOT EXISTS grants (
+        ip TEXT PRIMARY KEY,
+        username TEXT NOT NULL,
+        group_id INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL, -- unix seconds, 0 never expires
+        note TEXT NOT NULL DEFAULT '',
+        source TEXT NOT NULL DEFAULT '',
+        logins TEXT NOT NULL DEFAULT '', -- json, every user logged in from the ip
+        entry_expires_at INTEGER NOT NULL DEFAULT 0 -- end of a config or manual entry with logins on top, 0 never expires
+    );
+    CREATE TABLE IF NOT EXISTS bans (
+        target TEXT PRIMARY KEY,
+        reason TEXT NOT NULL DEFAULT '',
+        created_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL -- 0 never expires
+    );
+	`)
+	if err != nil {
+		return nil, err
+	}
+	//Tables from before manual entries existed
+	if _, err := db.Exec("ALTER TABLE grants ADD COLUMN source TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, err
+	}
+	if _, err := db.Exec("ALTER TABLE grants ADD COLUMN logins TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, err
+	}
+	if _, err := db.Exec("ALTER TABLE grants ADD COLUMN entry_expires_at INTEGER NOT NULL DEFAULT 0"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, err
+	}
+
+	s := &SQLiteStore{MemoryStore: NewMemoryStore(), db: db}
+	rows, err := db.Query("SELECT ip, username, group_id, expires_at, note, source, logins, entry_expires_at FROM grants")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var g Grant
+		var expires, entryExpires int64
+		var logins string
+		if err := rows.Scan(&g.IP, &g.User, &g.GroupID, &expires, &g.Note, &g.Source, &logins, &entryExpires); err != nil {
+			return nil, err
+		}
+		if expires != 0 {
+			g.Expires = time.Unix(expires, 0)
+		}
+		if entryExpires != 0 {
+			g.EntryExpires = time.Unix(entryExpires, 0)
+		}
+		if logins != "" {
+			if err := json.Unmarshal([]byte(logins), &g.Logins); err != nil {
+				log.Printf("ACCESS: Skipping invalid logins of %v: %v", g.IP, err)
+			}
+		} else if g.Source == "" && g.User != "" {
+			g.Logins = []Login{{User: g.User, GroupID: g.GroupID, Expires: g.Expires}} //saved before grants had logins
+		}
+		s.putLocked(g)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	bans, err := db.Query("SELECT target, reason, created_at, expires_at FROM bans")
+	if err != nil {
+		return nil, err
+	}
+	defer bans.Close()
+	for bans.Next() {
+		var b Ban
+		var created, expires int64
+		if err := bans.Scan(&b.Target, &b.Reason, &created, &expires); err != nil {
+			return nil, err
+		}
+		b.Created = time.Unix(created, 0)
+		if expires != 0 {
+			b.Expires = time.Unix(expires, 0)
+		}
+		if b, err = b.parse(); err != nil {
+			log.Printf("ACCESS: Skipping invalid ban %q: %v", b.Target, err)
+			continue
+		}
+		s.bans[b.Target] = b
+	}
+	return s, bans.Err()
+}
+
+func (s *SQLiteStore) Grant(g Grant) {
+	var expires, entryExpires int64
+	if !g.Expires.IsZero() {
+		expires = g.Expires.Unix()
+	}
+	if !g.EntryExpires.IsZero() {
+		entryExpires = g.EntryExpires.Unix()
+	}
+	var logins []byte
+	if len(g.Logins) > 0 {
+		logins, _ = json.Marshal(g.Logins)
+	}
+	_, err := s.db.Exec(`
+        INSERT INTO grants (ip, username, group_id, expires_at, note, source, logins, entry_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+        ON CONFLICT(ip) DO UPDATE SET username = excluded.username, group_id = excluded.group_id,
+            expires_at = excluded.expires_at, note = excluded.note, source = excluded.source, logins = excluded.logins,
+            entry_expires_at = excluded.entry_expires_at
+    `, g.IP, g.User, g.GroupID, expires, g.Note, g.Source, string(logins), entryExpires)
+	if err != nil {
+		log.Println("ACCESS: Failed to save grant ", err)
+	}
+	s.MemoryStore.Grant(g)
+}
+
+func (s *SQLiteStore) Revoke(ip string) (Grant, bool) {
+	if _, err := s.db.Exec("DELETE FROM grants WHERE ip = ?", ip); err != nil {
+		log.Println("ACCESS: Failed to delete grant ", err)
+	}
+	return s.MemoryStore.Revoke(ip)
+}
+
+func (s *SQLiteStore) Prune() []Grant {
+	expired := s.MemoryStore.Prune()
+	for _, g := range expired {
+		if _, err := s.db.Exec("DELETE FROM grants WHERE ip = ?", g.IP); err != nil {
+			log.Println("ACCESS: Failed to delete grant ", err)
+		}
+	}
+	if _, err := s.db.Exec("DELETE FROM bans WHERE expires_at != 0 AND expires_at <= ?", time.Now().Unix()); err != nil {
+		log.Println("ACCESS: Failed to delete expired bans ", err)
+	}
+	return expired
+}
+
+func (s *SQLiteStore) Ban(b Ban) error {
+	b, err := b.parse()
+	if err != nil {
+		return err
+	}
+	var expires int64
+	if !b.Expires.IsZero() {
+		expires = b.Expires.Unix()
+	}
+	_, err = s.db.Exec(`
+        INSERT INTO bans (target, reason, created_at, expires_at) VALUES (?, ?, ?, ?)
+        ON CONFLICT(target) DO UPDATE SET reason = excluded.reason, created_at = excluded.created_at,
+            expires_at = excluded.expires_at
+    `, b.Target, b.Reason, b.Created.Unix(), expires)
+	if err != nil {
+		log.Println("ACCESS: Failed to save ban ", err)
+	}
+	for _, g := range s.List() {
+		if b.Matches(g.IP) {
+			if _, err := s.db.Exec("DELETE FROM grants WHERE ip = ?", g.IP); err != nil {
+				log.Println("ACCESS: Failed to delete grant ", err)
+			}
+		}
+	}
+	return s.MemoryStore.Ban(b)
+}
+
+func (s *SQLiteStore) Unban(target string) (Ban, bool) {
+	b, ok := s.MemoryStore.Unban(target)
+	if ok {
+		if _, err := s.db.Exec("DELETE FROM bans WHERE target = ?", b.Target); err != nil {
+			log.Println("ACCESS: Failed to delete ban ", err)
+		}
+	}
+	return b, ok
+}
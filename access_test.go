@@ -0,0 +1,91 @@
+package main
+
+import (
+	"mazarin/access"
+	"net"
+	"testing"
+	"time"
+)
+
+// This test checks that the memory store only tracks conns of allowed ips, closes them on revoke and expires grants
+func TestMemoryStore(t *testing.T) {
+	store := access.NewMemoryStore()
+	events, stop := store.Subscribe()
+	defer stop()
+
+	store.Grant(access.Grant{IP: "10.0.0.1", User: "bob", GroupID: 2})
+	if e := <-events; e.Type != access.EventGrant || e.Grant.User != "bob" {
+		t.Fatalf("expected a grant event for bob, got %+v", e)
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	if store.TrackConn("10.0.0.1", client, func(g access.Grant) bool { return g.GroupID == 1 }) {
+		t.Error("conn tracked although the group check failed")
+	}
+	if !store.TrackConn("10.0.0.1", client, nil) {
+		t.Fatal("conn of a whitelisted ip was not tracked")
+	}
+	if store.TrackConn("10.0.0.2", client, nil) {
+		t.Error("conn of an unknown ip was tracked")
+	}
+	if n := store.Conns("10.0.0.1"); n != 1 {
+		t.Errorf("expected 1 conn, got %v", n)
+	}
+
+	//Revoking closes the tracked conns
+	if _, ok := store.Revoke("10.0.0.1"); !ok {
+		t.Fatal("revoke did not find the grant")
+	}
+	if _, err := client.Write([]byte("x")); err == nil {
+		t.Error("conn still open after revoke")
+	}
+	if e := <-events; e.Type != access.EventRevoke {
+		t.Errorf("expected a revoke event, got %+v", e)
+	}
+	if _, ok := store.Lookup("10.0.0.1"); ok {
+		t.Error("ip still whitelisted after revoke")
+	}
+
+	store.Grant(access.Grant{IP: "10.0.0.3", Expires: time.Now().Add(-time.Second)})
+	<-events
+	if _, ok := store.Lookup("10.0.0.3"); ok {
+		t.Error("expired grant counted as whitelisted")
+	}
+	if expired := store.Prune(); len(expired) != 1 || expired[0].IP != "10.0.0.3" {
+		t.Errorf("prune returned %+v", expired)
+	}
+	if len(store.List()) != 0 {
+		t.Error("store not empty after prune")
+	}
+}
+
+// This test checks that a cidr grant covers the ips in it and that its conns only close when nothing covers them anymore
+func TestCIDRGrant(t *testing.T) {
+	store := access.NewMemoryStore()
+	store.Grant(access.Grant{IP: "10.1.0.0/16", Source: access.SourceManual})
+	store.Grant(access.Grant{IP: "10.1.2.3", User: "bob"})
+
+	if g, ok := store.Lookup("10.1.9.9"); !ok || g.IP != "10.1.0.0/16" {
+		t.Fatalf("ip in the cidr not covered, got %+v", g)
+	}
+	if _, ok := store.Lookup("10.2.0.1"); ok {
+		t.Error("ip outside the cidr covered")
+	}
+
+	client, server := net.Pipe()
+	defer server.Close()
+	if !store.TrackConn("10.1.2.3", client, nil) {
+		t.Fatal("conn not tracked")
+	}
+
+	//The cidr still covers the ip, so the conn stays open
+	store.Revoke("10.1.2.3")
+	if store.Conns("10.1.2.3") != 1 {
+		t.Fatal("conn closed although the cidr still covers it")
+	}
+	store.Revoke("10.1.0.0/16")
+	if store.Conns("10.1.2.3") != 0 {
+		t.Error("conn still open after the cidr was revoked")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apiKey is a key in keys.json with these scopes, the returned string is what clients send
+func apiKey(id, secret string, scopes ...string) (webserver.APIKey, string) {
+	sum := sha256.Sum256([]byte(secret))
+	return webserver.APIKey{ID: id, Name: id, Hash: hex.EncodeToString(sum[:]), Scopes: scopes}, "mzk_" + id + "_" + secret
+}
+
+// callAPI sends an api request from ip with the key as bearer token
+func callAPI(method, path, key, ip, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.RemoteAddr = ip + ":5000"
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	webserver.APIHandler(w, r)
+	return w
+}
+
+func decodeLease(t *testing.T, w *httptest.ResponseRecorder) firewall.Lease {
+	t.Helper()
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got %v %v, want a lease", w.Code, w.Body.String())
+	}
+	var lease firewall.Lease
+	if err := json.NewDecoder(w.Body).Decode(&lease); err != nil {
+		t.Fatal(err)
+	}
+	return lease
+}
+
+// This test checks that only keys with the session scope whitelist an ip, and that new keys only take known scopes
+func TestAPIKeyScopes(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	session, sessionKey := apiKey("aaaa1111", "sessionsecret", webserver.ScopeSession)
+	other, otherKey := apiKey("bbbb2222", "othersecret", "other")
+	_, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash, APIKeys: []webserver.APIKey{session, other}})
+
+	if w := callAPI("POST", "/api/session", otherKey, "192.0.2.40", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Key without the session scope: got %v, want 401", w.Code)
+	}
+	if w := callAPI("POST", "/api/session", "mzk_aaaa1111_wrongsecret", "192.0.2.40", ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Wrong secret: got %v, want 401", w.Code)
+	}
+	if firewall.CheckWhitelist(store, "192.0.2.40") {
+		t.Fatal("A rejected key whitelisted the ip")
+	}
+	decodeLease(t, callAPI("POST", "/api/session", sessionKey, "192.0.2.40", ""))
+	if !firewall.CheckWhitelist(store, "192.0.2.40") {
+		t.Error("The session scope did not whitelist the ip")
+	}
+
+	cookie := loginCookie(t, "alice", "alice_password_1", "192.0.2.41")
+	create := func(body string) int {
+		r := httptest.NewRequest("POST", "/account/apikeys", strings.NewReader(body))
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		webserver.APIKeysHandler(w, r)
+		return w.Code
+	}
+	if code := create(`{"name":"launcher","scopes":["admin"]}`); code != http.StatusBadRequest {
+		t.Errorf("Unknown scope: got %v, want 400", code)
+	}
+	if code := create(`{"name":"launcher"}`); code != http.StatusOK {
+		t.Errorf("Default scope: got %v, want 200", code)
+	}
+}
+
+// This test checks that leases are capped at api_max_lease_minutes, that only their own key renews them and that they run out
+func TestAPILeases(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	first, firstKey := apiKey("cccc3333", "firstsecret", webserver.ScopeSession)
+	second, secondKey := apiKey("dddd4444", "secondsecret", webserver.ScopeSession)
+	_, store := testWebserver(t, config.WebserverConfig{APIMaxLeaseMinutes: 10}, webserver.User{Name: "alice", Hash: hash, APIKeys: []webserver.APIKey{first, second}})
+
+	lease := decodeLease(t, callAPI("POST", "/api/session", firstKey, "192.0.2.50", `{"duration_seconds":86400}`))
+	if left := time.Until(lease.Expires); left > 10*time.Minute || left < 9*time.Minute {
+		t.Errorf("Lease asked for a day: got %v, want the 10 minute cap", left)
+	}
+
+	path := "/api/session/" + lease.ID + "/renew"
+	if w := callAPI("POST", path, secondKey, "192.0.2.50", `{"duration_seconds":60}`); w.Code != http.StatusNotFound {
+		t.Errorf("Renew with another key: got %v, want 404", w.Code)
+	}
+	renewed := decodeLease(t, callAPI("POST", path, firstKey, "192.0.2.50", `{"duration_seconds":1}`))
+	if left := time.Until(renewed.Expires); left > time.Second {
+		t.Errorf("Renewed lease: got %v left, want at most 1s", left)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if firewall.CheckWhitelist(store, "192.0.2.50") {
+		t.Error("The ip is still whitelisted after the lease ran out")
+	}
+	if w := callAPI("POST", path, firstKey, "192.0.2.50", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Renew of an expired lease: got %v, want 404", w.Code)
+	}
+}
+
+// This test checks that a lease that ends leaves the login alone while the browser of the same user still has its stream open
+func TestLeaseKeepsBrowserSession(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	key, secret := apiKey("eeee7777", "leasesecret", webserver.ScopeSession)
+	conf, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash, APIKeys: []webserver.APIKey{key}})
+	cookie := loginCookie(t, "alice", "alice_password_1", "192.0.2.55")
+	drop := startStream(t, conf, cookie, "192.0.2.55")
+
+	released := decodeLease(t, callAPI("POST", "/api/session", secret, "192.0.2.55", ""))
+	if w := callAPI("DELETE", "/api/session/"+released.ID, secret, "192.0.2.55", ""); w.Code != http.StatusOK {
+		t.Fatalf("Release: got %v %v, want 200", w.Code, w.Body.String())
+	}
+	if !firewall.HasLogin(store, "192.0.2.55", "alice") {
+		t.Fatal("The released lease logged out the browser of alice")
+	}
+
+	decodeLease(t, callAPI("POST", "/api/session", secret, "192.0.2.55", `{"duration_seconds":1}`))
+	time.Sleep(1500 * time.Millisecond)
+	if !firewall.HasLogin(store, "192.0.2.55", "alice") {
+		t.Fatal("The expired lease logged out the browser of alice")
+	}
+
+	//Without the stream the lease is the last thing keeping alice on the ip
+	drop()
+	expiring := decodeLease(t, callAPI("POST", "/api/session", secret, "192.0.2.55", `{"duration_seconds":1}`))
+	time.Sleep(1500 * time.Millisecond)
+	if firewall.HasLogin(store, "192.0.2.55", "alice") {
+		t.Errorf("alice is still logged in after lease %v ran out without a stream", expiring.ID)
+	}
+}
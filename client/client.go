@@ -0,0 +1,354 @@
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// The client keeps a whitelist session open without a browser tab, it does the same /auth + /sse dance as script_v2.js
+
+const (
+	minBackoff    = time.Second
+	maxBackoff    = time.Minute
+	stableSession = 30 * time.Second //a session that lasted this long resets the backoff
+)
+
+type Client struct {
+	baseURL  string
+	username string
+	key      string
+	http     *http.Client
+	loggedIn bool //only then there is a cookie to log out with
+}
+
+type authResponse struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// errRevoked means the server ended our session on purpose, reconnecting wont help
+type errRevoked struct{ reason string }
+
+func (e errRevoked) Error() string { return "session ended by the server: " + e.reason }
+
+// Run is the `mazarin client` subcommand
+func Run(args []string) error {
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	baseURL := fs.String("url", "", "Url of the Mazarin login page, eg https://proxy.domain.com")
+	username := fs.String("user", "", "Username to log in with")
+	keyFile := fs.String("key-file", "", "Read the key from this file instead of asking for it (MAZARIN_KEY works too)")
+	insecure := fs.Bool("insecure", false, "Accept self signed certificates (only for testing)")
+	fs.Parse(args)
+
+	if *baseURL == "" || *username == "" {
+		fs.Usage()
+		return errors.New("-url and -user are required")
+	}
+
+	key, err := readKey(*keyFile)
+	if err != nil {
+		return err
+	}
+
+	jar, _ := cookiejar.New(nil)
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if *insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	c := &Client{
+		baseURL:  strings.TrimRight(*baseURL, "/"),
+		username: *username,
+		key:      key,
+		http:     &http.Client{Jar: jar, Transport: transport},
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = c.keepAlive(ctx)
+	if c.loggedIn {
+		c.logout()
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func readKey(keyFile string) (string, error) {
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if key := os.Getenv("MAZARIN_KEY"); key != "" {
+		return key, nil
+	}
+	return prompt("Key: ", true)
+}
+
+func prompt(label string, secret bool) (string, error) {
+	fmt.Fprint(os.Stderr, label)
+	if secret && term.IsTerminal(int(os.Stdin.Fd())) {
+		data, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		return strings.TrimSpace(string(data)), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.TrimSpace(line), err
+}
+
+// keepAlive logs in and holds the sse stream open, reconnecting with backoff until ctx is done
+func (c *Client) keepAlive(ctx context.Context) error {
+	backoff := minBackoff
+	needLogin := true
+
+	for ctx.Err() == nil {
+		if needLogin {
+			if err := c.login(ctx); err != nil {
+				var revoked errRevoked
+				if errors.As(err, &revoked) {
+					return err
+				}
+				log.Printf("CLIENT: Login failed: %v, retrying in %v", err, backoff)
+				if !sleep(ctx, backoff) {
+					return nil
+				}
+				backoff = min(backoff*2, maxBackoff)
+				continue
+			}
+			needLogin = false
+		}
+
+		started := time.Now()
+		err := c.stream(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var revoked errRevoked
+		if errors.As(err, &revoked) {
+			return err
+		}
+		if errors.Is(err, errUnauthorized) {
+			//The cookie could not whitelist us again, send the key instead
+			needLogin = true
+		}
+
+		if time.Since(started) > stableSession {
+			backoff = minBackoff
+		}
+		log.Printf("CLIENT: Disconnected (%v), reconnecting in %v", err, backoff)
+		if !sleep(ctx, backoff) {
+			return nil
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+	return nil
+}
+
+var errUnauthorized = errors.New("not whitelisted")
+
+func (c *Client) login(ctx context.Context) error {
+	otp := ""
+	for {
+		body, _ := json.Marshal(map[string]string{"username": c.username, "key": c.key, "otp": otp})
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/auth", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return err
+		}
+		data, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			return errRevoked{reason: strings.TrimSpace(string(data))}
+		case resp.StatusCode != http.StatusOK:
+			return fmt.Errorf("%v: %v", resp.Status, strings.TrimSpace(string(data)))
+		}
+
+		var result authResponse
+		if err := json.Unmarshal(data, &result); err != nil {
+			return err
+		}
+		switch result.Status {
+		case "success":
+			log.Printf("CLIENT: Logged in as %v", c.username)
+			c.loggedIn = true
+			return nil
+		case "totp_required":
+			if otp, err = prompt("2FA code: ", false); err != nil {
+				return err
+			}
+		default:
+			return errRevoked{reason: result.Message}
+		}
+	}
+}
+
+// stream holds /sse open and prints the session status, it returns when the stream ends
+func (c *Client) stream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.baseURL+"/sse", nil)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return errUnauthorized
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.New(resp.Status)
+	}
+
+	connected := time.Now()
+	log.Printf("CLIENT: Connected to %v, latency %v", c.baseURL, connected.Sub(start).Round(time.Millisecond))
+
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			if err := c.handleEvent(event, strings.TrimPrefix(line, "data: "), connected); err != nil {
+				return err
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+func (c *Client) handleEvent(event, data string, connected time.Time) error {
+	switch event {
+	case "session":
+		var payload struct {
+			RemainingSeconds int `json:"remaining_seconds"`
+		}
+		json.Unmarshal([]byte(data), &payload)
+		log.Printf("CLIENT: Connected for %v, session ends in %v", time.Since(connected).Round(time.Second),
+			(time.Duration(payload.RemainingSeconds) * time.Second).Round(time.Minute))
+	case "renew":
+		var payload struct {
+			CanRenew bool `json:"can_renew"`
+		}
+		json.Unmarshal([]byte(data), &payload)
+		if !payload.CanRenew || !c.renew() {
+			log.Println("CLIENT: The session ends soon, restart the client to log in again")
+		}
+	case "notice":
+		var payload struct {
+			Message string `json:"message"`
+		}
+		json.Unmarshal([]byte(data), &payload)
+		log.Printf("CLIENT: Notice from the server: %v", payload.Message)
+	case "health":
+		var routes []struct {
+			Route   string `json:"route"`
+			Healthy bool   `json:"healthy"`
+		}
+		json.Unmarshal([]byte(data), &routes)
+		for _, route := range routes {
+			status := "online"
+			if !route.Healthy {
+				status = "offline"
+			}
+			log.Printf("CLIENT: %v is %v", route.Route, status)
+		}
+	case "close":
+		var payload struct {
+			Reason string `json:"reason"`
+		}
+		json.Unmarshal([]byte(data), &payload)
+		if payload.Reason == "server shutdown" {
+			return errors.New(payload.Reason)
+		}
+		return errRevoked{reason: payload.Reason}
+	}
+	return nil
+}
+
+// renew swaps our login cookie for a fresh one before the session runs out
+func (c *Client) renew() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/account/renew", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		log.Printf("CLIENT: Renewing the session failed: %v", err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("CLIENT: Renewing the session failed: %v", resp.Status)
+		return false
+	}
+	log.Println("CLIENT: Session renewed")
+	return true
+}
+
+// logout releases the whitelist right away instead of waiting for the server to notice the closed stream
+func (c *Client) logout() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURL+"/logout", nil)
+	if err != nil {
+		return
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		log.Printf("CLIENT: Logout failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	log.Println("CLIENT: Logged out")
+}
+
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
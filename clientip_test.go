@@ -0,0 +1,51 @@
+package main
+
+import (
+	"mazarin/firewall"
+	"net/http/httptest"
+	"testing"
+)
+
+// This test checks that only the configured forwarding header is used, only when it comes from a trusted proxy, and that spoofed hops get skipped
+func TestClientIP(t *testing.T) {
+	defer firewall.InitTrustedProxies(nil, "")
+
+	cases := []struct {
+		name       string
+		header     string //client_ip_header, empty is the default X-Forwarded-For
+		remoteAddr string
+		headers    map[string]string
+		want       string
+	}{
+		{"untrusted peer ignores headers", "", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "1.1.1.1", "CF-Connecting-IP": "1.1.1.1"}, "203.0.113.7"},
+		{"trusted peer without headers", "", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"xff skips trusted hops", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "6.6.6.6, 198.51.100.4, 172.16.0.1"}, "198.51.100.4"},
+		{"xff garbage falls back to peer", "", "10.0.0.2:5000", map[string]string{"X-Forwarded-For": "not-an-ip"}, "10.0.0.2"},
+		//A proxy that only appends X-Forwarded-For passes these on from the client as they are
+		{"spoofed cloudflare header", "", "10.0.0.2:5000", map[string]string{"CF-Connecting-IP": "6.6.6.6", "X-Forwarded-For": "198.51.100.4"}, "198.51.100.4"},
+		{"spoofed forwarded header", "", "10.0.0.2:5000", map[string]string{"Forwarded": "for=6.6.6.6"}, "10.0.0.2"},
+		{"cloudflare header", "CF-Connecting-IP", "10.0.0.2:5000", map[string]string{"CF-Connecting-IP": "198.51.100.4", "X-Forwarded-For": "6.6.6.6"}, "198.51.100.4"},
+		{"header name is case insensitive", "x-real-ip", "10.0.0.2:5000", map[string]string{"X-Real-IP": "198.51.100.4"}, "198.51.100.4"},
+		{"forwarded header", "Forwarded", "10.0.0.2:5000", map[string]string{"Forwarded": `for=192.0.2.60;proto=https, for="[2001:db8::9]:443"`}, "2001:db8::9"},
+	}
+
+	for _, c := range cases {
+		if err := firewall.InitTrustedProxies([]string{"10.0.0.0/8", "172.16.0.1"}, c.header); err != nil {
+			t.Fatalf("Failed to init trusted proxies: %v", err)
+		}
+
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = c.remoteAddr
+		for key, val := range c.headers {
+			r.Header.Set(key, val)
+		}
+
+		got, err := firewall.ClientIP(r)
+		if err != nil {
+			t.Errorf("[%v] Unexpected error: %v", c.name, err)
+		}
+		if got != c.want {
+			t.Errorf("[%v] got %v, want %v", c.name, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,412 @@
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	reconcileInterval = time.Minute //catches changes a full subscriber channel dropped
+	maxBackoff        = 30 * time.Second
+	sendQueue         = 256
+)
+
+// Node keeps the access store of this instance in sync with its peers
+type Node struct {
+	conf    config.ClusterConfig
+	store   access.Store
+	tlsConf *tls.Config
+
+	events      <-chan access.Event
+	unsubscribe func()
+
+	mu      sync.Mutex
+	records map[string]Record
+	peers   map[*peer]bool
+}
+
+type peer struct {
+	wire  *wire
+	queue chan message
+	done  chan struct{}
+	once  sync.Once
+}
+
+func (p *peer) close() {
+	p.once.Do(func() {
+		close(p.done)
+		p.wire.conn.Close()
+	})
+}
+
+// New checks the config, a cluster needs a node id and a secret or mTLS between the nodes
+func New(conf config.ClusterConfig, store access.Store) (*Node, error) {
+	if conf.NodeID == "" {
+		return nil, errors.New("cluster needs a node_id")
+	}
+	mtls := conf.CertFile != "" || conf.KeyFile != "" || conf.CAFile != ""
+	if conf.Secret == "" && !mtls {
+		return nil, errors.New("cluster needs a secret or cert_file, key_file and ca_file")
+	}
+
+	n := &Node{
+		conf:    conf,
+		store:   store,
+		records: make(map[string]Record),
+		peers:   make(map[*peer]bool),
+	}
+	if mtls {
+		tlsConf, err := loadTLS(conf)
+		if err != nil {
+			return nil, err
+		}
+		n.tlsConf = tlsConf
+	}
+
+	//Subscribed before the first reconcile so no change falls in between
+	n.events, n.unsubscribe = store.Subscribe()
+	//What is already in the store is older than anything a peer knows, so after a restart the peers win
+	n.reconcile(1)
+	return n, nil
+}
+
+func loadTLS(conf config.ClusterConfig) (*tls.Config, error) {
+	if conf.CertFile == "" || conf.KeyFile == "" || conf.CAFile == "" {
+		return nil, errors.New("mTLS needs cert_file, key_file and ca_file")
+	}
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := os.ReadFile(conf.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %v", conf.CAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
+
+// Run listens for peers, dials the configured ones and sends out local changes until ctx ends
+func (n *Node) Run(ctx context.Context) error {
+	listener, err := net.Listen("tcp", n.conf.Listen)
+	if err != nil {
+		return err
+	}
+	if n.tlsConf != nil {
+		listener = tls.NewListener(listener, n.tlsConf)
+	}
+	log.Printf("CLUSTER: Node %v listening on %v", n.conf.NodeID, listener.Addr())
+	return n.Serve(ctx, listener)
+}
+
+// Serve is Run on an existing listener, tests use it to get a free port
+func (n *Node) Serve(ctx context.Context, listener net.Listener) error {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer n.unsubscribe()
+		n.watch(ctx, n.events)
+	}()
+	go func() {
+		defer wg.Done()
+		<-ctx.Done()
+		listener.Close()
+		n.mu.Lock()
+		for p := range n.peers {
+			p.close()
+		}
+		n.mu.Unlock()
+	}()
+	for _, addr := range n.conf.Peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n.dialLoop(ctx, addr)
+		}()
+	}
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				wg.Wait()
+				return nil
+			}
+			log.Println("CLUSTER: Accept error:", err)
+			continue
+		}
+		go func() {
+			w, err := handshake(conn, n.conf.NodeID, n.conf.Secret, false)
+			if err != nil {
+				log.Printf("CLUSTER: Rejected peer %v: %v", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			n.serve(ctx, w)
+		}()
+	}
+}
+
+func (n *Node) dialLoop(ctx context.Context, addr string) {
+	backoff := time.Second
+	for {
+		started := time.Now()
+		err := n.dial(ctx, addr)
+		if ctx.Err() != nil {
+			return
+		}
+		if time.Since(started) > maxBackoff {
+			backoff = time.Second //the link was up for a while, start over
+		}
+		log.Printf("CLUSTER: Link to %v lost: %v, retrying in %v", addr, err, backoff)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (n *Node) dial(ctx context.Context, addr string) error {
+	dialer := &net.Dialer{Timeout: handshakeTimeout}
+	var conn net.Conn
+	var err error
+	if n.tlsConf != nil {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: n.tlsConf}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+
+	w, err := handshake(conn, n.conf.NodeID, n.conf.Secret, true)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	return n.serve(ctx, w)
+}
+
+// serve runs one peer connection, both sides start with a full sync so whatever was missed while apart gets fixed
+func (n *Node) serve(ctx context.Context, w *wire) error {
+	p := &peer{wire: w, queue: make(chan message, sendQueue), done: make(chan struct{})}
+	defer p.close()
+
+	n.mu.Lock()
+	if ctx.Err() != nil {
+		n.mu.Unlock()
+		return ctx.Err()
+	}
+	n.peers[p] = true
+	p.queue <- message{Type: "sync", Records: n.snapshotLocked()}
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.peers, p)
+		n.mu.Unlock()
+	}()
+	log.Printf("CLUSTER: Connected to node %v", w.peer)
+
+	go func() {
+		for {
+			select {
+			case <-p.done:
+				return
+			case msg := <-p.queue:
+				if err := w.send(msg); err != nil {
+					p.close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		msg, err := w.receive()
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case "sync", "update":
+			n.merge(msg.Records)
+		}
+	}
+}
+
+func (n *Node) snapshotLocked() []Record {
+	list := make([]Record, 0, len(n.records))
+	for _, r := range n.records {
+		list = append(list, r)
+	}
+	return list
+}
+
+// broadcastLocked queues records for every peer, a peer that can't keep up gets dropped and resyncs on reconnect
+func (n *Node) broadcastLocked(records []Record) {
+	if len(records) == 0 {
+		return
+	}
+	for p := range n.peers {
+		select {
+		case p.queue <- message{Type: "update", Records: records}:
+		default:
+			log.Printf("CLUSTER: Node %v is too slow, dropping the link", p.wire.peer)
+			p.close()
+		}
+	}
+}
+
+// merge applies the records that are newer than ours to the store and forwards them
+func (n *Node) merge(records []Record) {
+	var apply []Record
+	n.mu.Lock()
+	for _, r := range records {
+		if !r.valid() {
+			continue
+		}
+		if current, ok := n.records[r.id()]; ok && !r.newerThan(current) {
+			continue
+		}
+		n.records[r.id()] = r
+		apply = append(apply, r)
+	}
+	//Passed on so nodes that aren't linked to the sender get it too, the sender ignores it since it isn't newer
+	n.broadcastLocked(apply)
+	n.mu.Unlock()
+
+	for _, r := range apply {
+		switch {
+		case r.Kind == kindGrant && r.Deleted:
+			n.store.Revoke(r.Key)
+		case r.Kind == kindGrant:
+			n.store.Grant(*r.Grant)
+		case r.Kind == kindBan && r.Deleted:
+			n.store.Unban(r.Key)
+		case r.Kind == kindBan:
+			if err := n.store.Ban(*r.Ban); err != nil {
+				log.Printf("CLUSTER: Invalid ban %v from a peer: %v", r.Key, err)
+			}
+		}
+	}
+}
+
+// record turns a local change into a new version, changes we applied for a peer already match and are skipped
+func (n *Node) record(r Record, version int64) {
+	r.Version, r.Node = version, n.conf.NodeID
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if current, ok := n.records[r.id()]; ok && current.matches(r) {
+		return
+	}
+	if _, ok := n.records[r.id()]; !ok && r.Deleted {
+		return //never had it, nothing to delete on the peers
+	}
+	n.records[r.id()] = r
+	n.broadcastLocked([]Record{r})
+}
+
+func (n *Node) watch(ctx context.Context, events <-chan access.Event) {
+	ticker := time.NewTicker(reconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.reconcile(time.Now().UnixNano())
+			n.dropTombstones()
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			now := time.Now().UnixNano()
+			switch e.Type {
+			case access.EventGrant:
+				grant := e.Grant
+				n.record(Record{Kind: kindGrant, Key: grant.IP, Grant: &grant}, now)
+			case access.EventRevoke, access.EventExpire:
+				n.record(Record{Kind: kindGrant, Key: e.Grant.IP, Deleted: true}, now)
+			case access.EventBan:
+				ban := e.Ban
+				n.record(Record{Kind: kindBan, Key: ban.Target, Ban: &ban}, now)
+			case access.EventUnban:
+				n.record(Record{Kind: kindBan, Key: e.Ban.Target, Deleted: true}, now)
+			}
+		}
+	}
+}
+
+// reconcile compares the store with the records, anything that differs becomes a change of this node
+func (n *Node) reconcile(version int64) {
+	seen := make(map[string]bool)
+	for _, g := range n.store.List() {
+		grant := g
+		r := Record{Kind: kindGrant, Key: g.IP, Grant: &grant}
+		seen[r.id()] = true
+		n.record(r, version)
+	}
+	for _, b := range n.store.Bans() {
+		ban := b
+		r := Record{Kind: kindBan, Key: b.Target, Ban: &ban}
+		seen[r.id()] = true
+		n.record(r, version)
+	}
+
+	n.mu.Lock()
+	var gone []Record
+	for id, r := range n.records {
+		if !r.Deleted && !seen[id] {
+			gone = append(gone, Record{Kind: r.Kind, Key: r.Key, Deleted: true})
+		}
+	}
+	n.mu.Unlock()
+	for _, r := range gone {
+		n.record(r, version)
+	}
+}
+
+func (n *Node) dropTombstones() {
+	cutoff := time.Now().Add(-tombstoneTTL).UnixNano()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for id, r := range n.records {
+		if r.Deleted && r.Version < cutoff {
+			delete(n.records, id)
+		}
+	}
+}
+
+// Peers lists the node ids this node is connected to right now
+func (n *Node) Peers() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var ids []string
+	for p := range n.peers {
+		ids = append(ids, p.wire.peer)
+	}
+	return ids
+}
@@ -0,0 +1,203 @@
+package cluster
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The protocol is one json object per line. After the handshake every line is an envelope with an hmac
+// over its sequence number and body, keyed per direction, so lines can't be changed, replayed or reflected
+
+const (
+	handshakeTimeout = 10 * time.Second
+	maxLine          = 16 << 20
+)
+
+type message struct {
+	Type    string   `json:"type"` //"sync" has every record, "update" only the changed ones
+	Records []Record `json:"records,omitempty"`
+}
+
+type hello struct {
+	Node  string `json:"node"`
+	Nonce string `json:"nonce"`
+	Proof string `json:"proof,omitempty"`
+}
+
+type envelope struct {
+	Seq  uint64          `json:"seq"`
+	Body json.RawMessage `json:"body"`
+	Mac  string          `json:"mac,omitempty"`
+}
+
+var errAuth = errors.New("peer failed authentication")
+
+// wire is an authenticated connection to a peer
+type wire struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	peer    string
+	sendKey []byte
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func mac(key []byte, parts ...string) string {
+	h := hmac.New(sha256.New, key)
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeLine(conn net.Conn, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(data, '\n'))
+	return err
+}
+
+func readLine(r *bufio.Reader, v any) error {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxLine {
+			return errors.New("line too long")
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	return json.Unmarshal(line, v)
+}
+
+// handshake proves both sides know the secret (when there is one) and derives the keys for this connection
+func handshake(conn net.Conn, self, secret string, dialer bool) (*wire, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	w := &wire{conn: conn, reader: bufio.NewReader(conn)}
+	key := []byte(secret)
+	own := hello{Node: self, Nonce: newNonce()}
+
+	var dialNonce, listenNonce, dialNode, listenNode string
+	if dialer {
+		if err := writeLine(conn, own); err != nil {
+			return nil, err
+		}
+		var theirs hello
+		if err := readLine(w.reader, &theirs); err != nil {
+			return nil, err
+		}
+		dialNonce, listenNonce, dialNode, listenNode = own.Nonce, theirs.Nonce, self, theirs.Node
+		if secret != "" && !hmac.Equal([]byte(theirs.Proof), []byte(mac(key, "listen", dialNonce, listenNonce, dialNode, listenNode))) {
+			return nil, errAuth
+		}
+		proof := hello{Node: self}
+		if secret != "" {
+			proof.Proof = mac(key, "dial", dialNonce, listenNonce, dialNode, listenNode)
+		}
+		if err := writeLine(conn, proof); err != nil {
+			return nil, err
+		}
+		w.peer = listenNode
+	} else {
+		var theirs hello
+		if err := readLine(w.reader, &theirs); err != nil {
+			return nil, err
+		}
+		dialNonce, listenNonce, dialNode, listenNode = theirs.Nonce, own.Nonce, theirs.Node, self
+		if secret != "" {
+			own.Proof = mac(key, "listen", dialNonce, listenNonce, dialNode, listenNode)
+		}
+		if err := writeLine(conn, own); err != nil {
+			return nil, err
+		}
+		var proof hello
+		if err := readLine(w.reader, &proof); err != nil {
+			return nil, err
+		}
+		if secret != "" && !hmac.Equal([]byte(proof.Proof), []byte(mac(key, "dial", dialNonce, listenNonce, dialNode, listenNode))) {
+			return nil, errAuth
+		}
+		w.peer = dialNode
+	}
+
+	if w.peer == "" || w.peer == self {
+		return nil, fmt.Errorf("peer has an empty or our own node id %q", w.peer)
+	}
+	if len(dialNonce) != 32 || len(listenNonce) != 32 {
+		return nil, errors.New("invalid nonce")
+	}
+
+	if secret != "" {
+		toListener, _ := hex.DecodeString(mac(key, "dial-key", dialNonce, listenNonce))
+		toDialer, _ := hex.DecodeString(mac(key, "listen-key", dialNonce, listenNonce))
+		if dialer {
+			w.sendKey, w.recvKey = toListener, toDialer
+		} else {
+			w.sendKey, w.recvKey = toDialer, toListener
+		}
+	}
+	return w, nil
+}
+
+func seqBytes(seq uint64) string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return string(b)
+}
+
+func (w *wire) send(msg message) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	w.sendSeq++
+	env := envelope{Seq: w.sendSeq, Body: body}
+	if w.sendKey != nil {
+		env.Mac = mac(w.sendKey, seqBytes(env.Seq), string(body))
+	}
+	return writeLine(w.conn, env)
+}
+
+func (w *wire) receive() (message, error) {
+	var env envelope
+	if err := readLine(w.reader, &env); err != nil {
+		return message{}, err
+	}
+	if env.Seq != w.recvSeq+1 {
+		return message{}, fmt.Errorf("expected sequence %v, got %v", w.recvSeq+1, env.Seq)
+	}
+	if w.recvKey != nil && !hmac.Equal([]byte(env.Mac), []byte(mac(w.recvKey, seqBytes(env.Seq), string(env.Body)))) {
+		return message{}, errAuth
+	}
+	w.recvSeq = env.Seq
+
+	var msg message
+	err := json.Unmarshal(env.Body, &msg)
+	return msg, err
+}
@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"mazarin/access"
+	"slices"
+	"time"
+)
+
+const (
+	kindGrant = "grant"
+	kindBan   = "ban"
+
+	tombstoneTTL = 24 * time.Hour //deletes are remembered this long so a node that was away can't bring them back
+)
+
+// Record is the replicated state of one ip (grant) or one target (ban), the newest version wins
+type Record struct {
+	Kind    string        `json:"kind"`
+	Key     string        `json:"key"`
+	Grant   *access.Grant `json:"grant,omitempty"`
+	Ban     *access.Ban   `json:"ban,omitempty"`
+	Deleted bool          `json:"deleted,omitempty"`
+	Version int64         `json:"version"` //unix nanos of the change
+	Node    string        `json:"node"`    //breaks ties between changes in the same nanosecond
+}
+
+func (r Record) id() string {
+	return r.Kind + "/" + r.Key
+}
+
+func (r Record) newerThan(other Record) bool {
+	if r.Version != other.Version {
+		return r.Version > other.Version
+	}
+	return r.Node > other.Node
+}
+
+func sameGrant(a, b access.Grant) bool {
+	return a.IP == b.IP && a.User == b.User && a.GroupID == b.GroupID && a.Note == b.Note && a.Source == b.Source && a.Expires.Equal(b.Expires) && a.EntryExpires.Equal(b.EntryExpires) &&
+		slices.EqualFunc(a.Logins, b.Logins, func(x, y access.Login) bool {
+			return x.User == y.User && x.GroupID == y.GroupID && x.Expires.Equal(y.Expires)
+		})
+}
+
+func sameBan(a, b access.Ban) bool {
+	return a.Target == b.Target && a.Reason == b.Reason && a.Expires.Equal(b.Expires)
+}
+
+// matches is true when the record already describes this state, used to not send back what a peer just sent us
+func (r Record) matches(other Record) bool {
+	if r.Deleted || other.Deleted {
+		return r.Deleted == other.Deleted
+	}
+	switch r.Kind {
+	case kindGrant:
+		return sameGrant(*r.Grant, *other.Grant)
+	case kindBan:
+		return sameBan(*r.Ban, *other.Ban)
+	}
+	return false
+}
+
+func (r Record) valid() bool {
+	if r.Key == "" || r.Node == "" {
+		return false
+	}
+	switch r.Kind {
+	case kindGrant:
+		return r.Deleted || (r.Grant != nil && r.Grant.IP == r.Key)
+	case kindBan:
+		return r.Deleted || (r.Ban != nil && r.Ban.Target == r.Key)
+	}
+	return false
+}
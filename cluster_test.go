@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"mazarin/access"
+	"mazarin/cluster"
+	"mazarin/config"
+	"net"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	store *access.MemoryStore
+	node  *cluster.Node
+}
+
+func startNode(t *testing.T, ctx context.Context, id, secret string, listener net.Listener, peers ...string) testNode {
+	t.Helper()
+	store := access.NewMemoryStore()
+	node, err := cluster.New(config.ClusterConfig{NodeID: id, Secret: secret, Peers: peers}, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go node.Serve(ctx, listener)
+	return testNode{store: store, node: node}
+}
+
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return listener
+}
+
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// This test checks that grants, revokes and bans replicate between nodes on localhost, late nodes catch up and a wrong secret is rejected
+func TestClusterSync(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	la, lb, lc, ld := listen(t), listen(t), listen(t), listen(t)
+	a := startNode(t, ctx, "a", "secret", la)
+	b := startNode(t, ctx, "b", "secret", lb, la.Addr().String())
+
+	a.store.Grant(access.Grant{IP: "10.0.0.1", User: "bob", GroupID: 1})
+	eventually(t, "grant on b", func() bool {
+		g, ok := b.store.Lookup("10.0.0.1")
+		return ok && g.User == "bob" && g.GroupID == 1
+	})
+
+	//c joins late and gets everything in the first sync
+	c := startNode(t, ctx, "c", "secret", lc, lb.Addr().String())
+	eventually(t, "grant on c", func() bool {
+		_, ok := c.store.Lookup("10.0.0.1")
+		return ok
+	})
+
+	b.store.Revoke("10.0.0.1")
+	eventually(t, "revoke on a and c", func() bool {
+		_, onA := a.store.Lookup("10.0.0.1")
+		_, onC := c.store.Lookup("10.0.0.1")
+		return !onA && !onC
+	})
+
+	a.store.Grant(access.Grant{IP: "10.0.1.5", User: "eve"})
+	eventually(t, "grant on c", func() bool {
+		_, ok := c.store.Lookup("10.0.1.5")
+		return ok
+	})
+	ban, err := access.NewBan("10.0.1.0/24", "testing", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.store.Ban(ban)
+	eventually(t, "ban on a", func() bool {
+		_, banned := a.store.Banned("10.0.1.5")
+		_, granted := a.store.Lookup("10.0.1.5")
+		return banned && !granted
+	})
+
+	d := startNode(t, ctx, "d", "wrong", ld, la.Addr().String())
+	time.Sleep(300 * time.Millisecond)
+	if len(d.node.Peers()) != 0 || len(d.store.Bans()) != 0 {
+		t.Error("node with the wrong secret got connected")
+	}
+}
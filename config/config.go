@@ -16,17 +16,34 @@ import (
 // CONFIG
 // ----
 type ProxyConfig struct {
-	ListenUrl     string            `json:"listen_url"`
-	ListenUrls    []string          `json:"listen_urls"`
-	Path          string            `json:"path"`
-	Port          string            `json:"port"`
-	Ports         []string          `json:"ports"`
-	TargetAddr    string            `json:"target_addr"`
-	Type          string            `json:"type"`
-	Protocol      string            `json:"protocol"`
-	AllowInsecure bool              `json:"allow_insecure"`
-	NoHeaders     bool              `json:"no_headers"`
-	Headers       map[string]string `json:"headers"`
+	Name              string            `json:"name"`
+	ListenUrl         string            `json:"listen_url"`
+	ListenUrls        []string          `json:"listen_urls"`
+	Path              string            `json:"path"`
+	Port              string            `json:"port"`
+	Ports             []string          `json:"ports"`
+	TargetAddr        string            `json:"target_addr"`
+	Type              string            `json:"type"`
+	Protocol          string            `json:"protocol"`
+	AllowInsecure     bool              `json:"allow_insecure"`
+	NoHeaders         bool              `json:"no_headers"`
+	Headers           map[string]string `json:"headers"`
+	RateLimit         int64             `json:"rate_limit"`
+	Motd              string            `json:"motd"`
+	SendProxyProtocol string            `json:"send_proxy_protocol"`
+	Auth              string            `json:"auth"`
+	ExtAuthz          *ExtAuthzConfig   `json:"ext_authz"`
+	DialTimeout       int               `json:"dial_timeout_seconds"` //tcp/udp, minecraft and sni routes, 0 is 10 seconds
+	IdleTimeout       int               `json:"idle_timeout_seconds"` //close after this long without bytes in either direction, 0 never
+	MaxLifetime       int               `json:"max_lifetime_seconds"` //close after this long no matter what, 0 never
+}
+
+// ----
+type ExtAuthzConfig struct {
+	URL       string `json:"url"`
+	TimeoutMs int    `json:"timeout_ms"`
+	CacheTTL  int    `json:"cache_ttl"`
+	FailOpen  bool   `json:"fail_open"`
 }
 
 // ----
@@ -39,18 +56,92 @@ type TLSConfig struct {
 
 // ----
 type FirewallConfig struct {
-	EnableFirewall bool `json:"enable_firewall"`
-	DefaultAllow   bool `json:"default_allow"`
+	EnableFirewall    bool                   `json:"enable_firewall"`
+	DefaultAllow      bool                   `json:"default_allow"`
+	ProxyProtocolFrom []string               `json:"proxy_protocol_from"`
+	TrustedProxies    []string               `json:"trusted_proxies"`
+	ClientIPHeader    string                 `json:"client_ip_header"` //header the trusted proxies set, default X-Forwarded-For
+	StaticWhitelist   []StaticWhitelistEntry `json:"static_whitelist"`
+}
+
+// An ip or cidr that is whitelisted without an account
+type StaticWhitelistEntry struct {
+	Target  string    `json:"target"`
+	Expires time.Time `json:"expires"` //optional, RFC 3339 eg "2026-06-01T23:00:00+02:00"
+	Note    string    `json:"note"`
+	GroupID int       `json:"permission_group_id"`
+}
+
+// ----
+// Local unix socket for the mazarin subcommands, see control/
+type ControlConfig struct {
+	Enable bool   `json:"enable"`
+	Socket string `json:"socket"` //default "mazarin.sock", relative to the working directory
 }
 
 // ----
 type WebserverConfig struct {
-	EnableWebServer bool   `json:"enable_webserver"`
-	ListenPort      string `json:"listen_port"`
-	ListenURL       string `json:"listen_url"`
-	StaticDir       string `json:"static_dir"`
-	KeysDir         string `json:"keys_dir"`
-	DbDir           string `json:"db_dir"`
+	EnableWebServer    bool          `json:"enable_webserver"`
+	ListenPort         string        `json:"listen_port"`
+	ListenURL          string        `json:"listen_url"`
+	StaticDir          string        `json:"static_dir"`
+	KeysDir            string        `json:"keys_dir"`
+	EnableDB           bool          `json:"enable_db"` //keep users and sessions in the sqlite db instead of keys.json and sessions.json
+	DbDir              string        `json:"db_dir"`
+	CookieDomain       string        `json:"cookie_domain"`
+	SessionHours       int           `json:"session_hours"`
+	RequireTotp        bool          `json:"require_totp"`
+	Lockout            LockoutConfig `json:"lockout"`
+	EnableRegister     bool          `json:"enable_registration"`
+	RequireApproval    bool          `json:"requires_approval"` //registered users stay pending until an admin approves them
+	Hashing            HashingConfig `json:"hashing"`
+	APIMaxLeaseMinutes int           `json:"api_max_lease_minutes"` //longest an api key can whitelist an ip at once
+	GracePeriodSeconds int           `json:"grace_period_seconds"`  //how long an ip stays whitelisted after its sse stream dropped
+}
+
+// Hashing policy for new keys, zero values fall back to the defaults in webserver/hashing.go
+type HashingConfig struct {
+	Algorithm     string `json:"algorithm"` //bcrypt or argon2id
+	BcryptCost    int    `json:"bcrypt_cost"`
+	Argon2Memory  uint32 `json:"argon2_memory"` //KiB
+	Argon2Time    uint32 `json:"argon2_time"`
+	Argon2Threads uint8  `json:"argon2_threads"`
+}
+
+// Account lockout after failed logins, zero values fall back to the defaults in webserver/lockout.go
+type LockoutConfig struct {
+	MaxAttempts    int `json:"max_attempts"`
+	LockMinutes    int `json:"lock_minutes"`     //first lock, doubles on every next lock
+	MaxLockMinutes int `json:"max_lock_minutes"` //cap for the doubling
+}
+
+// LoginURL is where users find our auth page, empty when the webserver is disabled
+func (conf *WebserverConfig) LoginURL(tlsConf *TLSConfig) string {
+	if !conf.EnableWebServer {
+		return ""
+	}
+	scheme := "http://"
+	if tlsConf.EnableTLS && slices.Contains(tlsConf.Domains, conf.ListenURL) {
+		scheme = "https://"
+	}
+	port := conf.ListenPort
+	if (scheme == "https://" && port == ":443") || (scheme == "http://" && port == ":80") {
+		port = ""
+	}
+	return scheme + conf.ListenURL + port
+}
+
+// ----
+type PermissionGroup struct {
+	ID     int      `json:"id"`
+	Name   string   `json:"name"`
+	Routes []string `json:"routes"` //proxy name, port (":25565") or host, "*" for everything
+}
+
+// ----
+type LimitsConfig struct {
+	GlobalRate int64 `json:"global_rate"`
+	UserRate   int64 `json:"user_rate"`
 }
 
 // ----
@@ -60,13 +151,30 @@ type LoggingConfig struct {
 	logFile       *os.File
 }
 
+// ----
+// Peer sync between mazarin instances, see cluster/
+type ClusterConfig struct {
+	Enable   bool     `json:"enable"`
+	NodeID   string   `json:"node_id"` //unique per instance
+	Listen   string   `json:"listen"`  //eg ":47400"
+	Peers    []string `json:"peers"`   //host:port of the other nodes
+	Secret   string   `json:"secret"`  //shared between every node, authenticates the links
+	CertFile string   `json:"cert_file"`
+	KeyFile  string   `json:"key_file"`
+	CAFile   string   `json:"ca_file"` //with cert and key set the nodes use mTLS and only trust certs from this ca
+}
+
 // ----
 type Config struct {
-	Proxy     []ProxyConfig   `json:"proxies"`
-	TLS       TLSConfig       `json:"tls"`
-	Firewall  FirewallConfig  `json:"firewall"`
-	Logging   LoggingConfig   `json:"logging"`
-	Webserver WebserverConfig `json:"webserver"`
+	Proxy     []ProxyConfig     `json:"proxies"`
+	TLS       TLSConfig         `json:"tls"`
+	Firewall  FirewallConfig    `json:"firewall"`
+	Logging   LoggingConfig     `json:"logging"`
+	Webserver WebserverConfig   `json:"webserver"`
+	Limits    LimitsConfig      `json:"limits"`
+	Groups    []PermissionGroup `json:"permission_groups"`
+	Cluster   ClusterConfig     `json:"cluster"`
+	Control   ControlConfig     `json:"control"`
 }
 
 func LoadConfig() (Config, error) {
@@ -206,7 +314,8 @@ func (conf *LoggingConfig) Close() error {
 type ParsedProxy struct {
 	Port          string
 	Protocol      string
-	TLS           bool
+	TLS           bool   //for sni this means terminated web routes share the port
+	Motd          string //minecraft only, the server list message for unknown addresses on this port
 	LinkedProxies []*ProxyConfig
 }
 
@@ -217,13 +326,32 @@ func ParseProxies(toParse []ProxyConfig, tlsConf *TLSConfig) (map[string]ParsedP
 		if proxies.Path != "" {
 			proxies.ListenUrl = proxies.ListenUrl + proxies.Path
 		}
+		if proxies.SendProxyProtocol != "" && proxies.SendProxyProtocol != "v1" && proxies.SendProxyProtocol != "v2" {
+			return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: send_proxy_protocol has to be v1 or v2")
+		}
+		if proxies.Auth != "" && (proxies.Auth != "session" || proxies.Protocol != "web") {
+			return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: auth can only be \"session\" and only on web proxies")
+		}
+		if proxies.ExtAuthz != nil && (proxies.ExtAuthz.URL == "" || proxies.Protocol != "web") {
+			return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: ext_authz needs an url and only works on web proxies")
+		}
 		switch proxies.Protocol {
 		case "web":
 			toBeRouted = append(toBeRouted, proxies)
 			allowed, ok := parsedProxyMap[proxies.Port]
 			if ok {
+				if allowed.Protocol == "sni" {
+					//The sni listener hands every hostname it doesnt passthrough to our https server
+					if !slices.Contains(tlsConf.Domains, proxies.ListenUrl) {
+						return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a http proxy and a sni proxy on the same port, only https web proxies can share a port with sni")
+					}
+					allowed.TLS = true
+					allowed.LinkedProxies = append(allowed.LinkedProxies, &proxies)
+					parsedProxyMap[proxies.Port] = allowed
+					continue
+				}
 				if allowed.Protocol != "web" {
-					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a tcp/udp proxy and a web proxy on the same port, both need to be web proxies")
+					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a web proxy and a " + allowed.Protocol + " proxy on the same port")
 				}
 				if tlsConf.EnableTLS && slices.Contains(tlsConf.Domains, proxies.ListenUrl) && !allowed.TLS {
 					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a http and https proxy on the same port")
@@ -233,6 +361,7 @@ func ParseProxies(toParse []ProxyConfig, tlsConf *TLSConfig) (map[string]ParsedP
 				}
 
 				allowed.LinkedProxies = append(allowed.LinkedProxies, &proxies)
+				parsedProxyMap[proxies.Port] = allowed
 				continue
 			}
 
@@ -248,7 +377,7 @@ func ParseProxies(toParse []ProxyConfig, tlsConf *TLSConfig) (map[string]ParsedP
 			allowed, ok := parsedProxyMap[proxies.Port]
 			if ok {
 				if allowed.Protocol != "tcp/udp" {
-					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a tcp/udp proxy and a web proxy on the same port, both need to be web proxies")
+					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a tcp/udp proxy and a " + allowed.Protocol + " proxy on the same port")
 				}
 				return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have multiple tcp/udp proxies on the same port, use type: web for this")
 			}
@@ -260,6 +389,71 @@ func ParseProxies(toParse []ProxyConfig, tlsConf *TLSConfig) (map[string]ParsedP
 			newProxy.LinkedProxies = append(newProxy.LinkedProxies, &proxies)
 			parsedProxyMap[newProxy.Port] = newProxy
 
+		case "minecraft":
+			//Minecraft proxies get routed by the hostname in the handshake, so multiple can share a port
+			allowed, ok := parsedProxyMap[proxies.Port]
+			if ok {
+				if allowed.Protocol != "minecraft" {
+					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a minecraft proxy and a " + allowed.Protocol + " proxy on the same port")
+				}
+				for _, linked := range allowed.LinkedProxies {
+					if strings.EqualFold(linked.ListenUrl, proxies.ListenUrl) {
+						return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have two minecraft proxies with the same listen_url on the same port")
+					}
+				}
+				//The motd belongs to the port, so only one of its proxies may set it
+				if proxies.Motd != "" {
+					if allowed.Motd != "" && allowed.Motd != proxies.Motd {
+						return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Only one minecraft proxy per port can set motd, it is shown for every unknown address on that port")
+					}
+					allowed.Motd = proxies.Motd
+				}
+
+				allowed.LinkedProxies = append(allowed.LinkedProxies, &proxies)
+				parsedProxyMap[proxies.Port] = allowed
+				continue
+			}
+
+			newProxy := ParsedProxy{
+				Port:     proxies.Port,
+				Protocol: "minecraft",
+				Motd:     proxies.Motd,
+			}
+			newProxy.LinkedProxies = append(newProxy.LinkedProxies, &proxies)
+			parsedProxyMap[newProxy.Port] = newProxy
+
+		case "sni":
+			//TLS passthrough routed by the ClientHello server name, a sni proxy without listen_url is the fallback target
+			allowed, ok := parsedProxyMap[proxies.Port]
+			if ok {
+				switch allowed.Protocol {
+				case "sni":
+				case "web":
+					if !allowed.TLS {
+						return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a sni proxy and a http proxy on the same port, only https web proxies can share a port with sni")
+					}
+					allowed.Protocol = "sni"
+				default:
+					return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have a sni proxy and a " + allowed.Protocol + " proxy on the same port")
+				}
+				for _, linked := range allowed.LinkedProxies {
+					if linked.Protocol == "sni" && strings.EqualFold(linked.ListenUrl, proxies.ListenUrl) {
+						return parsedProxyMap, toBeRouted, errors.New("PARSER ERROR: Cant have two sni proxies with the same listen_url on the same port")
+					}
+				}
+
+				allowed.LinkedProxies = append(allowed.LinkedProxies, &proxies)
+				parsedProxyMap[proxies.Port] = allowed
+				continue
+			}
+
+			newProxy := ParsedProxy{
+				Port:     proxies.Port,
+				Protocol: "sni",
+			}
+			newProxy.LinkedProxies = append(newProxy.LinkedProxies, &proxies)
+			parsedProxyMap[newProxy.Port] = newProxy
+
 		}
 	}
 	return parsedProxyMap, toBeRouted, nil
@@ -2,6 +2,7 @@ package main
 
 import (
 	"mazarin/config"
+	"strings"
 	"testing"
 )
 
@@ -191,3 +192,38 @@ func TestParseMulti(t *testing.T) {
 		}
 	}
 }
+
+// This test checks that port conflicts name the protocol that already holds the port, and that the minecraft motd is set per port
+func TestParseProxiesConflicts(t *testing.T) {
+	tlsConf := &config.TLSConfig{}
+	minecraft := config.ProxyConfig{ListenUrl: "survival.domain.com", Port: ":25565", TargetAddr: "127.0.0.1:25566", Protocol: "minecraft", Motd: "Try survival.domain.com"}
+
+	cases := []struct {
+		name    string
+		proxies []config.ProxyConfig
+		want    string //part of the error, empty for no error
+	}{
+		{"tcp after minecraft", []config.ProxyConfig{minecraft, {Port: ":25565", TargetAddr: "127.0.0.1:1", Protocol: "tcp"}}, "a tcp/udp proxy and a minecraft proxy"},
+		{"web after minecraft", []config.ProxyConfig{minecraft, {ListenUrl: "a.domain.com", Port: ":25565", Protocol: "web", Type: "proxy"}}, "a web proxy and a minecraft proxy"},
+		{"web after tcp", []config.ProxyConfig{{Port: ":80", Protocol: "tcp"}, {ListenUrl: "a.domain.com", Port: ":80", Protocol: "web", Type: "proxy"}}, "a web proxy and a tcp/udp proxy"},
+		{"tcp after sni", []config.ProxyConfig{{ListenUrl: "a.domain.com", Port: ":443", Protocol: "sni"}, {Port: ":443", Protocol: "tcp"}}, "a tcp/udp proxy and a sni proxy"},
+		{"two motds", []config.ProxyConfig{minecraft, {ListenUrl: "creative.domain.com", Port: ":25565", Protocol: "minecraft", Motd: "Something else"}}, "Only one minecraft proxy per port can set motd"},
+		{"one motd", []config.ProxyConfig{{ListenUrl: "creative.domain.com", Port: ":25565", Protocol: "minecraft"}, minecraft}, ""},
+	}
+
+	for _, c := range cases {
+		_, _, err := config.ParseProxies(c.proxies, tlsConf)
+		switch {
+		case c.want == "" && err != nil:
+			t.Errorf("[%v] Unexpected error: %v", c.name, err)
+		case c.want != "" && (err == nil || !strings.Contains(err.Error(), c.want)):
+			t.Errorf("[%v] Error: got %v, want %q", c.name, err, c.want)
+		}
+	}
+
+	//The motd does not depend on which proxy came first
+	parsed, _, _ := config.ParseProxies([]config.ProxyConfig{{ListenUrl: "creative.domain.com", Port: ":25565", Protocol: "minecraft"}, minecraft}, tlsConf)
+	if parsed[":25565"].Motd != minecraft.Motd {
+		t.Errorf("Motd: got %q, want %q", parsed[":25565"].Motd, minecraft.Motd)
+	}
+}
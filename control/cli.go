@@ -0,0 +1,337 @@
+package control
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/webserver"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands are the `mazarin <name>` subcommands that talk to the running instance
+var Commands = map[string]func(args []string) error{
+	"status":    RunStatus,
+	"routes":    RunRoutes,
+	"sessions":  RunSessions,
+	"whitelist": RunWhitelist,
+	"ban":       RunBan,
+	"unban":     RunUnban,
+	"reload":    RunReload,
+	"user":      RunUser,
+	"cert":      RunCert,
+}
+
+// defaultSocket uses the socket from config.json when it can be read, the subcommands run next to it
+func defaultSocket() string {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return DefaultSocket
+	}
+	return SocketPath(cfg.Control)
+}
+
+// newFlags makes the flag set of a subcommand, every one of them takes -socket
+func newFlags(name string) (*flag.FlagSet, *string) {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	socket := fs.String("socket", defaultSocket(), "Control socket of the running mazarin")
+	return fs, socket
+}
+
+// parseInterspersed lets flags come before and after the positional args, `add 1.2.3.4 --for 6h` reads better
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// parseArgs parses the flags and checks the amount of positional args
+func parseArgs(fs *flag.FlagSet, args []string, want int, usage string) ([]string, error) {
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return nil, err
+	}
+	if len(positional) != want {
+		return nil, errors.New("usage: " + usage)
+	}
+	return positional, nil
+}
+
+// subcommand splits `whitelist add ...` into add and the rest, def is used when there is no subcommand
+func subcommand(args []string, def string) (string, []string) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return def, args
+	}
+	return args[0], args[1:]
+}
+
+func table() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+}
+
+func timeText(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+func untilText(t time.Time, forever string) string {
+	if t.IsZero() {
+		return forever
+	}
+	return "until " + timeText(t)
+}
+
+func noteSuffix(note string) string {
+	if strings.TrimSpace(note) == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (%v)", note)
+}
+
+// RunStatus is `mazarin status`
+func RunStatus(args []string) error {
+	fs, socket := newFlags("status")
+	if _, err := parseArgs(fs, args, 0, "mazarin status"); err != nil {
+		return err
+	}
+	var s Status
+	if err := Call(*socket, "status", nil, &s); err != nil {
+		return err
+	}
+
+	fmt.Printf("Mazarin %v, up since %v (%v)\n", s.Version, timeText(s.Started), time.Since(s.Started).Round(time.Second))
+	fmt.Printf("Routes:      %v\n", s.Routes)
+	if s.Webserver {
+		fmt.Printf("Users:       %v\n", s.Users)
+		fmt.Printf("Sessions:    %v\n", s.Sessions)
+	} else {
+		fmt.Println("Webserver:   disabled")
+	}
+	fmt.Printf("Whitelisted: %v\n", s.Whitelisted)
+	fmt.Printf("Bans:        %v\n", s.Bans)
+	if s.Cluster {
+		fmt.Printf("Peers:       %v connected %v\n", len(s.Peers), strings.Join(s.Peers, ", "))
+	}
+	return nil
+}
+
+// RunRoutes is `mazarin routes`
+func RunRoutes(args []string) error {
+	fs, socket := newFlags("routes")
+	if _, err := parseArgs(fs, args, 0, "mazarin routes"); err != nil {
+		return err
+	}
+	var list []RouteInfo
+	if err := Call(*socket, "routes", nil, &list); err != nil {
+		return err
+	}
+
+	w := table()
+	fmt.Fprintln(w, "NAME\tPORT\tPROTOCOL\tTYPE\tTARGET\tHEALTH")
+	for _, r := range list {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", r.Name, r.Port, r.Protocol, r.Type, r.Target, r.Health)
+	}
+	return w.Flush()
+}
+
+// RunSessions is `mazarin sessions [list]` and `mazarin sessions kick <user> [--message "..."]`
+func RunSessions(args []string) error {
+	cmd, args := subcommand(args, "list")
+	fs, socket := newFlags("sessions " + cmd)
+	switch cmd {
+	case "list":
+		if _, err := parseArgs(fs, args, 0, "mazarin sessions list"); err != nil {
+			return err
+		}
+		var list []webserver.SessionInfo
+		if err := Call(*socket, "sessions.list", nil, &list); err != nil {
+			return err
+		}
+		w := table()
+		fmt.Fprintln(w, "ID\tUSER\tIP\tGROUP\tSTARTED\tEXPIRES")
+		for _, s := range list {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", s.ID, s.User, s.IP, s.Group, timeText(s.Started), timeText(s.Expires))
+		}
+		return w.Flush()
+
+	case "kick":
+		message := fs.String("message", "", "Shown to the user on their login page")
+		positional, err := parseArgs(fs, args, 1, "mazarin sessions kick <user> [--message \"...\"]")
+		if err != nil {
+			return err
+		}
+		if err := Call(*socket, "sessions.kick", KickArgs{User: positional[0], Message: *message}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Kicked %v\n", positional[0])
+		return nil
+	}
+	return errors.New("usage: mazarin sessions [list|kick]")
+}
+
+// RunWhitelist is `mazarin whitelist list|add|remove`
+func RunWhitelist(args []string) error {
+	cmd, args := subcommand(args, "list")
+	fs, socket := newFlags("whitelist " + cmd)
+	switch cmd {
+	case "list":
+		if _, err := parseArgs(fs, args, 0, "mazarin whitelist list"); err != nil {
+			return err
+		}
+		var grants []access.Grant
+		if err := Call(*socket, "whitelist.list", nil, &grants); err != nil {
+			return err
+		}
+		w := table()
+		fmt.Fprintln(w, "IP\tUSER\tGROUP\tEXPIRES\tNOTE")
+		for _, g := range grants {
+			who := g.User
+			if who == "" {
+				who = "(" + g.Source + ")"
+			}
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", g.IP, who, g.GroupID, timeText(g.Expires), g.Note)
+		}
+		return w.Flush()
+
+	case "add":
+		duration := fs.Duration("for", 0, "How long the entry stays, eg 6h or 30m (default until removed)")
+		note := fs.String("note", "", "Why this ip is whitelisted, shows up in logs and listings")
+		group := fs.Int("group", 0, "Permission group of the entry (default every route)")
+		positional, err := parseArgs(fs, args, 1, "mazarin whitelist add <ip|cidr> [--for 6h] [--note \"...\"] [--group id]")
+		if err != nil {
+			return err
+		}
+		if *duration < 0 {
+			return errors.New("--for can't be negative")
+		}
+
+		var grant access.Grant
+		req := WhitelistAddArgs{Target: positional[0], Seconds: int64(duration.Seconds()), Note: *note, GroupID: *group}
+		if err := Call(*socket, "whitelist.add", req, &grant); err != nil {
+			return err
+		}
+		fmt.Printf("Whitelisted %v %v%v\n", grant.IP, untilText(grant.Expires, "until removed"), noteSuffix(grant.Note))
+		return nil
+
+	case "remove":
+		positional, err := parseArgs(fs, args, 1, "mazarin whitelist remove <ip|cidr>")
+		if err != nil {
+			return err
+		}
+		if err := Call(*socket, "whitelist.remove", TargetArgs{Target: positional[0]}, nil); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %v from the whitelist\n", positional[0])
+		return nil
+	}
+	return errors.New("usage: mazarin whitelist [list|add|remove]")
+}
+
+// RunBan is `mazarin ban <ip|cidr> [--for 1h] [--reason "..."]` and `mazarin ban list`
+func RunBan(args []string) error {
+	fs, socket := newFlags("ban")
+	if len(args) > 0 && args[0] == "list" {
+		if _, err := parseArgs(fs, args[1:], 0, "mazarin ban list"); err != nil {
+			return err
+		}
+		var bans []access.Ban
+		if err := Call(*socket, "bans.list", nil, &bans); err != nil {
+			return err
+		}
+		w := table()
+		fmt.Fprintln(w, "TARGET\tCREATED\tEXPIRES\tREASON")
+		for _, b := range bans {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", b.Target, timeText(b.Created), timeText(b.Expires), b.Reason)
+		}
+		return w.Flush()
+	}
+
+	duration := fs.Duration("for", 0, "How long the ban lasts, eg 1h (default until unbanned)")
+	reason := fs.String("reason", "", "Why the ip is banned, shows up in logs and listings")
+	positional, err := parseArgs(fs, args, 1, "mazarin ban <ip|cidr> [--for 1h] [--reason \"...\"]")
+	if err != nil {
+		return err
+	}
+	if *duration < 0 {
+		return errors.New("--for can't be negative")
+	}
+
+	var b access.Ban
+	if err := Call(*socket, "ban", BanArgs{Target: positional[0], Reason: *reason, Seconds: int64(duration.Seconds())}, &b); err != nil {
+		return err
+	}
+	fmt.Printf("Banned %v %v%v\n", b.Target, untilText(b.Expires, "until unbanned"), noteSuffix(b.Reason))
+	return nil
+}
+
+// RunUnban is `mazarin unban <ip|cidr>`
+func RunUnban(args []string) error {
+	fs, socket := newFlags("unban")
+	positional, err := parseArgs(fs, args, 1, "mazarin unban <ip|cidr>")
+	if err != nil {
+		return err
+	}
+	if err := Call(*socket, "unban", TargetArgs{Target: positional[0]}, nil); err != nil {
+		return err
+	}
+	fmt.Printf("Unbanned %v\n", positional[0])
+	return nil
+}
+
+// RunReload is `mazarin reload`, same as a SIGHUP plus the static whitelist
+func RunReload(args []string) error {
+	fs, socket := newFlags("reload")
+	if _, err := parseArgs(fs, args, 0, "mazarin reload"); err != nil {
+		return err
+	}
+	if err := Call(*socket, "reload", nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("Reloaded the users and the static whitelist")
+	return nil
+}
+
+// RunCert is `mazarin cert [status]`
+func RunCert(args []string) error {
+	cmd, args := subcommand(args, "status")
+	if cmd != "status" {
+		return errors.New("usage: mazarin cert status")
+	}
+	fs, socket := newFlags("cert status")
+	if _, err := parseArgs(fs, args, 0, "mazarin cert status"); err != nil {
+		return err
+	}
+	var s CertStatus
+	if err := Call(*socket, "cert.status", nil, &s); err != nil {
+		return err
+	}
+
+	fmt.Printf("File:     %v\n", s.File)
+	fmt.Printf("Subject:  %v\n", s.Subject)
+	fmt.Printf("Issuer:   %v\n", s.Issuer)
+	fmt.Printf("Names:    %v\n", strings.Join(s.Names, ", "))
+	fmt.Printf("Valid:    %v to %v\n", timeText(s.NotBefore), timeText(s.NotAfter))
+	if time.Now().After(s.NotAfter) {
+		fmt.Println("Expires:  EXPIRED")
+	} else {
+		fmt.Printf("Expires:  in %v days\n", s.DaysLeft)
+	}
+	if len(s.Uncovered) > 0 {
+		fmt.Printf("Not covered by the cert: %v\n", strings.Join(s.Uncovered, ", "))
+	}
+	return nil
+}
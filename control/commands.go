@@ -0,0 +1,367 @@
+package control
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"os"
+	"slices"
+	"time"
+)
+
+var handlers = map[string]handler{
+	"status":           status,
+	"routes":           routes,
+	"sessions.list":    sessionsList,
+	"sessions.kick":    sessionsKick,
+	"whitelist.list":   whitelistList,
+	"whitelist.add":    whitelistAdd,
+	"whitelist.remove": whitelistRemove,
+	"bans.list":        bansList,
+	"ban":              ban,
+	"unban":            unban,
+	"reload":           reload,
+	"user.list":        userList,
+	"user.add":         userAdd,
+	"user.disable":     userDisabled(true),
+	"user.enable":      userDisabled(false),
+	"user.remove":      userRemove,
+	"user.passwd":      userPasswd,
+	"user.set-group":   userSetGroup,
+	"cert.status":      certStatus,
+}
+
+// operator is who shows up in the logs for changes, the user subcommands change it when they run without the socket
+var operator = "control socket"
+
+var errNoWebserver = errors.New("the webserver is disabled in config.json")
+
+func decode(args json.RawMessage, v any) error {
+	if len(args) == 0 {
+		return errors.New("missing arguments")
+	}
+	return json.Unmarshal(args, v)
+}
+
+func needWebserver() error {
+	if !instance.Webserver {
+		return errNoWebserver
+	}
+	return nil
+}
+
+type Status struct {
+	Version     string    `json:"version"`
+	Started     time.Time `json:"started"`
+	Routes      int       `json:"routes"`
+	Webserver   bool      `json:"webserver"`
+	Sessions    int       `json:"sessions"`
+	Users       int       `json:"users"`
+	Whitelisted int       `json:"whitelisted"`
+	Bans        int       `json:"bans"`
+	Cluster     bool      `json:"cluster"`
+	Peers       []string  `json:"peers,omitempty"`
+}
+
+func status(json.RawMessage) (any, error) {
+	s := Status{
+		Version:     instance.Version,
+		Started:     instance.Started,
+		Routes:      len(instance.Routes),
+		Webserver:   instance.Webserver,
+		Whitelisted: len(instance.Store.List()),
+		Bans:        len(firewall.Bans(instance.Store)),
+		Cluster:     instance.Cluster != nil,
+	}
+	if instance.Webserver {
+		s.Sessions = len(webserver.Sessions())
+		s.Users = len(webserver.Users())
+	}
+	if instance.Cluster != nil {
+		s.Peers = instance.Cluster.Peers()
+		slices.Sort(s.Peers)
+	}
+	return s, nil
+}
+
+type RouteInfo struct {
+	Name     string `json:"name"`
+	Listen   string `json:"listen"`
+	Port     string `json:"port"`
+	Protocol string `json:"protocol"`
+	Type     string `json:"type"`
+	Target   string `json:"target"`
+	Auth     string `json:"auth,omitempty"`
+	Health   string `json:"health"` //up, down or unknown when it is not checked
+}
+
+func routes(json.RawMessage) (any, error) {
+	health := webserver.Health()
+	list := make([]RouteInfo, 0, len(instance.Routes))
+	for _, route := range instance.Routes {
+		name := webserver.RouteName(route)
+		info := RouteInfo{
+			Name:     name,
+			Listen:   route.ListenUrl + route.Path,
+			Port:     route.Port,
+			Protocol: route.Protocol,
+			Type:     route.Type,
+			Target:   route.TargetAddr,
+			Auth:     route.Auth,
+			Health:   "unknown",
+		}
+		if healthy, ok := health[name]; ok {
+			info.Health = "down"
+			if healthy {
+				info.Health = "up"
+			}
+		}
+		list = append(list, info)
+	}
+	return list, nil
+}
+
+func sessionsList(json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	return webserver.Sessions(), nil
+}
+
+type KickArgs struct {
+	User    string `json:"user"`
+	Message string `json:"message"`
+}
+
+func sessionsKick(args json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	var a KickArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, webserver.KickUser(a.User, a.Message, operator)
+}
+
+func whitelistList(json.RawMessage) (any, error) {
+	return instance.Store.List(), nil
+}
+
+type WhitelistAddArgs struct {
+	Target  string `json:"target"`
+	Seconds int64  `json:"seconds"` //0 keeps it until removed
+	Note    string `json:"note"`
+	GroupID int    `json:"permission_group_id"`
+}
+
+func whitelistAdd(args json.RawMessage) (any, error) {
+	var a WhitelistAddArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Seconds < 0 {
+		return nil, errors.New("duration can't be negative")
+	}
+	return firewall.AddManual(instance.Store, a.Target, time.Duration(a.Seconds)*time.Second, a.Note, a.GroupID)
+}
+
+type TargetArgs struct {
+	Target string `json:"target"`
+}
+
+func whitelistRemove(args json.RawMessage) (any, error) {
+	var a TargetArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if !webserver.RemoveWhitelist(a.Target, operator) {
+		return nil, fmt.Errorf("%v is not whitelisted", a.Target)
+	}
+	return nil, nil
+}
+
+func bansList(json.RawMessage) (any, error) {
+	return firewall.Bans(instance.Store), nil
+}
+
+type BanArgs struct {
+	Target  string `json:"target"`
+	Reason  string `json:"reason"`
+	Seconds int64  `json:"seconds"` //0 bans until unbanned
+}
+
+func ban(args json.RawMessage) (any, error) {
+	var a BanArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if a.Seconds < 0 {
+		return nil, errors.New("duration can't be negative")
+	}
+	return webserver.Ban(a.Target, a.Reason, time.Duration(a.Seconds)*time.Second, operator)
+}
+
+func unban(args json.RawMessage) (any, error) {
+	var a TargetArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	if !firewall.Unban(instance.Store, a.Target) {
+		return nil, fmt.Errorf("%v is not banned", a.Target)
+	}
+	return nil, nil
+}
+
+// reload picks up keys.json and the static whitelist, everything else in config.json still needs a restart
+func reload(json.RawMessage) (any, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("config.json: %w", err)
+	}
+	if err := firewall.LoadStatic(instance.Store, cfg.Firewall.StaticWhitelist); err != nil {
+		return nil, fmt.Errorf("static_whitelist: %w", err)
+	}
+	if instance.Webserver {
+		if err := webserver.ReloadKeys(); err != nil {
+			return nil, fmt.Errorf("keys.json: %w", err)
+		}
+	}
+	return nil, nil
+}
+
+func userList(json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	return webserver.Users(), nil
+}
+
+type UserAddArgs struct {
+	Name    string `json:"name"`
+	Key     string `json:"key"`
+	GroupID int    `json:"permission_group_id"`
+	Admin   bool   `json:"admin"`
+}
+
+func userAdd(args json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	var a UserAddArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, webserver.AddUser(a.Name, a.Key, a.GroupID, a.Admin, operator)
+}
+
+type UserArgs struct {
+	Name string `json:"name"`
+}
+
+func userDisabled(disabled bool) handler {
+	return func(args json.RawMessage) (any, error) {
+		if err := needWebserver(); err != nil {
+			return nil, err
+		}
+		var a UserArgs
+		if err := decode(args, &a); err != nil {
+			return nil, err
+		}
+		return nil, webserver.SetUserDisabled(a.Name, disabled, operator)
+	}
+}
+
+func userRemove(args json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	var a UserArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, webserver.RemoveUser(a.Name, operator)
+}
+
+type UserPasswdArgs struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+func userPasswd(args json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	var a UserPasswdArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, webserver.SetUserKey(a.Name, a.Key, operator)
+}
+
+type UserGroupArgs struct {
+	Name    string `json:"name"`
+	GroupID int    `json:"permission_group_id"`
+}
+
+func userSetGroup(args json.RawMessage) (any, error) {
+	if err := needWebserver(); err != nil {
+		return nil, err
+	}
+	var a UserGroupArgs
+	if err := decode(args, &a); err != nil {
+		return nil, err
+	}
+	return nil, webserver.SetUserGroup(a.Name, a.GroupID, operator)
+}
+
+type CertStatus struct {
+	File      string    `json:"file"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Names     []string  `json:"names"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	DaysLeft  int       `json:"days_left"`
+	Uncovered []string  `json:"uncovered,omitempty"` //domains from config.json the cert is not valid for
+}
+
+// certStatus reads the cert from disk, that is also what the listeners load
+func certStatus(json.RawMessage) (any, error) {
+	if instance.TLS == nil || !instance.TLS.EnableTLS {
+		return nil, errors.New("tls is disabled in config.json")
+	}
+	data, err := os.ReadFile(instance.TLS.Cert)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%v has no pem certificate", instance.TLS.Cert)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	s := CertStatus{
+		File:      instance.TLS.Cert,
+		Subject:   cert.Subject.CommonName,
+		Issuer:    cert.Issuer.CommonName,
+		Names:     cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		DaysLeft:  int(time.Until(cert.NotAfter).Hours() / 24),
+	}
+	for _, domain := range instance.TLS.Domains {
+		if cert.VerifyHostname(domain) != nil {
+			s.Uncovered = append(s.Uncovered, domain)
+		}
+	}
+	return s, nil
+}
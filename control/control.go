@@ -0,0 +1,175 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mazarin/access"
+	"mazarin/cluster"
+	"mazarin/config"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The control socket lets the mazarin subcommands talk to the running instance.
+// One json request per connection, answered with one json response. Only the user running mazarin can open it
+
+const (
+	DefaultSocket = "mazarin.sock"
+	callTimeout   = 10 * time.Second
+)
+
+type Request struct {
+	Cmd  string          `json:"cmd"`
+	Args json.RawMessage `json:"args,omitempty"`
+}
+
+type Response struct {
+	OK    bool            `json:"ok"`
+	Error string          `json:"error,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+type handler func(args json.RawMessage) (any, error)
+
+// Instance is what the status commands report about the running mazarin
+type Instance struct {
+	Version   string
+	Started   time.Time
+	Routes    []*config.ProxyConfig
+	TLS       *config.TLSConfig
+	Webserver bool
+	Cluster   *cluster.Node //nil when clustering is off
+	Store     access.Store  //the whitelist and bans the listeners check
+}
+
+var instance Instance
+
+func SocketPath(conf config.ControlConfig) string {
+	if conf.Socket == "" {
+		return DefaultSocket
+	}
+	return conf.Socket
+}
+
+// Serve answers commands on the socket until ctx ends
+func Serve(ctx context.Context, path string, inst Instance) error {
+	instance = inst
+
+	//A socket file left behind by a crash would make listen fail, but never take over one that is still in use
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%v is in use by another mazarin", path)
+	}
+	os.Remove(path)
+
+	listener, err := listenPrivate(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	abs, _ := filepath.Abs(path)
+	log.Printf("CONTROL: Listening on %v", abs)
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			log.Println("CONTROL: Accept error:", err)
+			continue
+		}
+		go handle(conn)
+	}
+}
+
+// listenPrivate creates the socket in a dir only we can enter and moves it to path once it is 0600.
+// Created at path directly it would be open to everyone the umask allows until the chmod
+func listenPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".mazarin-sock-") //0700
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "s")
+	listener, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	listener.(*net.UnixListener).SetUnlinkOnClose(false) //it would unlink tmp, Serve removes path when it returns
+	if err := os.Chmod(tmp, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(callTimeout))
+
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: "invalid request"})
+		return
+	}
+
+	resp := Response{OK: true}
+	h, ok := handlers[req.Cmd]
+	if !ok {
+		resp = Response{Error: "unknown command " + req.Cmd}
+	} else if data, err := h(req.Args); err != nil {
+		resp = Response{Error: err.Error()}
+	} else if resp.Data, err = json.Marshal(data); err != nil {
+		resp = Response{Error: err.Error()}
+	}
+	log.Printf("CONTROL: %v ok=%v %v", req.Cmd, resp.OK, resp.Error)
+	json.NewEncoder(conn).Encode(resp)
+}
+
+// Call runs a command on the running instance and decodes its answer into result (can be nil)
+func Call(path, cmd string, args any, result any) error {
+	conn, err := net.DialTimeout("unix", path, callTimeout)
+	if err != nil {
+		return fmt.Errorf("can't reach mazarin on %v (is it running with control enabled?): %w", path, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(callTimeout))
+
+	req := Request{Cmd: cmd}
+	if args != nil {
+		if req.Args, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	if err := json.NewEncoder(conn).Encode(req); err != nil {
+		return err
+	}
+
+	var resp Response
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if !resp.OK {
+		return errors.New(resp.Error)
+	}
+	if result != nil && len(resp.Data) > 0 {
+		return json.Unmarshal(resp.Data, result)
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// The user subcommands go through the socket when mazarin is running, otherwise they change keys.json or the db themselves.
+// Both ways run the same handlers so the checks are the same
+
+type userCLI struct {
+	socket  string
+	offline bool
+	db      bool
+}
+
+func openUserCLI(socket string) (*userCLI, error) {
+	if conn, err := net.DialTimeout("unix", socket, time.Second); err == nil {
+		conn.Close()
+		return &userCLI{socket: socket}, nil
+	}
+
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("mazarin is not running and config.json can't be read: %w", err)
+	}
+	log.SetOutput(io.Discard) //the result gets printed, the package logs would only clutter the terminal
+	if err := webserver.SetHashPolicy(cfg.Webserver.Hashing); err != nil {
+		return nil, fmt.Errorf("invalid hashing in config.json: %w", err)
+	}
+	if err := firewall.InitPermissions(cfg.Groups); err != nil {
+		return nil, fmt.Errorf("invalid permission_groups in config.json: %w", err)
+	}
+	instance.Store = access.NewMemoryStore() //nothing is whitelisted while mazarin is down
+	if err := webserver.OpenUsers(&cfg.Webserver, instance.Store); err != nil {
+		return nil, err
+	}
+	instance.Webserver = true
+	operator = "command line"
+	return &userCLI{offline: true, db: cfg.Webserver.EnableDB}, nil
+}
+
+func (u *userCLI) call(cmd string, args any, result any) error {
+	if !u.offline {
+		return Call(u.socket, cmd, args, result)
+	}
+
+	var raw json.RawMessage
+	if args != nil {
+		var err error
+		if raw, err = json.Marshal(args); err != nil {
+			return err
+		}
+	}
+	data, err := handlers[cmd](raw)
+	if err != nil || result == nil {
+		return err
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(encoded, result)
+}
+
+// done prints the result, a running mazarin only sees db changes after a reload
+func (u *userCLI) done(format string, a ...any) {
+	fmt.Printf(format+"\n", a...)
+	if u.offline && u.db {
+		fmt.Println("Changed the database directly, a running mazarin picks this up after a SIGHUP")
+	}
+}
+
+// RunUser is `mazarin user list|add|remove|disable|enable|passwd|set-group`
+func RunUser(args []string) error {
+	cmd, args := subcommand(args, "list")
+	fs, socket := newFlags("user " + cmd)
+
+	var group *int
+	var admin *bool
+	want, usage := 1, "mazarin user "+cmd+" <name>"
+	switch cmd {
+	case "list":
+		want, usage = 0, "mazarin user list"
+	case "add":
+		group = fs.Int("group", 0, "Permission group of the user (default every route)")
+		admin = fs.Bool("admin", false, "Give the user access to the admin api")
+		usage = "mazarin user add <name> [--group id] [--admin]"
+	case "set-group":
+		want, usage = 2, "mazarin user set-group <name> <group id>"
+	case "remove", "disable", "enable", "passwd":
+	default:
+		return errors.New("usage: mazarin user [list|add|remove|disable|enable|passwd|set-group]")
+	}
+	positional, err := parseArgs(fs, args, want, usage)
+	if err != nil {
+		return err
+	}
+
+	u, err := openUserCLI(*socket)
+	if err != nil {
+		return err
+	}
+
+	switch cmd {
+	case "list":
+		var users []webserver.UserInfo
+		if err := u.call("user.list", nil, &users); err != nil {
+			return err
+		}
+		w := table()
+		fmt.Fprintln(w, "NAME\tGROUP\tADMIN\tDISABLED\tPENDING\t2FA\tAPI KEYS")
+		for _, user := range users {
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", user.Name, user.PermissionGroupID, user.Admin, user.Disabled, user.Pending, user.Totp, user.APIKeys)
+		}
+		return w.Flush()
+
+	case "add":
+		name := positional[0]
+		if !firewall.ValidateInput(name, firewall.TypeUsername) {
+			return errors.New("invalid username, use up to 64 letters, numbers, _ or -")
+		}
+		//Check before asking for the key, the server refuses duplicates too
+		var users []webserver.UserInfo
+		if err := u.call("user.list", nil, &users); err != nil {
+			return err
+		}
+		if slices.ContainsFunc(users, func(user webserver.UserInfo) bool { return user.Name == name }) {
+			return fmt.Errorf("user %v already exists", name)
+		}
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+		if err := u.call("user.add", UserAddArgs{Name: name, Key: key, GroupID: *group, Admin: *admin}, nil); err != nil {
+			return err
+		}
+		u.done("Created %v", name)
+
+	case "remove":
+		if err := u.call("user.remove", UserArgs{Name: positional[0]}, nil); err != nil {
+			return err
+		}
+		u.done("Removed %v", positional[0])
+
+	case "disable", "enable":
+		if err := u.call("user."+cmd, UserArgs{Name: positional[0]}, nil); err != nil {
+			return err
+		}
+		u.done("%vd %v", strings.ToUpper(cmd[:1])+cmd[1:], positional[0])
+
+	case "passwd":
+		key, err := readKey()
+		if err != nil {
+			return err
+		}
+		if err := u.call("user.passwd", UserPasswdArgs{Name: positional[0], Key: key}, nil); err != nil {
+			return err
+		}
+		u.done("Changed the key of %v", positional[0])
+
+	case "set-group":
+		groupID, err := strconv.Atoi(positional[1])
+		if err != nil || groupID < 0 {
+			return fmt.Errorf("invalid group id %q", positional[1])
+		}
+		if err := u.call("user.set-group", UserGroupArgs{Name: positional[0], GroupID: groupID}, nil); err != nil {
+			return err
+		}
+		u.done("Moved %v to permission group %v", positional[0], groupID)
+	}
+	return nil
+}
+
+// readKey asks for the key twice without echoing it, a pipe is read as a single line so scripts still work
+func readKey() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("no key on stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Print("Key: ")
+	key, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	fmt.Print("Repeat key: ")
+	again, err := term.ReadPassword(fd)
+	fmt.Println()
+	if err != nil {
+		return "", err
+	}
+	if string(key) != string(again) {
+		return "", errors.New("the keys don't match")
+	}
+	return string(key), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/control"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startControl serves the control socket for inst in a temp dir and returns its path, it is shut down when the test ends
+func startControl(t *testing.T, inst control.Instance) string {
+	t.Helper()
+	socket := filepath.Join(t.TempDir(), "mazarin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- control.Serve(ctx, socket, inst) }()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+	eventually(t, "the control socket", func() bool { return control.Call(socket, "status", nil, nil) == nil })
+	return socket
+}
+
+// callError runs cmd and returns the error text, empty when it worked
+func callError(socket, cmd string, args any) string {
+	if err := control.Call(socket, cmd, args, nil); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// This test checks that the socket runs whitelist and ban commands on the store of the instance and answers errors for bad ones
+func TestControlCommands(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	_, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash})
+	socket := startControl(t, control.Instance{
+		Version:   "test",
+		Routes:    []*config.ProxyConfig{{Name: "survival", Port: ":25565"}, {Name: "creative", Port: ":25566"}},
+		Webserver: true,
+		Store:     store,
+	})
+
+	var status control.Status
+	if err := control.Call(socket, "status", nil, &status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Version != "test" || status.Routes != 2 || status.Users != 1 || !status.Webserver {
+		t.Errorf("Status: got %+v", status)
+	}
+
+	if err := control.Call(socket, "whitelist.add", control.WhitelistAddArgs{Target: "198.51.100.7", Seconds: 60, Note: "test"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !firewall.CheckWhitelist(store, "198.51.100.7") {
+		t.Error("whitelist.add did not whitelist the ip")
+	}
+	var grants []access.Grant
+	if err := control.Call(socket, "whitelist.list", nil, &grants); err != nil || len(grants) != 1 || grants[0].Note != "test" {
+		t.Errorf("whitelist.list: got %+v %v, want the added ip", grants, err)
+	}
+	if msg := callError(socket, "whitelist.remove", control.TargetArgs{Target: "198.51.100.7"}); msg != "" {
+		t.Fatal(msg)
+	}
+	if firewall.CheckWhitelist(store, "198.51.100.7") {
+		t.Error("whitelist.remove left the ip whitelisted")
+	}
+	if msg := callError(socket, "whitelist.remove", control.TargetArgs{Target: "198.51.100.7"}); !strings.Contains(msg, "not whitelisted") {
+		t.Errorf("Removing it twice: got %q, want not whitelisted", msg)
+	}
+
+	if msg := callError(socket, "ban", control.BanArgs{Target: "203.0.113.0/24", Reason: "test"}); msg != "" {
+		t.Fatal(msg)
+	}
+	if !firewall.IsBanned(store, "203.0.113.5") {
+		t.Error("ban did not ban the range")
+	}
+	var bans []access.Ban
+	if err := control.Call(socket, "bans.list", nil, &bans); err != nil || len(bans) != 1 {
+		t.Errorf("bans.list: got %+v %v, want the ban", bans, err)
+	}
+	if msg := callError(socket, "unban", control.TargetArgs{Target: "203.0.113.0/24"}); msg != "" {
+		t.Fatal(msg)
+	}
+	if firewall.IsBanned(store, "203.0.113.5") {
+		t.Error("unban left the range banned")
+	}
+
+	for _, bad := range []struct {
+		cmd  string
+		args any
+		want string
+	}{
+		{"nope", nil, "unknown command nope"},
+		{"whitelist.add", nil, "missing arguments"},
+		{"whitelist.add", control.WhitelistAddArgs{Target: "198.51.100.7", Seconds: -1}, "negative"},
+		{"ban", control.BanArgs{Target: "not an ip"}, ""},
+		{"unban", control.TargetArgs{Target: "203.0.113.0/24"}, "not banned"},
+	} {
+		msg := callError(socket, bad.cmd, bad.args)
+		if msg == "" || !strings.Contains(msg, bad.want) {
+			t.Errorf("%v %+v: got %q, want an error with %q", bad.cmd, bad.args, msg, bad.want)
+		}
+	}
+}
+
+// This test checks that the user commands change the users of the webserver, and refuse to run when it is disabled
+func TestControlUsers(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	_, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash})
+	socket := startControl(t, control.Instance{Webserver: true, Store: store})
+
+	if msg := callError(socket, "user.add", control.UserAddArgs{Name: "bob", Key: "bob_password_1", Admin: true}); msg != "" {
+		t.Fatal(msg)
+	}
+	if msg := callError(socket, "user.add", control.UserAddArgs{Name: "bob", Key: "bob_password_1"}); msg == "" {
+		t.Error("A second bob was added")
+	}
+	if msg := callError(socket, "user.disable", control.UserArgs{Name: "bob"}); msg != "" {
+		t.Fatal(msg)
+	}
+	var users []webserver.UserInfo
+	if err := control.Call(socket, "user.list", nil, &users); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, user := range users {
+		if user.Name == "bob" {
+			found = true
+			if !user.Disabled || !user.Admin {
+				t.Errorf("bob: got %+v, want a disabled admin", user)
+			}
+		}
+	}
+	if len(users) != 2 || !found {
+		t.Errorf("user.list: got %+v, want alice and bob", users)
+	}
+
+	//Without the webserver there are no users to change
+	socket = startControl(t, control.Instance{Store: access.NewMemoryStore()})
+	if msg := callError(socket, "user.add", control.UserAddArgs{Name: "carol", Key: "carol_password_1"}); !strings.Contains(msg, "webserver is disabled") {
+		t.Errorf("user.add without webserver: got %q, want the webserver disabled error", msg)
+	}
+}
+
+// This test checks that the socket is only open to our user, leaves nothing else in its folder and is removed on shutdown
+func TestControlSocketFile(t *testing.T) {
+	dir := t.TempDir()
+	socket := filepath.Join(dir, "mazarin.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- control.Serve(ctx, socket, control.Instance{Store: access.NewMemoryStore()}) }()
+	eventually(t, "the control socket", func() bool { return control.Call(socket, "status", nil, nil) == nil })
+
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 || info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("Socket mode: got %v, want a 0600 socket", info.Mode())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("Folder of the socket: got %v entries, want only the socket", len(entries))
+	}
+
+	cancel()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !os.IsNotExist(err) {
+		t.Errorf("Socket after shutdown: got %v, want it removed", err)
+	}
+}
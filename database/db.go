@@ -6,6 +6,7 @@ import (
 	"mazarin/config"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	_ "modernc.org/sqlite"
@@ -18,6 +19,7 @@ type User struct {
 	CreatedAt         time.Time
 	PermissionGroupID int
 	Active            bool
+	Data              string //the whole user as json, the webserver keeps more than the columns above
 }
 
 var currentDB *sql.DB = nil
@@ -29,7 +31,8 @@ func InitDb(conf *config.WebserverConfig) error {
 		return fmt.Errorf("failed to create db directory: %v", err)
 	}
 
-	dbFilePath := filepath.Join(DbDir, "mazarinDB")
+	//The user subcommands can write while mazarin is running, wait for the lock instead of failing
+	dbFilePath := filepath.Join(DbDir, "mazarinDB") + "?_pragma=busy_timeout(5000)"
 
 	db, err := sql.Open("sqlite", dbFilePath)
 	if err != nil {
@@ -51,7 +54,7 @@ func setupDb() error {
 	}
 
 	schema := `
-    -- Users table (migrating from keys.json)
+    -- Users table, replaces keys.json when the db is on
     CREATE TABLE IF NOT EXISTS users (
         id INTEGER PRIMARY KEY AUTOINCREMENT,
         username TEXT NOT NULL UNIQUE,
@@ -61,16 +64,49 @@ func setupDb() error {
         active BOOLEAN DEFAULT 1
     );
     CREATE INDEX IF NOT EXISTS idx_users_username ON users(username);
+
+    -- Saved across restarts, times are unix seconds. Whitelisted ips are in the grants table of the access store
+    CREATE TABLE IF NOT EXISTS sessions (
+        token_hash TEXT PRIMARY KEY,
+        username TEXT NOT NULL,
+        ip TEXT NOT NULL,
+        created_at INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS leases (
+        id TEXT PRIMARY KEY,
+        ip TEXT NOT NULL,
+        username TEXT NOT NULL,
+        key_id TEXT NOT NULL,
+        group_id INTEGER NOT NULL,
+        expires_at INTEGER NOT NULL
+    );
 	`
 
-	_, err := db.Exec(schema)
-	return err
+	if _, err := db.Exec(schema); err != nil {
+		return err
+	}
+	//Tables from before the webserver kept its users here
+	if _, err := db.Exec("ALTER TABLE users ADD COLUMN data TEXT NOT NULL DEFAULT ''"); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return err
+	}
+	return nil
 }
 
 func GetDB() *sql.DB {
 	return currentDB
 }
 
+// Close closes the db, InitDb has to run again before it is used
+func Close() error {
+	if currentDB == nil {
+		return nil
+	}
+	err := currentDB.Close()
+	currentDB = nil
+	return err
+}
+
 func CreateUser(username, passwordHash string, groupID int) error {
 	db := GetDB()
 	if db == nil {
@@ -93,9 +129,9 @@ func GetUserByUsername(username string) (*User, error) {
 
 	user := &User{}
 	err := db.QueryRow(`
-        SELECT id, username, password_hash, created_at, updated_at, permission_group_id, active 
+        SELECT id, username, password_hash, created_at, COALESCE(permission_group_id, 0), active, data
         FROM users WHERE username = ?
-	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.PermissionGroupID, &user.Active)
+	`, username).Scan(&user.ID, &user.Username, &user.PasswordHash, &user.CreatedAt, &user.PermissionGroupID, &user.Active, &user.Data)
 
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("user not found")
@@ -135,8 +171,8 @@ func ListUsers() ([]User, error) {
 	}
 
 	rows, err := db.Query(`
-        SELECT id, username, password_hash, created_at, updated_at, 
-               COALESCE(permission_group_id, 1), active 
+        SELECT id, username, password_hash, created_at,
+               COALESCE(permission_group_id, 0), active, data
         FROM users ORDER BY username
     `)
 	if err != nil {
@@ -149,7 +185,7 @@ func ListUsers() ([]User, error) {
 		var user User
 		if err := rows.Scan(
 			&user.ID, &user.Username, &user.PasswordHash,
-			&user.CreatedAt, &user.PermissionGroupID, &user.Active,
+			&user.CreatedAt, &user.PermissionGroupID, &user.Active, &user.Data,
 		); err != nil {
 			return nil, err
 		}
@@ -158,3 +194,43 @@ func ListUsers() ([]User, error) {
 
 	return users, rows.Err()
 }
+
+// SaveUsers inserts or updates the rows of these users, rows of other users are left alone.
+// The user subcommands write here while mazarin runs, a full sync would delete the users they added
+func SaveUsers(users []User) error {
+	db := GetDB()
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, user := range users {
+		if _, err := tx.Exec(`
+            INSERT INTO users (username, password_hash, permission_group_id, active, data)
+            VALUES (?, ?, ?, ?, ?)
+            ON CONFLICT(username) DO UPDATE SET
+                password_hash = excluded.password_hash,
+                permission_group_id = excluded.permission_group_id,
+                active = excluded.active,
+                data = excluded.data
+        `, user.Username, user.PasswordHash, user.PermissionGroupID, user.Active, user.Data); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func DeleteUserByName(username string) error {
+	db := GetDB()
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	_, err := db.Exec("DELETE FROM users WHERE username = ?", username)
+	return err
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"fmt"
+	"mazarin/firewall"
+	"mazarin/sessions"
+	"time"
+)
+
+// SaveState replaces the saved sessions and leases with the current ones
+func SaveState(stored []sessions.Stored, leases []firewall.Lease) error {
+	db := GetDB()
+	if db == nil {
+		return fmt.Errorf("database not initialized")
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //no-op after commit
+
+	for _, table := range []string{"sessions", "leases"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return err
+		}
+	}
+	for _, s := range stored {
+		if _, err := tx.Exec(`
+            INSERT INTO sessions (token_hash, username, ip, created_at, expires_at)
+            VALUES (?, ?, ?, ?, ?)
+        `, s.TokenHash, s.Username, s.IPAddress, s.CreatedAt.Unix(), s.ExpiresAt.Unix()); err != nil {
+			return err
+		}
+	}
+	for _, l := range leases {
+		if _, err := tx.Exec(`
+            INSERT INTO leases (id, ip, username, key_id, group_id, expires_at)
+            VALUES (?, ?, ?, ?, ?, ?)
+        `, l.ID, l.IP, l.User, l.KeyID, l.GroupID, l.Expires.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadState reads back what SaveState wrote, expired rows are left out
+func LoadState() ([]sessions.Stored, []firewall.Lease, error) {
+	db := GetDB()
+	if db == nil {
+		return nil, nil, fmt.Errorf("database not initialized")
+	}
+	now := time.Now().Unix()
+
+	var stored []sessions.Stored
+	rows, err := db.Query(`
+        SELECT token_hash, username, ip, created_at, expires_at
+        FROM sessions WHERE expires_at > ?
+    `, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	for rows.Next() {
+		var s sessions.Stored
+		var created, expires int64
+		if err := rows.Scan(&s.TokenHash, &s.Username, &s.IPAddress, &created, &expires); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		s.CreatedAt, s.ExpiresAt = time.Unix(created, 0), time.Unix(expires, 0)
+		stored = append(stored, s)
+	}
+	rows.Close()
+
+	var leases []firewall.Lease
+	rows, err = db.Query(`
+        SELECT id, ip, username, key_id, group_id, expires_at
+        FROM leases WHERE expires_at > ?
+    `, now)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var l firewall.Lease
+		var expires int64
+		if err := rows.Scan(&l.ID, &l.IP, &l.User, &l.KeyID, &l.GroupID, &expires); err != nil {
+			return nil, nil, err
+		}
+		l.Expires = time.Unix(expires, 0)
+		leases = append(leases, l)
+	}
+	return stored, leases, rows.Err()
+}
@@ -0,0 +1,168 @@
+package extauthz
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"mazarin/config"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How the authorization endpoint is called:
+//  POST <url> {"method","host","path","client_ip","user"}
+//  2xx -> allowed, an optional json body {"headers":{...}} adds headers towards the upstream, X-Mazarin-* ones are ours and get dropped
+//         a json body with "allow": false denies with its "status" and "body"
+//  anything else -> denied, the status and body are passed on to the client
+
+const maxBodySize = 64 * 1024
+
+type Request struct {
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Path     string `json:"path"`
+	ClientIP string `json:"client_ip"`
+	User     string `json:"user"`
+}
+
+type Decision struct {
+	Allow       bool
+	Status      int
+	Body        string
+	ContentType string
+	Headers     map[string]string
+}
+
+type response struct {
+	Allow   *bool             `json:"allow"`
+	Status  int               `json:"status"`
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+}
+
+type cacheEntry struct {
+	decision Decision
+	expires  time.Time
+}
+
+var (
+	mu     = sync.Mutex{}
+	cache  = make(map[string]cacheEntry)
+	client = &http.Client{}
+)
+
+// Check asks the endpoint of a route if this request may pass, decisions are cached for cache_ttl seconds
+func Check(ctx context.Context, conf *config.ExtAuthzConfig, req Request) Decision {
+	key := strings.Join([]string{conf.URL, req.Method, req.Host, req.Path, req.ClientIP, req.User}, "\x00")
+	if conf.CacheTTL > 0 {
+		mu.Lock()
+		entry, ok := cache[key]
+		mu.Unlock()
+		if ok && time.Now().Before(entry.expires) {
+			return entry.decision
+		}
+	}
+
+	decision, err := call(ctx, conf, req)
+	if err != nil {
+		log.Printf("EXTAUTHZ: Calling %v failed: %v", conf.URL, err)
+		//Errors are never cached, the next request tries again
+		if conf.FailOpen {
+			return Decision{Allow: true}
+		}
+		return Decision{Allow: false, Status: http.StatusServiceUnavailable, Body: "Authorization service unavailable"}
+	}
+
+	if conf.CacheTTL > 0 {
+		mu.Lock()
+		pruneLocked()
+		cache[key] = cacheEntry{decision: decision, expires: time.Now().Add(time.Duration(conf.CacheTTL) * time.Second)}
+		mu.Unlock()
+	}
+	return decision
+}
+
+func call(ctx context.Context, conf *config.ExtAuthzConfig, req Request) (Decision, error) {
+	timeout := time.Duration(conf.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return Decision{}, err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, conf.URL, bytes.NewReader(payload))
+	if err != nil {
+		return Decision{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return Decision{
+			Allow:       false,
+			Status:      denyStatus(resp.StatusCode),
+			Body:        string(body),
+			ContentType: resp.Header.Get("Content-Type"),
+		}, nil
+	}
+
+	decision := Decision{Allow: true}
+	var parsed response
+	if len(bytes.TrimSpace(body)) == 0 || json.Unmarshal(body, &parsed) != nil {
+		return decision, nil //a plain 200 is enough to allow
+	}
+	if parsed.Allow != nil && !*parsed.Allow {
+		decision.Allow = false
+		decision.Status = denyStatus(parsed.Status)
+		decision.Body = parsed.Body
+		return decision, nil
+	}
+	//The router sets X-Mazarin-User after checking the login, the endpoint must not be able to swap the user
+	for key := range parsed.Headers {
+		if strings.HasPrefix(http.CanonicalHeaderKey(key), "X-Mazarin-") {
+			log.Printf("EXTAUTHZ: Ignoring header %v from %v", key, conf.URL)
+			delete(parsed.Headers, key)
+		}
+	}
+	decision.Headers = parsed.Headers
+	return decision, nil
+}
+
+// denyStatus keeps the status of a denial to client and server errors, anything else from the endpoint becomes a 403.
+// A success status would look like an allow, and net/http panics on codes outside 100-999
+func denyStatus(status int) int {
+	if status < 400 || status > 599 {
+		return http.StatusForbidden
+	}
+	return status
+}
+
+// pruneLocked drops expired entries once the cache gets big, callers hold mu
+func pruneLocked() {
+	if len(cache) < 10000 {
+		return
+	}
+	now := time.Now()
+	for key, entry := range cache {
+		if now.After(entry.expires) {
+			delete(cache, key)
+		}
+	}
+}
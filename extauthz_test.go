@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mazarin/config"
+	"mazarin/extauthz"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+var authzRequest = extauthz.Request{Method: "GET", Host: "app.domain.com", Path: "/", ClientIP: "198.51.100.4", User: "alice"}
+
+// authzServer answers every check with status and body, calls counts how often it got asked
+func authzServer(t *testing.T, status int, body string) (*config.ExtAuthzConfig, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if status != http.StatusOK {
+			w.Header().Set("Content-Type", "text/plain")
+		}
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(server.Close)
+	return &config.ExtAuthzConfig{URL: server.URL}, &calls
+}
+
+// This test checks that a 2xx allows the request and that the endpoint can add headers, but none of our X-Mazarin-* ones
+func TestExtAuthzAllow(t *testing.T) {
+	conf, _ := authzServer(t, http.StatusOK, `{"headers":{"X-Team":"red","X-Mazarin-User":"admin","x-mazarin-group":"0"}}`)
+
+	decision := extauthz.Check(context.Background(), conf, authzRequest)
+	if !decision.Allow {
+		t.Fatalf("Allow: got false, want true")
+	}
+	if decision.Headers["X-Team"] != "red" {
+		t.Errorf("X-Team: got %q, want red", decision.Headers["X-Team"])
+	}
+	if len(decision.Headers) != 1 {
+		t.Errorf("Headers: got %v, want only X-Team", decision.Headers)
+	}
+}
+
+// This test checks that denials pass the status and body of the endpoint on to the client
+func TestExtAuthzDeny(t *testing.T) {
+	conf, _ := authzServer(t, http.StatusUnauthorized, "log in first")
+	decision := extauthz.Check(context.Background(), conf, authzRequest)
+	if decision.Allow || decision.Status != http.StatusUnauthorized || decision.Body != "log in first" || decision.ContentType != "text/plain" {
+		t.Errorf("Plain deny: got %+v, want 401 with the body passed on", decision)
+	}
+
+	conf, _ = authzServer(t, http.StatusOK, `{"allow":false,"body":"not today"}`)
+	decision = extauthz.Check(context.Background(), conf, authzRequest)
+	if decision.Allow || decision.Status != http.StatusForbidden || decision.Body != "not today" {
+		t.Errorf("Json deny: got %+v, want 403 with the body passed on", decision)
+	}
+}
+
+// This test checks that a denial only passes on 4xx and 5xx statuses, anything else from the endpoint becomes a 403
+func TestExtAuthzDenyStatus(t *testing.T) {
+	for body, want := range map[string]int{
+		`{"allow":false,"status":42}`:   http.StatusForbidden,
+		`{"allow":false,"status":200}`:  http.StatusForbidden,
+		`{"allow":false,"status":302}`:  http.StatusForbidden,
+		`{"allow":false,"status":1000}`: http.StatusForbidden,
+		`{"allow":false,"status":429}`:  http.StatusTooManyRequests,
+		`{"allow":false,"status":503}`:  http.StatusServiceUnavailable,
+	} {
+		conf, _ := authzServer(t, http.StatusOK, body)
+		decision := extauthz.Check(context.Background(), conf, authzRequest)
+		if decision.Allow || decision.Status != want {
+			t.Errorf("%v: got %+v, want a %v deny", body, decision, want)
+		}
+	}
+
+	//The deny has to reach the client without net/http panicking on the status
+	conf, _ := authzServer(t, http.StatusOK, `{"allow":false,"status":42}`)
+	decision := extauthz.Check(context.Background(), conf, authzRequest)
+	w := httptest.NewRecorder()
+	w.WriteHeader(decision.Status)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Written status: got %v, want 403", w.Code)
+	}
+}
+
+// This test checks that an unreachable endpoint denies with a 503 unless fail_open is set
+func TestExtAuthzFailOpen(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	conf := &config.ExtAuthzConfig{URL: closed.URL}
+
+	decision := extauthz.Check(context.Background(), conf, authzRequest)
+	if decision.Allow || decision.Status != http.StatusServiceUnavailable {
+		t.Errorf("Fail closed: got %+v, want a 503 deny", decision)
+	}
+
+	conf.FailOpen = true
+	if decision := extauthz.Check(context.Background(), conf, authzRequest); !decision.Allow {
+		t.Errorf("Fail open: got %+v, want allowed", decision)
+	}
+}
+
+// This test checks that decisions are cached per request for cache_ttl and that a different request asks again
+func TestExtAuthzCache(t *testing.T) {
+	conf, calls := authzServer(t, http.StatusOK, "")
+	conf.CacheTTL = 60
+
+	for range 3 {
+		extauthz.Check(context.Background(), conf, authzRequest)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("Same request: endpoint got %v calls, want 1", calls.Load())
+	}
+
+	other := authzRequest
+	other.ClientIP = "203.0.113.7"
+	extauthz.Check(context.Background(), conf, other)
+	if calls.Load() != 2 {
+		t.Errorf("Other ip: endpoint got %v calls, want 2", calls.Load())
+	}
+
+	uncached, uncachedCalls := authzServer(t, http.StatusOK, "")
+	extauthz.Check(context.Background(), uncached, authzRequest)
+	extauthz.Check(context.Background(), uncached, authzRequest)
+	if uncachedCalls.Load() != 2 {
+		t.Errorf("No cache_ttl: endpoint got %v calls, want 2", uncachedCalls.Load())
+	}
+}
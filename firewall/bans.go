@@ -0,0 +1,57 @@
+package firewall
+
+import (
+	"context"
+	"log"
+	"mazarin/access"
+	"time"
+)
+
+// BanIP blocks an ip or cidr and closes its conns, a duration of 0 bans until Unban
+func BanIP(store access.Store, target, reason string, duration time.Duration) (access.Ban, error) {
+	ban, err := access.NewBan(target, reason, duration)
+	if err != nil {
+		return ban, err
+	}
+	if err := store.Ban(ban); err != nil {
+		return ban, err
+	}
+	notifyChanged()
+	log.Printf("FIREWALL: Banned %v: %v", ban.Target, reason)
+	return ban, nil
+}
+
+func Unban(store access.Store, target string) bool {
+	ban, ok := store.Unban(target)
+	if ok {
+		log.Printf("FIREWALL: Unbanned %v", ban.Target)
+	}
+	return ok
+}
+
+// IsBanned is checked before anything else, bans apply even with the firewall off
+func IsBanned(store access.Store, ip string) bool {
+	_, banned := store.Banned(ip)
+	return banned
+}
+
+func Bans(store access.Store) []access.Ban {
+	return store.Bans()
+}
+
+// RunJanitor drops expired grants and bans, their conns get closed by the store
+func RunJanitor(ctx context.Context, store access.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, g := range store.Prune() {
+				log.Printf("FIREWALL: Whitelist entry for %v expired", g.IP)
+			}
+			dropEndedEntries(store)
+		}
+	}
+}
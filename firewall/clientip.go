@@ -0,0 +1,133 @@
+package firewall
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Reverse proxies (cloudflare, nginx) we trust to tell us the real client ip
+var trustedProxies []*net.IPNet
+
+// The one header the trusted proxies put the client ip in, every other forwarding header could come straight from the client
+var clientIPHeader = defaultClientIPHeader
+
+const defaultClientIPHeader = "X-Forwarded-For"
+
+func InitTrustedProxies(list []string, header string) error {
+	nets, err := ParseCIDRs(list)
+	if err != nil {
+		return err
+	}
+	header = strings.TrimSpace(header)
+	if header == "" {
+		header = defaultClientIPHeader
+	}
+	if strings.ContainsAny(header, " :\t") {
+		return errors.New("invalid client_ip_header " + header)
+	}
+	trustedProxies = nets
+	clientIPHeader = http.CanonicalHeaderKey(header)
+	return nil
+}
+
+// ClientIPHeader is the header ClientIP reads, the http proxy strips it from requests that dont come from a trusted proxy
+func ClientIPHeader() string {
+	return clientIPHeader
+}
+
+// ClientIP is the one place we resolve the ip of a http client, use this instead of r.RemoteAddr.
+// The forwarding header is only looked at when the direct peer is a trusted proxy, anyone else could spoof it.
+// Only the configured header counts, a proxy that sets X-Forwarded-For passes a CF-Connecting-IP from the client on untouched.
+func ClientIP(r *http.Request) (string, error) {
+	peerIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "", err
+	}
+	if !isTrustedProxy(peerIP) {
+		return peerIP, nil
+	}
+
+	var ip string
+	switch clientIPHeader {
+	case "X-Forwarded-For":
+		ip = rightmostUntrusted(splitHeaderList(r.Header.Values(clientIPHeader)))
+	case "Forwarded":
+		ip = rightmostUntrusted(forwardedFor(r.Header.Values(clientIPHeader)))
+	default:
+		//Single ip headers like CF-Connecting-IP or X-Real-IP, the proxy sets these itself and overwrites whatever the client sent
+		ip = parseHeaderIP(r.Header.Get(clientIPHeader))
+	}
+	if ip != "" {
+		return ip, nil
+	}
+	return peerIP, nil
+}
+
+// FromTrustedProxy reports if the forwarding headers of this request can be passed on as is
+func FromTrustedProxy(r *http.Request) bool {
+	peerIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	return err == nil && isTrustedProxy(peerIP)
+}
+
+func isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && ContainsIP(trustedProxies, parsed)
+}
+
+// Every proxy appends the address it got the request from, so we walk back from the right and stop at the first hop we dont trust.
+// The left side of that hop is client controlled.
+func rightmostUntrusted(hops []string) string {
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := parseHeaderIP(hops[i])
+		if ip == "" {
+			return ""
+		}
+		if !isTrustedProxy(ip) {
+			return ip
+		}
+	}
+	return ""
+}
+
+func splitHeaderList(values []string) []string {
+	var list []string
+	for _, value := range values {
+		for _, part := range strings.Split(value, ",") {
+			list = append(list, strings.TrimSpace(part))
+		}
+	}
+	return list
+}
+
+// forwardedFor pulls the for= values out of RFC 7239 Forwarded headers
+func forwardedFor(values []string) []string {
+	var list []string
+	for _, element := range splitHeaderList(values) {
+		for _, pair := range strings.Split(element, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(key, "for") {
+				list = append(list, strings.Trim(value, `"`))
+			}
+		}
+	}
+	return list
+}
+
+// parseHeaderIP accepts "1.2.3.4", "1.2.3.4:5678", "[2001:db8::1]:443" and "2001:db8::1"
+func parseHeaderIP(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	value = strings.Trim(value, "[]")
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
@@ -2,29 +2,177 @@ package firewall
 
 import (
 	"log"
-	"mazarin/state"
+	"mazarin/access"
+	"mazarin/config"
 	"net"
+	"slices"
+	"sync"
+	"time"
 )
 
-func CheckWhitelistAddConn(ip string, conn net.Conn) bool {
-	state.Mutex.Lock()
-	defer state.Mutex.Unlock()
-	allowed := state.WhitelistedIPs[ip]
-	if allowed {
-		state.ActiveConns[ip] = append(state.ActiveConns[ip], conn)
-		return true
+// CheckWhitelistAddConn tracks the conn when the ip may reach the route.
+// The store holds the whitelist and open conns, main makes it (the sqlite one when enable_db is on) and passes it down
+func CheckWhitelistAddConn(store access.Store, ip string, route *config.ProxyConfig, conn net.Conn) bool {
+	return store.TrackConn(ip, conn, func(g access.Grant) bool { return GrantAllows(g, route) })
+}
+
+// GrantAllows is true when any user logged in from the ip may use the route.
+// We only see the ip on raw conns, so users behind the same nat get the routes of all of them
+func GrantAllows(g access.Grant, route *config.ProxyConfig) bool {
+	for _, groupID := range g.Groups() {
+		if GroupAllows(groupID, route) {
+			return true
+		}
 	}
 	return false
 }
 
-func CheckWhitelist(ip string) bool {
-	state.Mutex.RLock()
-	allowed := state.WhitelistedIPs[ip]
-	state.Mutex.RUnlock()
+// LoginForRoute returns the newest user of the ip whose group allows the route, empty for entries without a user
+func LoginForRoute(store access.Store, ip string, route *config.ProxyConfig) (string, bool) {
+	g, ok := store.Lookup(ip)
+	if !ok {
+		return "", false
+	}
+	if len(g.Logins) == 0 {
+		return g.User, GroupAllows(g.GroupID, route)
+	}
+	now := time.Now()
+	for i := len(g.Logins) - 1; i >= 0; i-- {
+		l := g.Logins[i]
+		if (l.Expires.IsZero() || now.Before(l.Expires)) && GroupAllows(l.GroupID, route) {
+			return l.User, true
+		}
+	}
+	//None of the logins allows it, a config or manual entry under them still can
+	return "", GrantAllows(g, route)
+}
+
+// ReleaseConn forgets a closed conn
+func ReleaseConn(store access.Store, ip string, conn net.Conn) {
+	store.UntrackConn(ip, conn)
+}
 
-	if allowed {
+func CheckWhitelist(store access.Store, ip string) bool {
+	if _, allowed := store.Lookup(ip); allowed {
 		log.Printf("FIREWALL: Authorized connection from IP %v", ip)
 		return true
 	}
 	return false
 }
+
+// loginMu keeps two logins on the same ip from both reading the old grant and dropping each other
+var loginMu = sync.Mutex{}
+
+// WhitelistIP grants the ip access to every route the user's permission group allows, other users of the ip keep theirs
+func WhitelistIP(store access.Store, ip string, user string, groupID int) {
+	WhitelistIPUntil(store, ip, user, groupID, time.Time{})
+}
+
+// WhitelistIPUntil is WhitelistIP for logins without a stream to clean up after them, the login expires on its own
+func WhitelistIPUntil(store access.Store, ip string, user string, groupID int, expires time.Time) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+
+	login := access.Login{User: user, GroupID: groupID, Expires: expires}
+	g, ok := store.Lookup(ip)
+	if !ok || g.IP != ip { //a cidr isn't a login to add to, a config or manual entry on the ip keeps its own group next to the login
+		g = access.Grant{IP: ip}
+	}
+	store.Grant(g.WithLogin(login))
+	notifyChanged()
+}
+
+// RemoveLogin takes one user off the ip, the conns only close when that was the last user of the ip.
+// Conns the other users opened stay up, even on routes only the removed user could reach
+func RemoveLogin(store access.Store, ip string, user string) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	removeLoginLocked(store, ip, user)
+}
+
+func removeLoginLocked(store access.Store, ip string, user string) bool {
+	g, ok := store.Lookup(ip)
+	if !ok || g.IP != ip {
+		return false
+	}
+	if !slices.ContainsFunc(g.Logins, func(l access.Login) bool { return l.User == user }) {
+		return false
+	}
+	if rest, left := g.WithoutLogin(user); left {
+		store.Grant(rest)
+	} else {
+		store.Revoke(ip)
+	}
+	notifyChanged()
+	return true
+}
+
+// RevokeUser removes the user from every ip they whitelisted, ips without other users get closed. Returns the ips of the user
+func RevokeUser(store access.Store, user string) []string {
+	leaseMu.Lock()
+	dropLeasesLocked(func(l *Lease) bool { return l.User == user })
+	leaseMu.Unlock()
+
+	loginMu.Lock()
+	var revoked []string
+	for _, g := range store.List() {
+		if removeLoginLocked(store, g.IP, user) {
+			revoked = append(revoked, g.IP)
+		}
+	}
+	loginMu.Unlock()
+	if len(revoked) > 0 {
+		log.Printf("FIREWALL: Revoked %v whitelisted IPs of user %v", len(revoked), user)
+	}
+	return revoked
+}
+
+// RemoveIP takes the ip off the whitelist for every user and closes its open conns
+func RemoveIP(store access.Store, ip string) {
+	removeIP(store, ip)
+}
+
+// HasLogin is true when the user is one of the users that whitelisted the ip
+func HasLogin(store access.Store, ip, user string) bool {
+	g, ok := store.Lookup(ip)
+	return ok && slices.ContainsFunc(g.Logins, func(l access.Login) bool { return l.User == user })
+}
+
+// UserForIP returns the newest user that whitelisted this ip, empty if unknown
+func UserForIP(store access.Store, ip string) string {
+	g, _ := store.Lookup(ip)
+	return g.User
+}
+
+// WhitelistEntry is a whitelisted ip the way it gets saved across restarts
+type WhitelistEntry struct {
+	IP      string `json:"ip"`
+	User    string `json:"user"`
+	GroupID int    `json:"group_id"`
+}
+
+// WhitelistEntries lists every ip that is whitelisted right now
+func WhitelistEntries(store access.Store) []WhitelistEntry {
+	grants := store.List()
+	entries := make([]WhitelistEntry, 0, len(grants))
+	for _, g := range grants {
+		for _, l := range g.Logins { //config and manual entries are kept on their own, only the logins on top of them count
+			entries = append(entries, WhitelistEntry{IP: g.IP, User: l.User, GroupID: l.GroupID})
+		}
+	}
+	return entries
+}
+
+var changed = make(chan struct{}, 1)
+
+// Changed fires after the whitelist or the leases changed, used to save them
+func Changed() <-chan struct{} {
+	return changed
+}
+
+func notifyChanged() {
+	select {
+	case changed <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,187 @@
+package firewall
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"mazarin/access"
+	"sync"
+	"time"
+)
+
+// Leases whitelist an ip for a fixed time, api clients use them instead of keeping an sse session open
+type Lease struct {
+	ID      string    `json:"lease_id"`
+	IP      string    `json:"ip"`
+	User    string    `json:"user"`
+	KeyID   string    `json:"key_id"`
+	GroupID int       `json:"group_id"`
+	Expires time.Time `json:"expires_at"`
+	timer   *time.Timer
+}
+
+var (
+	leaseMu = sync.Mutex{}
+	leases  = make(map[string]*Lease)
+)
+
+// InUse tells if something besides the leases still keeps the user on the ip, like an open sse stream of the browser.
+// A lease that ends leaves such a login alone
+type InUse func(ip, user string) bool
+
+// GrantLease whitelists the ip the same way a browser login does, until the lease runs out
+func GrantLease(store access.Store, inUse InUse, ip, user string, groupID int, keyID string, duration time.Duration) Lease {
+	b := make([]byte, 16)
+	rand.Read(b)
+	lease := &Lease{
+		ID:      hex.EncodeToString(b),
+		IP:      ip,
+		User:    user,
+		KeyID:   keyID,
+		GroupID: groupID,
+		Expires: time.Now().Add(duration),
+	}
+
+	WhitelistIP(store, ip, user, groupID)
+
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	lease.timer = time.AfterFunc(duration, func() { expireLease(store, inUse, lease.ID) })
+	leases[lease.ID] = lease
+	log.Printf("FIREWALL: Lease %v whitelisted IP %v for %v until %v", lease.ID, ip, user, lease.Expires.Format(time.RFC3339))
+	return *lease
+}
+
+// RenewLease moves the end of a lease, only the api key that made it can renew it
+func RenewLease(id, keyID string, duration time.Duration) (Lease, bool) {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	lease, ok := leases[id]
+	if !ok || lease.KeyID != keyID {
+		return Lease{}, false
+	}
+	lease.Expires = time.Now().Add(duration)
+	lease.timer.Reset(duration)
+	notifyChanged()
+	return *lease, true
+}
+
+func ReleaseLease(store access.Store, inUse InUse, id, keyID string) bool {
+	leaseMu.Lock()
+	lease, ok := leases[id]
+	if !ok || lease.KeyID != keyID {
+		leaseMu.Unlock()
+		return false
+	}
+	logins := dropLeasesLocked(func(l *Lease) bool { return l.ID == id })
+	leaseMu.Unlock()
+
+	removeLogins(store, inUse, logins)
+	log.Printf("FIREWALL: Lease %v released", id)
+	return true
+}
+
+// ReleaseKeyLeases ends every lease made with an api key, for when the key gets deleted
+func ReleaseKeyLeases(store access.Store, inUse InUse, keyID string) {
+	leaseMu.Lock()
+	logins := dropLeasesLocked(func(l *Lease) bool { return l.KeyID == keyID })
+	leaseMu.Unlock()
+	removeLogins(store, inUse, logins)
+}
+
+// LeaseActive is true when an api lease keeps this ip whitelisted for the user
+func LeaseActive(ip, user string) bool {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	for _, lease := range leases {
+		if lease.IP == ip && lease.User == user {
+			return true
+		}
+	}
+	return false
+}
+
+func expireLease(store access.Store, inUse InUse, id string) {
+	leaseMu.Lock()
+	lease, ok := leases[id]
+	if !ok || time.Now().Before(lease.Expires) { //renewed while the timer fired
+		leaseMu.Unlock()
+		return
+	}
+	logins := dropLeasesLocked(func(l *Lease) bool { return l.ID == id })
+	leaseMu.Unlock()
+
+	removeLogins(store, inUse, logins)
+	log.Printf("FIREWALL: Lease %v for IP %v expired", id, lease.IP)
+}
+
+type ipLogin struct {
+	ip   string
+	user string
+}
+
+// dropLeasesLocked removes the matching leases, returns the ip and user pairs no other lease keeps whitelisted
+func dropLeasesLocked(match func(*Lease) bool) []ipLogin {
+	dropped := make(map[ipLogin]bool)
+	for id, lease := range leases {
+		if match(lease) {
+			lease.timer.Stop()
+			delete(leases, id)
+			dropped[ipLogin{lease.IP, lease.User}] = true
+			notifyChanged()
+		}
+	}
+	for _, lease := range leases {
+		delete(dropped, ipLogin{lease.IP, lease.User})
+	}
+
+	logins := make([]ipLogin, 0, len(dropped))
+	for login := range dropped {
+		logins = append(logins, login)
+	}
+	return logins
+}
+
+func removeLogins(store access.Store, inUse InUse, logins []ipLogin) {
+	for _, login := range logins {
+		if inUse != nil && inUse(login.ip, login.user) {
+			log.Printf("FIREWALL: %v stays on IP %v, the login is still in use", login.user, login.ip)
+			continue
+		}
+		RemoveLogin(store, login.ip, login.user)
+	}
+}
+
+// removeIP takes the ip off the whitelist and closes its conns
+func removeIP(store access.Store, ip string) {
+	store.Revoke(ip)
+	notifyChanged()
+}
+
+// Leases returns a copy of every active lease
+func Leases() []Lease {
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	list := make([]Lease, 0, len(leases))
+	for _, lease := range leases {
+		list = append(list, *lease)
+	}
+	return list
+}
+
+// RestoreLease brings a saved lease back after a restart, false when it already ran out
+func RestoreLease(store access.Store, inUse InUse, saved Lease) bool {
+	remaining := time.Until(saved.Expires)
+	if saved.ID == "" || remaining <= 0 {
+		return false
+	}
+
+	WhitelistIP(store, saved.IP, saved.User, saved.GroupID)
+
+	leaseMu.Lock()
+	defer leaseMu.Unlock()
+	lease := saved
+	lease.timer = time.AfterFunc(remaining, func() { expireLease(store, inUse, lease.ID) })
+	leases[lease.ID] = &lease
+	return true
+}
@@ -0,0 +1,80 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"mazarin/config"
+	"net/url"
+	"strings"
+)
+
+// Group id 0 means no group, those users can reach every route like before
+var permissionGroups = make(map[int]*config.PermissionGroup)
+
+func InitPermissions(groups []config.PermissionGroup) error {
+	loaded := make(map[int]*config.PermissionGroup, len(groups))
+	for i := range groups {
+		id := groups[i].ID
+		if id <= 0 {
+			return fmt.Errorf("permission group %q needs an id above 0", groups[i].Name)
+		}
+		if _, exists := loaded[id]; exists {
+			return fmt.Errorf("permission group id %v is used twice", id)
+		}
+		loaded[id] = &groups[i]
+	}
+	permissionGroups = loaded
+	log.Printf("FIREWALL: Loaded %v permission groups", len(groups))
+	return nil
+}
+
+// GroupExists is true for the groups from config.json and for 0
+func GroupExists(groupID int) bool {
+	_, ok := permissionGroups[groupID]
+	return groupID == 0 || ok
+}
+
+// GroupAllows checks if a permission group may access the route
+func GroupAllows(groupID int, route *config.ProxyConfig) bool {
+	if groupID == 0 || route == nil || route.Type == "func" { //the login page has to stay reachable
+		return true
+	}
+	group, ok := permissionGroups[groupID]
+	if !ok {
+		log.Printf("FIREWALL: Unknown permission group %v, denying access", groupID)
+		return false
+	}
+	for _, selector := range group.Routes {
+		if routeMatches(selector, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// A selector is the proxy name, its port (":25565" or "25565") or its host
+func routeMatches(selector string, route *config.ProxyConfig) bool {
+	selector = strings.TrimSpace(selector)
+	switch {
+	case selector == "*":
+		return true
+	case route.Name != "" && selector == route.Name:
+		return true
+	case selector == route.Port || ":"+selector == route.Port:
+		return true
+	}
+	if route.ListenUrl == "" {
+		return false
+	}
+	return strings.EqualFold(selector, route.ListenUrl) || strings.EqualFold(selector, routeHost(route.ListenUrl))
+}
+
+func routeHost(listenURL string) string {
+	if strings.Contains(listenURL, "://") {
+		if u, err := url.Parse(listenURL); err == nil {
+			return u.Hostname()
+		}
+	}
+	host, _, _ := strings.Cut(listenURL, "/")
+	return host
+}
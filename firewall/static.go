@@ -0,0 +1,97 @@
+package firewall
+
+import (
+	"fmt"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"time"
+)
+
+// LoadStatic whitelists the static_whitelist entries, entries that were removed from the config get revoked
+func LoadStatic(store access.Store, entries []config.StaticWhitelistEntry) error {
+	grants := make(map[string]access.Grant)
+	for _, entry := range entries {
+		target, _, err := access.ParseTarget(entry.Target)
+		if err != nil {
+			return fmt.Errorf("invalid target %q: %v", entry.Target, err)
+		}
+		if entry.Expires.IsZero() || time.Now().Before(entry.Expires) {
+			grants[target] = access.Grant{IP: target, GroupID: entry.GroupID, Expires: entry.Expires, Note: entry.Note, Source: access.SourceConfig}
+		}
+	}
+
+	//The sqlite store or a peer can still have entries from an older config
+	for _, g := range store.List() {
+		if _, ok := grants[g.IP]; !ok && g.Source == access.SourceConfig {
+			revokeEntry(store, g.IP)
+		}
+	}
+	for _, g := range grants {
+		GrantEntry(store, g)
+	}
+	if len(grants) > 0 {
+		log.Printf("FIREWALL: Loaded %v static whitelist entries", len(grants))
+	}
+	return nil
+}
+
+// AddManual whitelists an ip or cidr without an account, a duration of 0 keeps it until removed
+func AddManual(store access.Store, target string, duration time.Duration, note string, groupID int) (access.Grant, error) {
+	target, _, err := access.ParseTarget(target)
+	if err != nil {
+		return access.Grant{}, err
+	}
+	g := access.Grant{IP: target, GroupID: groupID, Note: note, Source: access.SourceManual}
+	if duration > 0 {
+		g.Expires = time.Now().Add(duration)
+	}
+	GrantEntry(store, g)
+	notifyChanged()
+	log.Printf("FIREWALL: Manually whitelisted %v until %v (%v)", target, expiresText(g.Expires), note)
+	return g, nil
+}
+
+// GrantEntry puts a config or manual entry on its ip or cidr, users logged in from that ip keep their logins
+func GrantEntry(store access.Store, entry access.Grant) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	if g, ok := store.Lookup(entry.IP); ok && g.IP == entry.IP {
+		entry = g.WithEntry(entry)
+	}
+	store.Grant(entry)
+}
+
+// revokeEntry drops the config or manual entry of the ip, the grant only goes when nobody is logged in on top of it
+func revokeEntry(store access.Store, ip string) {
+	loginMu.Lock()
+	defer loginMu.Unlock()
+	g, ok := store.Lookup(ip)
+	if !ok || g.IP != ip {
+		return
+	}
+	if rest, left := g.WithoutEntry(); left {
+		store.Grant(rest)
+	} else {
+		store.Revoke(ip)
+	}
+}
+
+// dropEndedEntries takes config and manual entries that ran out off the ips users are still logged in on,
+// Prune only drops the whole grant once the logins are gone too
+func dropEndedEntries(store access.Store) {
+	now := time.Now()
+	for _, g := range store.List() {
+		if g.Source != "" && len(g.Logins) > 0 && !g.EntryExpires.IsZero() && !now.Before(g.EntryExpires) {
+			revokeEntry(store, g.IP)
+			log.Printf("FIREWALL: Whitelist entry for %v expired, its logins stay", g.IP)
+		}
+	}
+}
+
+func expiresText(t time.Time) string {
+	if t.IsZero() {
+		return "removed"
+	}
+	return t.Format(time.RFC3339)
+}
@@ -9,18 +9,24 @@ type InputType string
 
 // declare const instead of writing "string" in the switch case, might change other switch statements to this for security
 const (
-	TypeUsername InputType = "username"
-	TypePassword InputType = "password"
-	TypePath     InputType = "path"
-	TypeURL      InputType = "url"
+	TypeUsername     InputType = "username"
+	TypePassword     InputType = "password"
+	TypeLongPassword InputType = "long_password" //argon2id keys, bcrypt ignores everything after 72 bytes
+	TypePath         InputType = "path"
+	TypeURL          InputType = "url"
+	TypeOTP          InputType = "otp"
+	TypeInvite       InputType = "invite"
 )
 
 // Handy for testing https://regex101.com/
 var (
-	UsernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
-	PasswordPattern = regexp.MustCompile(`^[a-zA-Z0-9._:/?#@!$&'()*+,;=-]{12,64}$`)
-	UrlPattern      = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
-	PathPattern     = regexp.MustCompile(`^[a-zA-Z0-9\s._~:/?#[\]@!$&'()*+,;=-]*$`)
+	UsernamePattern     = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+	PasswordPattern     = regexp.MustCompile(`^[a-zA-Z0-9._:/?#@!$&'()*+,;=-]{12,64}$`)
+	LongPasswordPattern = regexp.MustCompile(`^[a-zA-Z0-9._:/?#@!$&'()*+,;=-]{12,256}$`)
+	UrlPattern          = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+	PathPattern         = regexp.MustCompile(`^[a-zA-Z0-9\s._~:/?#[\]@!$&'()*+,;=-]*$`)
+	OtpPattern          = regexp.MustCompile(`^([0-9]{6}|[a-z2-7]{4}-[a-z2-7]{4})$`) //app code or recovery code
+	InvitePattern       = regexp.MustCompile(`^[a-z2-7]{4}(-[a-z2-7]{4}){3}$`)
 )
 
 func ValidateInput(input string, inputType InputType) bool {
@@ -34,6 +40,8 @@ func ValidateInput(input string, inputType InputType) bool {
 		return UsernamePattern.MatchString(input)
 	case TypePassword:
 		return PasswordPattern.MatchString(input)
+	case TypeLongPassword:
+		return LongPasswordPattern.MatchString(input)
 	case TypePath:
 		//no escaping out of the static folder
 		if strings.Contains(input, "..") {
@@ -42,6 +50,10 @@ func ValidateInput(input string, inputType InputType) bool {
 		return PathPattern.MatchString(input)
 	case TypeURL:
 		return UrlPattern.MatchString(input)
+	case TypeOTP:
+		return OtpPattern.MatchString(input)
+	case TypeInvite:
+		return InvitePattern.MatchString(input)
 	default:
 		return false
 	}
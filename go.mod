@@ -6,6 +6,7 @@ toolchain go1.24.2
 
 require (
 	golang.org/x/crypto v0.45.0
+	golang.org/x/term v0.37.0
 	modernc.org/sqlite v1.40.0
 )
 
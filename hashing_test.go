@@ -0,0 +1,126 @@
+package main
+
+import (
+	"mazarin/config"
+	"mazarin/webserver"
+	"strings"
+	"testing"
+)
+
+// This test checks that argon2id and bcrypt hashes both validate, whatever the current policy is
+func TestHashAlgorithms(t *testing.T) {
+	bcryptHash, err := webserver.HashKey("test_password")
+	if err != nil {
+		t.Fatalf("Failed to make a bcrypt hash: %v", err)
+	}
+
+	if err := webserver.SetHashPolicy(config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 1024, Argon2Time: 1}); err != nil {
+		t.Fatal(err)
+	}
+	defer webserver.SetHashPolicy(config.HashingConfig{})
+
+	argonHash, err := webserver.HashKey("test_password")
+	if err != nil {
+		t.Fatalf("Failed to make an argon2id hash: %v", err)
+	}
+	if !strings.HasPrefix(argonHash, "$argon2id$v=19$m=1024,t=1,p=1$") {
+		t.Errorf("Unexpected argon2id hash format: %v", argonHash)
+	}
+
+	for _, hash := range []string{bcryptHash, argonHash} {
+		if ok, err := webserver.ValidateUserHash("test_password", hash); !ok || err != nil {
+			t.Errorf("Correct password rejected for %v: %v", hash, err)
+		}
+		if ok, err := webserver.ValidateUserHash("wrong_password", hash); ok || err != nil {
+			t.Errorf("Wrong password accepted or errored for %v: %v", hash, err)
+		}
+	}
+
+	if _, err := webserver.ValidateUserHash("test_password", "$argon2id$v=19$m=1024$broken"); err == nil {
+		t.Error("Expected an error for a broken hash")
+	}
+	if err := webserver.SetHashPolicy(config.HashingConfig{Algorithm: "md5"}); err == nil {
+		t.Error("Expected an error for an unknown algorithm")
+	}
+}
+
+// This test checks that a login rehashes the stored key when the policy asks for another algorithm or stronger settings, and leaves it alone otherwise
+func TestHashUpgradeOnLogin(t *testing.T) {
+	t.Cleanup(func() { webserver.SetHashPolicy(config.HashingConfig{}) })
+	if err := webserver.SetHashPolicy(config.HashingConfig{BcryptCost: 4}); err != nil {
+		t.Fatal(err)
+	}
+	hash, _ := webserver.HashKey("grace_password_1")
+	conf, _ := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "grace", Hash: hash})
+
+	for i, step := range []struct {
+		policy config.HashingConfig
+		want   string
+	}{
+		{config.HashingConfig{BcryptCost: 5}, "$2a$05$"},
+		{config.HashingConfig{BcryptCost: 4}, "$2a$05$"}, //a stronger hash stays
+		{config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 1024, Argon2Time: 1}, "$argon2id$v=19$m=1024,t=1,p=1$"},
+		{config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 2048, Argon2Time: 1}, "$argon2id$v=19$m=2048,t=1,p=1$"},
+		{config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 2048, Argon2Time: 2}, "$argon2id$v=19$m=2048,t=2,p=1$"},
+		{config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 2048, Argon2Time: 2, Argon2Threads: 2}, "$argon2id$v=19$m=2048,t=2,p=2$"},
+		{config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 1024, Argon2Time: 1}, "$argon2id$v=19$m=2048,t=2,p=2$"},
+	} {
+		if err := webserver.SetHashPolicy(step.policy); err != nil {
+			t.Fatal(err)
+		}
+		before := webserver.LoadUsers(conf)["grace"].Hash
+		loginCookie(t, "grace", "grace_password_1", "192.0.2.130")
+		after := webserver.LoadUsers(conf)["grace"].Hash
+		if !strings.HasPrefix(after, step.want) {
+			t.Errorf("Step %v %+v: got %v, want a %v hash", i, step.policy, after, step.want)
+		}
+		if strings.HasPrefix(before, step.want) && after != before {
+			t.Errorf("Step %v %+v: a hash that was strong enough got rehashed", i, step.policy)
+		}
+	}
+}
+
+// This test checks that argon2id hashes with a broken format, version or settings are errors instead of a wrong password
+func TestArgon2Malformed(t *testing.T) {
+	for _, hash := range []string{
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA",
+		"$argon2id$v=18$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$c3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3U",
+		"$argon2id$v=19$m=lots,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$c3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3U",
+		"$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0c2FsdA$c3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3U",
+		"$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0c2FsdA$c3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3U",
+		"$argon2id$v=19$m=1024,t=1,p=1$not base64!$c3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3Vtc3U",
+		"$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0c2FsdA$",
+	} {
+		if ok, err := webserver.ValidateUserHash("test_password", hash); ok || err == nil {
+			t.Errorf("%v: got %v %v, want an error", hash, ok, err)
+		}
+	}
+}
+
+// This test checks that keys longer than 64 characters are only taken when argon2id hashes them, bcrypt would cut them at 72 bytes
+func TestLongKeys(t *testing.T) {
+	t.Cleanup(func() { webserver.SetHashPolicy(config.HashingConfig{}) })
+	long := strings.Repeat("long_key_", 20)
+	if _, err := webserver.HashKey(long); err == nil {
+		t.Error("bcrypt took a 180 character key")
+	}
+
+	if err := webserver.SetHashPolicy(config.HashingConfig{Algorithm: "argon2id", Argon2Memory: 1024, Argon2Time: 1}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := webserver.HashKey(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := webserver.HashKey(long + strings.Repeat("x", 100)); err == nil {
+		t.Error("argon2id took a 280 character key")
+	}
+	testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "heidi", Hash: hash})
+	loginCookie(t, "heidi", long, "192.0.2.131")
+
+	//Going back to bcrypt keeps the login working, the key just can't be rehashed
+	if err := webserver.SetHashPolicy(config.HashingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	loginCookie(t, "heidi", long, "192.0.2.131")
+}
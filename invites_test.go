@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeInvites puts invites for these codes in invites.json, the way admins create them
+func writeInvites(t *testing.T, dir string, invites map[string]webserver.Invite) {
+	t.Helper()
+	var file struct {
+		Invites []webserver.Invite `json:"invites"`
+	}
+	for code, invite := range invites {
+		sum := sha256.Sum256([]byte(code))
+		invite.Hash = hex.EncodeToString(sum[:])
+		invite.ID = invite.Hash[:8]
+		file.Invites = append(file.Invites, invite)
+	}
+	data, _ := json.Marshal(file)
+	if err := os.WriteFile(filepath.Join(dir, "invites.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// register posts to /register from its own ip, so the lockout of one case doesnt slow down the next
+func register(name, invite, ip string) *httptest.ResponseRecorder {
+	body := `{"username":"` + name + `","key":"` + name + `_password_1","invite":"` + invite + `"}`
+	r := httptest.NewRequest("POST", "/register", strings.NewReader(body))
+	r.RemoteAddr = ip + ":5000"
+	w := httptest.NewRecorder()
+	webserver.RegisterHandler(w, r)
+	return w
+}
+
+// This test checks that an invite creates exactly as many users as it has uses, and that expired invites create none
+func TestInvites(t *testing.T) {
+	dir := t.TempDir()
+	writeInvites(t, dir, map[string]webserver.Invite{
+		"aaaa-bbbb-cccc-dddd": {UsesLeft: 1, PermissionGroupID: 3},
+		"eeee-ffff-gggg-hhhh": {UsesLeft: 5, Expires: time.Now().Add(-time.Minute)},
+	})
+	conf, _ := testWebserver(t, config.WebserverConfig{KeysDir: dir, EnableRegister: true})
+
+	if w := register("alice", "aaaa-bbbb-cccc-dddd", "198.51.100.1"); w.Code != http.StatusOK {
+		t.Fatalf("First use: got %v %v, want 200", w.Code, w.Body.String())
+	}
+	if w := register("bob", "aaaa-bbbb-cccc-dddd", "198.51.100.2"); w.Code != http.StatusForbidden {
+		t.Errorf("Second use of a single use invite: got %v, want 403", w.Code)
+	}
+	if w := register("carol", "eeee-ffff-gggg-hhhh", "198.51.100.3"); w.Code != http.StatusForbidden {
+		t.Errorf("Expired invite: got %v, want 403", w.Code)
+	}
+
+	users := webserver.LoadUsers(conf)
+	if len(users) != 1 || users["alice"].PermissionGroupID != 3 {
+		t.Errorf("Users: got %+v, want only alice in group 3", users)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "invites.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Count(string(data), `"hash"`) != 1 {
+		t.Errorf("invites.json still has the used up invite: %s", data)
+	}
+}
+
+// This test checks that admins can't create invites for a missing permission group or with a negative expiry
+func TestCreateInvite(t *testing.T) {
+	if err := firewall.InitPermissions([]config.PermissionGroup{{ID: 1, Name: "friends", Routes: []string{"survival"}}}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { firewall.InitPermissions(nil) })
+	hash, _ := webserver.HashKey("admin_password_1")
+	testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "admin", Hash: hash, Admin: true})
+	admin := loginCookie(t, "admin", "admin_password_1", "198.51.100.20")
+
+	for _, c := range []struct {
+		body string
+		want int
+	}{
+		{`{}`, http.StatusOK},
+		{`{"uses":2,"expires_hours":48,"permission_group_id":1}`, http.StatusOK},
+		{`{"permission_group_id":7}`, http.StatusBadRequest},
+		{`{"expires_hours":-1}`, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest("POST", "/admin/api/invites", strings.NewReader(c.body))
+		r.AddCookie(admin)
+		w := httptest.NewRecorder()
+		webserver.AdminHandler(w, r)
+		if w.Code != c.want {
+			t.Errorf("%v: got %v %v, want %v", c.body, w.Code, w.Body.String(), c.want)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/admin/api/invites", nil)
+	r.AddCookie(admin)
+	w := httptest.NewRecorder()
+	webserver.AdminHandler(w, r)
+	var invites []webserver.Invite
+	if err := json.Unmarshal(w.Body.Bytes(), &invites); err != nil || len(invites) != 2 {
+		t.Errorf("Invites: got %v %v, want the two valid ones", w.Body.String(), err)
+	}
+}
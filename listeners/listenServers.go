@@ -4,9 +4,11 @@ import (
 	"context"
 	"crypto/tls"
 	"log"
+	"mazarin/access"
 	"mazarin/config"
 	"mazarin/firewall"
 	"mazarin/proxy"
+	"mazarin/proxyproto"
 	"mazarin/router"
 	"net"
 	"net/http"
@@ -15,10 +17,10 @@ import (
 	"time"
 )
 
-func ListenProxy(ctx context.Context, fw *config.FirewallConfig, proxyConf *config.ProxyConfig, wg *sync.WaitGroup) error {
+func ListenProxy(ctx context.Context, fw *config.FirewallConfig, store access.Store, proxyConf *config.ProxyConfig, wg *sync.WaitGroup) error {
 	defer wg.Done()
 
-	listener, err := net.Listen(proxyConf.Protocol, proxyConf.Port)
+	listener, err := listen(fw, proxyConf.Protocol, proxyConf.Port)
 	if err != nil {
 		log.Printf("PROXY: %v %v failed to start: %v", proxyConf.Protocol, proxyConf.Port, err)
 		return err
@@ -45,27 +47,8 @@ func ListenProxy(ctx context.Context, fw *config.FirewallConfig, proxyConf *conf
 				continue
 			}
 
-			clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
-			if err != nil {
-				log.Printf("PROXY: Failed to parse client IP: %v", err)
-				continue
-			}
-
-			allowed := true
-			if fw.EnableFirewall {
-				allowed = fw.DefaultAllow
-				if !allowed {
-					allowed = firewall.CheckWhitelistAddConn(clientIP, conn)
-				}
-			}
-
-			if allowed {
-				log.Printf("PROXY: %v %v Starting proxy for %v to dest %v", proxyConf.Protocol, proxyConf.Port, clientIP, proxyConf.TargetAddr)
-				go proxy.HandleProxyConnection(ctx, conn, proxyConf.TargetAddr, clientIP, proxyConf.Protocol)
-			} else {
-				log.Printf("PROXY: %v %v Blocked connection from: %v", proxyConf.Protocol, proxyConf.Port, clientIP)
-				conn.Close()
-			}
+			//RemoteAddr can wait on a PROXY header, so dont do it in the accept loop
+			go handleProxyConn(ctx, conn, fw, store, proxyConf)
 		}
 	}()
 
@@ -75,6 +58,53 @@ func ListenProxy(ctx context.Context, fw *config.FirewallConfig, proxyConf *conf
 	return nil
 }
 
+func handleProxyConn(ctx context.Context, conn net.Conn, fw *config.FirewallConfig, store access.Store, proxyConf *config.ProxyConfig) {
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("PROXY: Failed to parse client IP: %v", err)
+		conn.Close()
+		return
+	}
+
+	if firewallAllows(fw, store, clientIP, proxyConf, conn) {
+		log.Printf("PROXY: %v %v Starting proxy for %v to dest %v", proxyConf.Protocol, proxyConf.Port, clientIP, proxyConf.TargetAddr)
+		proxy.HandleProxyConnection(ctx, store, conn, proxyConf, clientIP)
+	} else {
+		log.Printf("PROXY: %v %v Blocked connection from: %v", proxyConf.Protocol, proxyConf.Port, clientIP)
+		conn.Close()
+	}
+}
+
+// listen opens a listener, conns from proxy_protocol_from sources get their client address from the PROXY header
+func listen(fw *config.FirewallConfig, network, addr string) (net.Listener, error) {
+	listener, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(fw.ProxyProtocolFrom) == 0 {
+		return listener, nil
+	}
+
+	trusted, err := firewall.ParseCIDRs(fw.ProxyProtocolFrom)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return proxyproto.NewListener(listener, trusted), nil
+}
+
+// firewallAllows checks the whitelist and permission group for a raw conn, whitelisted conns get tracked so they can be closed on logout
+func firewallAllows(fw *config.FirewallConfig, store access.Store, clientIP string, route *config.ProxyConfig, conn net.Conn) bool {
+	if firewall.IsBanned(store, clientIP) {
+		log.Printf("FIREWALL: Dropped connection from banned IP %v", clientIP)
+		return false
+	}
+	if !fw.EnableFirewall || fw.DefaultAllow {
+		return true
+	}
+	return firewall.CheckWhitelistAddConn(store, clientIP, route, conn)
+}
+
 //WEB LISTEN----------
 
 func ListenWebTLS(parentCtx context.Context, tlsConf *config.TLSConfig, fw *config.FirewallConfig, srv *config.ParsedProxy, webConf *config.WebserverConfig, wg *sync.WaitGroup) {
@@ -83,6 +113,33 @@ func ListenWebTLS(parentCtx context.Context, tlsConf *config.TLSConfig, fw *conf
 	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
 
+	server := newWebTLSServer(ctx, fw, srv, webConf)
+
+	var webWG sync.WaitGroup
+	webWG.Add(1)
+	go func() {
+		defer webWG.Done()
+
+		listener, err := listen(fw, "tcp", srv.Port)
+		if err != nil {
+			log.Printf("HTTPS Listener: %v failed to start: %v", srv.Port, err)
+			cancel()
+			return
+		}
+
+		log.Printf("HTTPS Listener: %v server started", srv.Port)
+		err = server.ServeTLS(listener, tlsConf.Cert, tlsConf.Key)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("HTTPS Listener: ServeTLS error: %v", err)
+			cancel()
+		}
+	}()
+
+	listenForExit(ctx, server, &webWG)
+}
+
+// newWebTLSServer builds the https server used for terminated web routes, the caller decides where it listens
+func newWebTLSServer(ctx context.Context, fw *config.FirewallConfig, srv *config.ParsedProxy, webConf *config.WebserverConfig) *http.Server {
 	//Some handy tips: https://blog.cloudflare.com/exposing-go-on-the-internet/
 
 	//Load tls cert and key is currently not working, I think the standard certs domain registrars give you have to be edited for this
@@ -126,20 +183,7 @@ func ListenWebTLS(parentCtx context.Context, tlsConf *config.TLSConfig, fw *conf
 	//Let the router handle everything
 	mux.HandleFunc("/", router.RouteWithCfg(ctx, webConf, fw))
 
-	var webWG sync.WaitGroup
-	webWG.Add(1)
-	go func() {
-		defer webWG.Done()
-
-		log.Printf("HTTPS Listener: %v server started", srv.Port)
-		err := server.ListenAndServeTLS(tlsConf.Cert, tlsConf.Key)
-		if err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTPS Listener: ListenAndServeTLS error: %v", err)
-			cancel()
-		}
-	}()
-
-	listenForExit(ctx, server, &webWG)
+	return server
 }
 
 func ListenWeb(parentCtx context.Context, tlsConf *config.TLSConfig, fw *config.FirewallConfig, srv *config.ProxyConfig, webConf *config.WebserverConfig, wg *sync.WaitGroup) {
@@ -165,10 +209,17 @@ func ListenWeb(parentCtx context.Context, tlsConf *config.TLSConfig, fw *config.
 	go func() {
 		defer webWG.Done()
 
+		listener, err := listen(fw, "tcp", srv.Port)
+		if err != nil {
+			log.Printf("HTTP Listener: %v %v failed to start: %v", srv.ListenUrl, srv.Port, err)
+			cancel()
+			return
+		}
+
 		log.Printf("HTTP Listener: %v %v server started", srv.ListenUrl, srv.Port)
-		err := server.ListenAndServe()
+		err = server.Serve(listener)
 		if err != nil && err != http.ErrServerClosed {
-			log.Printf("HTTP Listener: ListenAndServeTLS error: %v", err)
+			log.Printf("HTTP Listener: Serve error: %v", err)
 			cancel()
 		}
 	}()
@@ -0,0 +1,133 @@
+package listeners
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/minecraft"
+	"mazarin/proxy"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultMotd = "§cUnknown server address"
+
+// ListenMinecraft is a tcp listener that reads the minecraft handshake and routes the client by the address they typed
+func ListenMinecraft(ctx context.Context, tlsConf *config.TLSConfig, fw *config.FirewallConfig, store access.Store, srv *config.ParsedProxy, webConf *config.WebserverConfig, wg *sync.WaitGroup) error {
+	defer wg.Done()
+
+	listener, err := listen(fw, "tcp", srv.Port)
+	if err != nil {
+		log.Printf("MINECRAFT: %v failed to start: %v", srv.Port, err)
+		return err
+	}
+	defer listener.Close()
+	log.Printf("MINECRAFT: %v server started with %v routes", srv.Port, len(srv.LinkedProxies))
+
+	routes := make(map[string]*config.ProxyConfig)
+	for _, route := range srv.LinkedProxies {
+		routes[strings.ToLower(route.ListenUrl)] = route
+	}
+	fallbackMotd := srv.Motd
+	if fallbackMotd == "" {
+		fallbackMotd = defaultMotd
+	}
+	loginURL := webConf.LoginURL(tlsConf)
+
+	var listenWG sync.WaitGroup
+
+	listenWG.Add(1)
+	go func() {
+		defer listenWG.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ne, ok := err.(*net.OpError); ok {
+					if ne.Op == "accept" && strings.Contains(ne.Error(), "use of closed network connection") {
+						log.Printf("MINECRAFT: %v accept loop exiting, listener has been closed", srv.Port)
+						return
+					}
+				}
+				log.Printf("MINECRAFT: %v failed to accept connection: %v", srv.Port, err)
+				continue
+			}
+
+			go handleMinecraftConn(ctx, conn, fw, store, routes, fallbackMotd, loginURL)
+		}
+	}()
+
+	<-ctx.Done()
+	stopServer(listener)
+	listenWG.Wait()
+	return nil
+}
+
+func handleMinecraftConn(ctx context.Context, conn net.Conn, fw *config.FirewallConfig, store access.Store, routes map[string]*config.ProxyConfig, fallbackMotd, loginURL string) {
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("MINECRAFT: Failed to parse client IP: %v", err)
+		conn.Close()
+		return
+	}
+
+	//Dont let clients hold the goroutine hostage before they even said hello
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	br := bufio.NewReader(conn)
+	handshake, raw, err := minecraft.ReadHandshake(br)
+	if err != nil {
+		if !errors.Is(err, io.EOF) {
+			log.Printf("MINECRAFT: Invalid handshake from %v: %v", clientIP, err)
+		}
+		conn.Close()
+		return
+	}
+	hostname := handshake.Hostname()
+
+	route, ok := routes[hostname]
+	if !ok {
+		log.Printf("MINECRAFT: %v requested unknown server address %v", clientIP, hostname)
+		rejectMinecraftConn(conn, br, handshake, fallbackMotd, "Unknown server address: "+hostname)
+		return
+	}
+
+	//Replay the handshake and anything the client already sent after it
+	clientConn := proxy.NewPrefixConn(conn, io.MultiReader(bytes.NewReader(raw), br))
+
+	if !firewallAllows(fw, store, clientIP, route, clientConn) {
+		log.Printf("MINECRAFT: Blocked connection from %v to %v", clientIP, hostname)
+		message := "You are not whitelisted on this server"
+		if loginURL != "" {
+			message = "Please log in at " + loginURL + " before joining"
+		}
+		rejectMinecraftConn(conn, br, handshake, message, message)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	log.Printf("MINECRAFT: Starting proxy for %v (%v) to dest %v", clientIP, hostname, route.TargetAddr)
+	proxy.HandleProxyConnection(ctx, store, clientConn, route, clientIP)
+}
+
+// rejectMinecraftConn answers the client ourselves, a motd for the server list and a kick message for logins
+func rejectMinecraftConn(conn net.Conn, br *bufio.Reader, handshake minecraft.Handshake, motd, kickMessage string) {
+	defer conn.Close()
+
+	var err error
+	switch handshake.NextState {
+	case minecraft.StateStatus:
+		err = minecraft.HandleStatus(conn, br, handshake.ProtocolVersion, motd)
+	case minecraft.StateLogin, minecraft.StateTransfer:
+		err = minecraft.Disconnect(conn, kickMessage)
+	}
+	if err != nil {
+		log.Printf("MINECRAFT: Failed to answer client: %v", err)
+	}
+}
@@ -0,0 +1,122 @@
+package listeners
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"mazarin/access"
+	"mazarin/config"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pipeConn is one end of a net.Pipe that says it comes from a client ip, the handler needs one to check the whitelist
+type pipeConn struct {
+	net.Conn
+}
+
+func (pipeConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("198.51.100.50"), Port: 50000}
+}
+
+// packet frames a minecraft packet, everything in these tests is short enough for one byte lengths
+func packet(id byte, data ...byte) []byte {
+	return append([]byte{byte(len(data) + 1), id}, data...)
+}
+
+// handshake of a 1.21 client (protocol 767) for host:25565, next is 1 for the server list and 2 for a login
+func handshake(host string, next byte) []byte {
+	data := append([]byte{0xff, 0x05, byte(len(host))}, host...)
+	return packet(0x00, append(data, 0x63, 0xdd, next)...)
+}
+
+// readString reads the next packet the way the client would and returns the string in it, the status json or the kick reason
+func readString(t *testing.T, br *bufio.Reader) string {
+	t.Helper()
+	length, err := binary.ReadUvarint(br)
+	if err != nil {
+		t.Fatalf("Reading the answer: %v", err)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(br, body); err != nil {
+		t.Fatalf("Reading the answer: %v", err)
+	}
+	if body[0] != 0x00 {
+		t.Fatalf("Packet id: got %x, want 00", body[0])
+	}
+	size, n := binary.Uvarint(body[1:])
+	return string(body[1+n : 1+n+int(size)])
+}
+
+// dialMinecraft hands the server end of a pipe to the minecraft handler, the route play.domain.com needs a login
+func dialMinecraft(t *testing.T, loginURL string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	server, client := net.Pipe()
+	routes := map[string]*config.ProxyConfig{"play.domain.com": {Name: "survival", ListenUrl: "play.domain.com", TargetAddr: "127.0.0.1:1"}}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		handleMinecraftConn(context.Background(), pipeConn{server}, &config.FirewallConfig{EnableFirewall: true}, access.NewMemoryStore(), routes, defaultMotd, loginURL)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, bufio.NewReader(client)
+}
+
+// This test checks that the server list shows the fallback motd for unknown addresses and echoes the ping
+func TestMinecraftUnknownHostStatus(t *testing.T) {
+	client, br := dialMinecraft(t, "")
+	client.Write(handshake("nope.domain.com", 1))
+	client.Write(packet(0x00))
+
+	if status := readString(t, br); !strings.Contains(status, `"text":"§cUnknown server address"`) || !strings.Contains(status, `"protocol":767`) {
+		t.Errorf("Status: got %v, want the fallback motd", status)
+	}
+
+	ping := packet(0x01, 1, 2, 3, 4, 5, 6, 7, 8)
+	client.Write(ping)
+	pong := make([]byte, len(ping))
+	if _, err := io.ReadFull(br, pong); err != nil || string(pong) != string(ping) {
+		t.Errorf("Pong: got %x %v, want %x", pong, err, ping)
+	}
+}
+
+// This test checks that a login to an unknown address gets kicked with the address it asked for
+func TestMinecraftUnknownHostLogin(t *testing.T) {
+	client, br := dialMinecraft(t, "https://login.domain.com")
+	client.Write(handshake("nope.domain.com", 2))
+
+	if reason := readString(t, br); reason != `{"text":"Unknown server address: nope.domain.com"}` {
+		t.Errorf("Kick: got %v, want the unknown address", reason)
+	}
+}
+
+// This test checks that ips without a login get told where to log in, both in the server list and when they join
+func TestMinecraftNotWhitelisted(t *testing.T) {
+	want := `{"text":"Please log in at https://login.domain.com before joining"}`
+	client, br := dialMinecraft(t, "https://login.domain.com")
+	client.Write(handshake("play.domain.com", 2))
+	if reason := readString(t, br); reason != want {
+		t.Errorf("Kick: got %v, want %v", reason, want)
+	}
+
+	client, br = dialMinecraft(t, "https://login.domain.com")
+	client.Write(handshake("play.domain.com", 1))
+	client.Write(packet(0x00))
+	if status := readString(t, br); !strings.Contains(status, `"description":`+want) {
+		t.Errorf("Status: got %v, want the login url as motd", status)
+	}
+
+	//Without the webserver there is nothing to point them to
+	client, br = dialMinecraft(t, "")
+	client.Write(handshake("play.domain.com", 2))
+	if reason := readString(t, br); reason != `{"text":"You are not whitelisted on this server"}` {
+		t.Errorf("Kick without a login url: got %v", reason)
+	}
+}
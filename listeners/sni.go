@@ -0,0 +1,222 @@
+package listeners
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/proxy"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errHelloPeeked = errors.New("client hello peeked")
+
+// ListenSNI forwards raw tls streams by the server name in the ClientHello, without terminating tls.
+// If https web routes share the port, the names we dont passthrough get handed to our own https server.
+func ListenSNI(parentCtx context.Context, tlsConf *config.TLSConfig, fw *config.FirewallConfig, store access.Store, srv *config.ParsedProxy, webConf *config.WebserverConfig, wg *sync.WaitGroup) error {
+	defer wg.Done()
+
+	ctx, cancel := context.WithCancel(parentCtx)
+	defer cancel()
+
+	listener, err := listen(fw, "tcp", srv.Port)
+	if err != nil {
+		log.Printf("SNI: %v failed to start: %v", srv.Port, err)
+		return err
+	}
+	defer listener.Close()
+
+	routes := make(map[string]*config.ProxyConfig)
+	webHosts := make(map[string]bool)
+	var fallback *config.ProxyConfig
+	for _, route := range srv.LinkedProxies {
+		switch {
+		case route.Protocol == "web":
+			host, _, _ := strings.Cut(route.ListenUrl, "/") //web routes have their path glued on
+			webHosts[strings.ToLower(host)] = true
+		case route.ListenUrl == "":
+			fallback = route
+		default:
+			routes[strings.ToLower(route.ListenUrl)] = route
+		}
+	}
+	log.Printf("SNI: %v server started with %v passthrough routes", srv.Port, len(routes))
+
+	var webWG sync.WaitGroup
+	var webListener *connListener
+	var server *http.Server
+	if srv.TLS {
+		webListener = newConnListener(listener.Addr())
+		server = newWebTLSServer(ctx, fw, srv, webConf)
+
+		webWG.Add(1)
+		go func() {
+			defer webWG.Done()
+
+			log.Printf("SNI: %v https server for web routes started", srv.Port)
+			err := server.ServeTLS(webListener, tlsConf.Cert, tlsConf.Key)
+			if err != nil && err != http.ErrServerClosed {
+				log.Printf("SNI: ServeTLS error: %v", err)
+				cancel()
+			}
+		}()
+	}
+
+	var listenWG sync.WaitGroup
+
+	listenWG.Add(1)
+	go func() {
+		defer listenWG.Done()
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if ne, ok := err.(*net.OpError); ok {
+					if ne.Op == "accept" && strings.Contains(ne.Error(), "use of closed network connection") {
+						log.Printf("SNI: %v accept loop exiting, listener has been closed", srv.Port)
+						return
+					}
+				}
+				log.Printf("SNI: %v failed to accept connection: %v", srv.Port, err)
+				continue
+			}
+
+			go handleSNIConn(ctx, conn, fw, store, routes, webHosts, fallback, webListener)
+		}
+	}()
+
+	<-ctx.Done()
+	stopServer(listener)
+	listenWG.Wait()
+	if server != nil {
+		listenForExit(ctx, server, &webWG)
+	}
+	return nil
+}
+
+func handleSNIConn(ctx context.Context, conn net.Conn, fw *config.FirewallConfig, store access.Store, routes map[string]*config.ProxyConfig, webHosts map[string]bool, fallback *config.ProxyConfig, webListener *connListener) {
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		log.Printf("SNI: Failed to parse client IP: %v", err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	var peeked bytes.Buffer
+	serverName, err := peekServerName(io.TeeReader(conn, &peeked))
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("SNI: Failed to read ClientHello from %v: %v", clientIP, err)
+		conn.Close()
+		return
+	}
+
+	//Replay the ClientHello so the target can do the handshake itself
+	clientConn := proxy.NewPrefixConn(conn, io.MultiReader(&peeked, conn))
+
+	route, ok := routes[serverName]
+	if !ok {
+		if webListener != nil && (webHosts[serverName] || fallback == nil) {
+			//Firewall is done by the router for web routes
+			if err := webListener.hand(clientConn); err != nil {
+				conn.Close()
+			}
+			return
+		}
+		route = fallback
+	}
+	if route == nil {
+		log.Printf("SNI: %v requested unknown server name %q", clientIP, serverName)
+		conn.Close()
+		return
+	}
+
+	if !firewallAllows(fw, store, clientIP, route, clientConn) {
+		log.Printf("SNI: Blocked connection from %v to %q", clientIP, serverName)
+		conn.Close()
+		return
+	}
+
+	log.Printf("SNI: Starting passthrough for %v (%q) to dest %v", clientIP, serverName, route.TargetAddr)
+	proxy.HandleProxyConnection(ctx, store, clientConn, route, clientIP)
+}
+
+// peekServerName lets crypto/tls parse the ClientHello for us and aborts the handshake right after
+func peekServerName(r io.Reader) (string, error) {
+	var serverName string
+	err := tls.Server(readOnlyConn{r: r}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+			return nil, errHelloPeeked
+		},
+	}).Handshake()
+	if !errors.Is(err, errHelloPeeked) {
+		return "", err
+	}
+	return serverName, nil
+}
+
+// readOnlyConn is only used for peeking, tls wont get to write anything since we abort before that
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c readOnlyConn) Close() error                       { return nil }
+func (c readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// connListener is a net.Listener fed by hand, used to pass conns we already accepted to a http.Server
+type connListener struct {
+	addr   net.Addr
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newConnListener(addr net.Addr) *connListener {
+	return &connListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *connListener) hand(conn net.Conn) error {
+	select {
+	case l.conns <- conn:
+		return nil
+	case <-l.closed:
+		return net.ErrClosed
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.addr
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"mazarin/config"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tryLogin posts a login from a client that already went away, failed logins then skip their growing delay
+func tryLogin(name, key string) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequestWithContext(ctx, "POST", "/auth", strings.NewReader(`{"username":"`+name+`","key":"`+key+`"}`))
+	r.RemoteAddr = "192.0.2.120:5000"
+	w := httptest.NewRecorder()
+	webserver.AuthHandler(w, r)
+	return w.Code
+}
+
+// lockout returns the failed logins of name, ok is false when it has none
+func lockout(name string) (webserver.LockoutInfo, bool) {
+	for _, info := range webserver.Lockouts() {
+		if info.Username == name {
+			return info, true
+		}
+	}
+	return webserver.LockoutInfo{}, false
+}
+
+// This test checks that max_attempts failures lock the account, and that the lock holds even for the right key
+func TestLockoutAfterMaxAttempts(t *testing.T) {
+	hash, _ := webserver.HashKey("dave_password_1")
+	testWebserver(t, config.WebserverConfig{Lockout: config.LockoutConfig{MaxAttempts: 3, LockMinutes: 1}},
+		webserver.User{Name: "dave", Hash: hash})
+
+	for i := range 3 {
+		if code := tryLogin("dave", "wrong_password_1"); code != http.StatusUnauthorized {
+			t.Fatalf("Failure %v: got %v, want 401", i+1, code)
+		}
+	}
+	if code := tryLogin("dave", "dave_password_1"); code != http.StatusTooManyRequests {
+		t.Fatalf("Right key while locked: got %v, want 429", code)
+	}
+	info, _ := lockout("dave")
+	if left := time.Until(info.LockedUntil); info.Locks != 1 || left <= 0 || left > time.Minute {
+		t.Errorf("Lock: got %+v, want one lock of lock_minutes", info)
+	}
+}
+
+// This test checks that a successful login clears the failures, and that the admin api lifts a lock
+func TestLockoutClear(t *testing.T) {
+	adminHash, _ := webserver.HashKey("admin_password_1")
+	erinHash, _ := webserver.HashKey("erin_password_1")
+	testWebserver(t, config.WebserverConfig{Lockout: config.LockoutConfig{MaxAttempts: 2}},
+		webserver.User{Name: "admin", Hash: adminHash, Admin: true},
+		webserver.User{Name: "erin", Hash: erinHash},
+	)
+	admin := loginCookie(t, "admin", "admin_password_1", "192.0.2.121")
+
+	tryLogin("erin", "wrong_password_1")
+	if info, ok := lockout("erin"); !ok || info.Failures != 1 {
+		t.Fatalf("After one failure: got %+v %v, want 1 failure", info, ok)
+	}
+	if code := tryLogin("erin", "erin_password_1"); code != http.StatusOK {
+		t.Fatalf("Right key: got %v, want 200", code)
+	}
+	if info, ok := lockout("erin"); ok {
+		t.Errorf("The login left the failures behind: %+v", info)
+	}
+
+	tryLogin("erin", "wrong_password_1")
+	tryLogin("erin", "wrong_password_1")
+	if code := tryLogin("erin", "erin_password_1"); code != http.StatusTooManyRequests {
+		t.Fatalf("Right key while locked: got %v, want 429", code)
+	}
+	unlock := func() int {
+		r := httptest.NewRequest("DELETE", "/admin/api/lockouts/erin", nil)
+		r.AddCookie(admin)
+		w := httptest.NewRecorder()
+		webserver.AdminHandler(w, r)
+		return w.Code
+	}
+	if code := unlock(); code != http.StatusOK {
+		t.Fatalf("Unlock: got %v, want 200", code)
+	}
+	if code := unlock(); code != http.StatusNotFound {
+		t.Errorf("Second unlock: got %v, want 404", code)
+	}
+	if code := tryLogin("erin", "erin_password_1"); code != http.StatusOK {
+		t.Errorf("Right key after the unlock: got %v, want 200", code)
+	}
+}
+
+// This test checks that unknown names get counted and locked like real ones, and still pay for a hash on every try
+func TestLockoutUnknownUser(t *testing.T) {
+	hash, _ := webserver.HashKey("frank_password_1")
+	testWebserver(t, config.WebserverConfig{Lockout: config.LockoutConfig{MaxAttempts: 2}}, webserver.User{Name: "frank", Hash: hash})
+
+	timed := func(name string) (int, time.Duration) {
+		start := time.Now()
+		code := tryLogin(name, "wrong_password_1")
+		return code, time.Since(start)
+	}
+	_, known := timed("frank")
+	code, unknown := timed("ghost")
+	if code != http.StatusUnauthorized {
+		t.Errorf("Unknown name: got %v, want the same 401 as a wrong key", code)
+	}
+	//A skipped hash would answer in microseconds instead of the milliseconds a bcrypt check takes
+	if unknown < known/3 {
+		t.Errorf("Unknown name took %v, a wrong key %v, want both to hash", unknown, known)
+	}
+
+	if code, _ := timed("ghost"); code != http.StatusUnauthorized {
+		t.Errorf("Second failure: got %v, want 401", code)
+	}
+	if code := tryLogin("ghost", "wrong_password_1"); code != http.StatusTooManyRequests {
+		t.Errorf("Unknown name after max_attempts: got %v, want the same 429 as a real account", code)
+	}
+}
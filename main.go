@@ -6,9 +6,17 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"mazarin/access"
+	"mazarin/client"
+	"mazarin/cluster"
 	"mazarin/config"
+	"mazarin/control"
+	"mazarin/database"
+	"mazarin/firewall"
 	"mazarin/listeners"
 	"mazarin/router"
+	"mazarin/sessions"
+	"mazarin/throttle"
 	"mazarin/webserver"
 	"os"
 	"os/signal"
@@ -17,8 +25,26 @@ import (
 	"time"
 )
 
+const version = "v0.0.8"
+
 func main() {
-	fmt.Println("v0.0.8")
+	fmt.Println(version)
+	started := time.Now()
+
+	//Subcommands, `mazarin client` keeps a login alive without a browser, the others talk to a running mazarin over the control socket
+	if len(os.Args) > 1 {
+		run := control.Commands[os.Args[1]]
+		if os.Args[1] == "client" {
+			run = client.Run
+		}
+		if run != nil {
+			if err := run(os.Args[2:]); err != nil {
+				fmt.Printf("%v error: %v\n", os.Args[1], err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
 
 	//cmd flag, Generate hashed key and exit.
 	shouldExit := parseArgs()
@@ -45,8 +71,23 @@ func main() {
 		defer cfg.Logging.Close()
 	}
 
+	throttle.Init(&cfg.Limits)
+
+	if err := firewall.InitTrustedProxies(cfg.Firewall.TrustedProxies, cfg.Firewall.ClientIPHeader); err != nil {
+		fmt.Println("Invalid trusted_proxies or client_ip_header in config.json:", err)
+		return
+	}
+
+	if err := firewall.InitPermissions(cfg.Groups); err != nil {
+		fmt.Println("Invalid permission_groups in config.json:", err)
+		return
+	}
+
 	var wg sync.WaitGroup
 
+	//Whitelist and bans, everything that checks or changes them gets this one
+	var store access.Store = access.NewMemoryStore()
+
 	if cfg.Webserver.EnableWebServer {
 		webRoute := config.ProxyConfig{
 			ListenUrl: cfg.Webserver.ListenURL,
@@ -56,14 +97,78 @@ func main() {
 		}
 		cfg.Proxy = append(cfg.Proxy, webRoute)
 
-		webserver.Init(webserver.LoadKeys(cfg.Webserver.KeysDir))
+		if err := webserver.SetHashPolicy(cfg.Webserver.Hashing); err != nil {
+			fmt.Println("Invalid hashing in config.json:", err)
+			return
+		}
+		if cfg.Webserver.EnableDB {
+			if err := database.InitDb(&cfg.Webserver); err != nil {
+				log.Println("DataBase init error: ", err)
+				return
+			}
+			defer database.Close()
+		}
+
+		//Grants and users live in the db too when it is on, so they survive a restart without the snapshot
+		if cfg.Webserver.EnableDB {
+			dbStore, err := access.NewSQLiteStore(database.GetDB())
+			if err != nil {
+				log.Println("Access store init error: ", err)
+				return
+			}
+			store = dbStore
+		}
+
+		webserver.Init(webserver.LoadUsers(&cfg.Webserver), &cfg.Webserver, store)
+		go webserver.WatchAccess(ctx)
+
+		//Sessions and whitelisted ips from before the restart
+		webserver.RestoreState()
+		wg.Add(1)
+		go webserver.PersistState(ctx, &wg)
+		go sessions.RunCleanup(ctx, time.Minute)
 
-		// Preparations for the oncoming db rework
-		//	if err := database.InitDb(&cfg.Webserver); err != nil {
-		//		log.Println("DataBase init error: ", err)
-		//		return
-		//	}
-		//	defer database.GetDB().Close()
+		//Reload keys.json on SIGHUP or when it changes on disk
+		go webserver.WatchKeys(ctx)
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-hup:
+					log.Println("SIGHUP received, reloading keys.json")
+					webserver.ReloadKeys()
+				}
+			}
+		}()
+	}
+
+	if err := firewall.LoadStatic(store, cfg.Firewall.StaticWhitelist); err != nil {
+		fmt.Println("Invalid static_whitelist in config.json:", err)
+		return
+	}
+
+	//Expired whitelist entries and bans, their conns get closed
+	go firewall.RunJanitor(ctx, store, 10*time.Second)
+
+	//Share the whitelist and bans with the other nodes
+	var node *cluster.Node
+	if cfg.Cluster.Enable {
+		node, err = cluster.New(cfg.Cluster, store)
+		if err != nil {
+			fmt.Println("Invalid cluster in config.json:", err)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := node.Run(ctx); err != nil {
+				log.Println("Cluster failed starting up, starting a shutdown:", err)
+				stop()
+			}
+		}()
 	}
 	//-----
 
@@ -73,6 +178,10 @@ func main() {
 		log.Println(err)
 		return
 	}
+	//The routes have to be there before the first conn comes in
+	if len(toBeRouted) > 0 {
+		router.InitRouter(toBeRouted, cfg.Webserver.LoginURL(&cfg.TLS), store)
+	}
 	for _, srv := range listenerMap {
 		switch srv.Protocol {
 		case "web":
@@ -86,18 +195,63 @@ func main() {
 		case "tcp/udp":
 			wg.Add(1)
 			go func() {
-				if err := listeners.ListenProxy(ctx, &cfg.Firewall, srv.LinkedProxies[0], &wg); err != nil {
+				if err := listeners.ListenProxy(ctx, &cfg.Firewall, store, srv.LinkedProxies[0], &wg); err != nil {
 					log.Println("Proxy server failed starting up, starting a shutdown")
 					stop() //Signal with the main ctx to start a clean shutdown
 					return
 				}
 			}()
+
+		case "minecraft":
+			wg.Add(1)
+			go func() {
+				if err := listeners.ListenMinecraft(ctx, &cfg.TLS, &cfg.Firewall, store, &srv, &cfg.Webserver, &wg); err != nil {
+					log.Println("Minecraft server failed starting up, starting a shutdown")
+					stop()
+					return
+				}
+			}()
+
+		case "sni":
+			wg.Add(1)
+			go func() {
+				if err := listeners.ListenSNI(ctx, &cfg.TLS, &cfg.Firewall, store, &srv, &cfg.Webserver, &wg); err != nil {
+					log.Println("SNI server failed starting up, starting a shutdown")
+					stop()
+					return
+				}
+			}()
 		}
 	}
 
-	if len(toBeRouted) > 0 {
-		router.InitRouter(toBeRouted)
+	var allRoutes []*config.ProxyConfig
+	for _, srv := range listenerMap {
+		allRoutes = append(allRoutes, srv.LinkedProxies...)
 	}
+	if cfg.Webserver.EnableWebServer {
+		go webserver.WatchHealth(ctx, allRoutes)
+	}
+
+	if cfg.Control.Enable {
+		instance := control.Instance{
+			Version:   version,
+			Started:   started,
+			Routes:    allRoutes,
+			TLS:       &cfg.TLS,
+			Webserver: cfg.Webserver.EnableWebServer,
+			Cluster:   node,
+			Store:     store,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := control.Serve(ctx, control.SocketPath(cfg.Control), instance); err != nil {
+				log.Println("Control socket failed starting up, starting a shutdown:", err)
+				stop()
+			}
+		}()
+	}
+
 	//-----
 
 	//Clean shutdown portion
@@ -0,0 +1,209 @@
+package minecraft
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Protocol docs: https://minecraft.wiki/w/Java_Edition_protocol
+// We only need the handshake and enough of the status/login state to answer clients ourselves.
+
+const (
+	StateStatus   = 1
+	StateLogin    = 2
+	StateTransfer = 3
+
+	maxPacketLen   = 1 << 16
+	maxHostnameLen = 255
+)
+
+var ErrLegacyPing = errors.New("legacy (pre 1.7) server list ping is not supported")
+
+type Handshake struct {
+	ProtocolVersion int32
+	ServerAddress   string //raw, as the client sent it
+	ServerPort      uint16
+	NextState       int32
+}
+
+// Hostname returns the address the client typed, without forge/mod markers or a trailing dot
+func (h Handshake) Hostname() string {
+	host, _, _ := strings.Cut(h.ServerAddress, "\x00") //Forge appends \x00FML\x00
+	host = strings.TrimSuffix(host, ".")
+	return strings.ToLower(host)
+}
+
+// ReadHandshake reads the first packet of a connection.
+// It also returns the raw bytes read so the packet can be replayed to the backend.
+func ReadHandshake(r *bufio.Reader) (Handshake, []byte, error) {
+	var hs Handshake
+
+	first, err := r.Peek(1)
+	if err != nil {
+		return hs, nil, err
+	}
+	if first[0] == 0xFE {
+		return hs, nil, ErrLegacyPing
+	}
+
+	packetID, data, raw, err := readPacket(r)
+	if err != nil {
+		return hs, nil, err
+	}
+	if packetID != 0x00 {
+		return hs, nil, errors.New("first packet is not a handshake")
+	}
+
+	pr := bytes.NewReader(data)
+	if hs.ProtocolVersion, err = readVarInt(pr); err != nil {
+		return hs, nil, err
+	}
+	if hs.ServerAddress, err = readString(pr, maxHostnameLen*4); err != nil { //a few extra bytes for forge markers
+		return hs, nil, err
+	}
+	if err = binary.Read(pr, binary.BigEndian, &hs.ServerPort); err != nil {
+		return hs, nil, err
+	}
+	if hs.NextState, err = readVarInt(pr); err != nil {
+		return hs, nil, err
+	}
+
+	return hs, raw, nil
+}
+
+// HandleStatus answers a server list ping with our own motd, it reads the status request and the ping itself
+func HandleStatus(rw io.ReadWriter, br *bufio.Reader, protocolVersion int32, motd string) error {
+	packetID, _, _, err := readPacket(br)
+	if err != nil {
+		return err
+	}
+	if packetID != 0x00 {
+		return errors.New("expected a status request")
+	}
+
+	status := map[string]any{
+		"version":     map[string]any{"name": "Mazarin", "protocol": protocolVersion},
+		"players":     map[string]any{"max": 0, "online": 0},
+		"description": map[string]string{"text": motd},
+	}
+	statusJSON, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	var payload bytes.Buffer
+	writeString(&payload, string(statusJSON))
+	if err := writePacket(rw, 0x00, payload.Bytes()); err != nil {
+		return err
+	}
+
+	//The client follows up with a ping (long payload), echo it so the ping bar shows up
+	packetID, data, _, err := readPacket(br)
+	if err != nil {
+		return nil //client is allowed to just close here
+	}
+	if packetID != 0x01 {
+		return nil
+	}
+	return writePacket(rw, 0x01, data)
+}
+
+// Disconnect kicks a client that is in the login state with a message
+func Disconnect(w io.Writer, message string) error {
+	reason, err := json.Marshal(map[string]string{"text": message})
+	if err != nil {
+		return err
+	}
+	var payload bytes.Buffer
+	writeString(&payload, string(reason))
+	return writePacket(w, 0x00, payload.Bytes())
+}
+
+// --- Packet helpers
+
+func readPacket(r *bufio.Reader) (int32, []byte, []byte, error) {
+	var raw bytes.Buffer
+	length, err := readVarInt(io.TeeReader(r, &raw))
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if length <= 0 || length > maxPacketLen {
+		return 0, nil, nil, errors.New("invalid packet length")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, nil, err
+	}
+	raw.Write(body)
+
+	br := bytes.NewReader(body)
+	packetID, err := readVarInt(br)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	return packetID, body[len(body)-br.Len():], raw.Bytes(), nil
+}
+
+func writePacket(w io.Writer, packetID int32, data []byte) error {
+	var body bytes.Buffer
+	writeVarInt(&body, packetID)
+	body.Write(data)
+
+	var packet bytes.Buffer
+	writeVarInt(&packet, int32(body.Len()))
+	packet.Write(body.Bytes())
+	_, err := w.Write(packet.Bytes())
+	return err
+}
+
+func readVarInt(r io.Reader) (int32, error) {
+	var value uint32
+	buf := make([]byte, 1)
+	for i := 0; i < 5; i++ {
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return 0, err
+		}
+		value |= uint32(buf[0]&0x7F) << (7 * i)
+		if buf[0]&0x80 == 0 {
+			return int32(value), nil
+		}
+	}
+	return 0, errors.New("varint is too big")
+}
+
+func writeVarInt(w *bytes.Buffer, value int32) {
+	v := uint32(value)
+	for {
+		if v&^0x7F == 0 {
+			w.WriteByte(byte(v))
+			return
+		}
+		w.WriteByte(byte(v&0x7F) | 0x80)
+		v >>= 7
+	}
+}
+
+func readString(r io.Reader, maxLen int) (string, error) {
+	length, err := readVarInt(r)
+	if err != nil {
+		return "", err
+	}
+	if length < 0 || int(length) > maxLen {
+		return "", errors.New("string is too long")
+	}
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func writeString(w *bytes.Buffer, s string) {
+	writeVarInt(w, int32(len(s)))
+	w.WriteString(s)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"mazarin/minecraft"
+	"testing"
+)
+
+// Handshake of a 1.21 client (protocol 767) connecting to play.domain.com:25565 with the login intent
+var testHandshake = []byte{
+	0x16, 0x00, 0xff, 0x05, 0x0f, 'p', 'l', 'a', 'y', '.', 'd', 'o', 'm', 'a', 'i', 'n', '.', 'c', 'o', 'm',
+	0x63, 0xdd, 0x02,
+}
+
+// This test checks that we read the hostname out of the handshake and that we give back the exact bytes for replaying
+func TestReadHandshake(t *testing.T) {
+	input := append(append([]byte{}, testHandshake...), 0x01, 0x02) //bytes after the handshake must stay in the reader
+	br := bufio.NewReader(bytes.NewReader(input))
+
+	hs, raw, err := minecraft.ReadHandshake(br)
+	if err != nil {
+		t.Fatalf("Failed to read handshake: %v", err)
+	}
+	if hs.ProtocolVersion != 767 {
+		t.Errorf("ProtocolVersion: got %v, want 767", hs.ProtocolVersion)
+	}
+	if hs.Hostname() != "play.domain.com" {
+		t.Errorf("Hostname: got %v, want play.domain.com", hs.Hostname())
+	}
+	if hs.ServerPort != 25565 {
+		t.Errorf("ServerPort: got %v, want 25565", hs.ServerPort)
+	}
+	if hs.NextState != minecraft.StateLogin {
+		t.Errorf("NextState: got %v, want %v", hs.NextState, minecraft.StateLogin)
+	}
+	if !bytes.Equal(raw, testHandshake) {
+		t.Errorf("Raw: got %x, want %x", raw, testHandshake)
+	}
+	if br.Buffered() != 2 {
+		t.Errorf("Reader: got %v bytes left, want 2", br.Buffered())
+	}
+
+	//Forge clients add a marker to the address
+	forge := minecraft.Handshake{ServerAddress: "Play.Domain.com.\x00FML3\x00"}
+	if forge.Hostname() != "play.domain.com" {
+		t.Errorf("Forge hostname: got %v, want play.domain.com", forge.Hostname())
+	}
+}
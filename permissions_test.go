@@ -0,0 +1,169 @@
+package main
+
+import (
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/firewall"
+	"net"
+	"testing"
+	"time"
+)
+
+// This test checks that permission groups match routes by name, port and host
+func TestGroupAllows(t *testing.T) {
+	err := firewall.InitPermissions([]config.PermissionGroup{
+		{ID: 1, Name: "friends", Routes: []string{"survival", "25580", "vault.domain.com"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		group int
+		route config.ProxyConfig
+		want  bool
+	}{
+		{0, config.ProxyConfig{Port: ":22"}, true},
+		{1, config.ProxyConfig{Name: "survival", Port: ":25565"}, true},
+		{1, config.ProxyConfig{Port: ":25580", Protocol: "tcp"}, true},
+		{1, config.ProxyConfig{ListenUrl: "vault.domain.com/admin", Port: ":443"}, true},
+		{1, config.ProxyConfig{ListenUrl: "proxmox.domain.com", Port: ":443"}, false},
+		{1, config.ProxyConfig{ListenUrl: "auth.domain.com", Type: "func"}, true},
+		{2, config.ProxyConfig{Name: "survival"}, false},
+	}
+	for _, test := range tests {
+		if got := firewall.GroupAllows(test.group, &test.route); got != test.want {
+			t.Errorf("GroupAllows(%v, %+v) = %v, want %v", test.group, test.route, got, test.want)
+		}
+	}
+
+	if err := firewall.InitPermissions([]config.PermissionGroup{{ID: 1}, {ID: 1}}); err == nil {
+		t.Error("expected an error for a duplicate group id")
+	}
+}
+
+// This test checks that two users behind the same ip both keep their routes, and that one leaving doesnt take the other's away
+func TestPermissionsSharedIP(t *testing.T) {
+	err := firewall.InitPermissions([]config.PermissionGroup{
+		{ID: 1, Name: "survival", Routes: []string{"survival"}},
+		{ID: 2, Name: "creative", Routes: []string{"creative"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const ip = "198.51.100.9"
+	store := access.NewMemoryStore()
+	t.Cleanup(func() { firewall.InitPermissions(nil) })
+	survival := &config.ProxyConfig{Name: "survival", Port: ":25565"}
+	creative := &config.ProxyConfig{Name: "creative", Port: ":25566"}
+	vault := &config.ProxyConfig{ListenUrl: "vault.domain.com", Port: ":443"}
+
+	firewall.WhitelistIP(store, ip, "alice", 1)
+	firewall.WhitelistIP(store, ip, "bob", 2)
+
+	for _, test := range []struct {
+		route    *config.ProxyConfig
+		wantUser string
+		want     bool
+	}{
+		{survival, "alice", true},
+		{creative, "bob", true},
+		{vault, "", false},
+	} {
+		user, ok := firewall.LoginForRoute(store, ip, test.route)
+		if user != test.wantUser || ok != test.want {
+			t.Errorf("LoginForRoute(%v) = %v, %v, want %v, %v", test.route.Name+test.route.ListenUrl, user, ok, test.wantUser, test.want)
+		}
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	if !firewall.CheckWhitelistAddConn(store, ip, survival, server) {
+		t.Fatal("alice's route was refused on the shared ip")
+	}
+	defer firewall.ReleaseConn(store, ip, server)
+
+	//Bob leaving only takes the routes of bob away, alice's conn stays up
+	firewall.RemoveLogin(store, ip, "bob")
+	if _, ok := firewall.LoginForRoute(store, ip, creative); ok {
+		t.Error("bob's route is still allowed after bob left")
+	}
+	if _, ok := firewall.LoginForRoute(store, ip, survival); !ok {
+		t.Error("alice lost the survival route when bob left")
+	}
+	go client.Write([]byte{1})
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		t.Errorf("alice's conn got closed when bob left: %v", err)
+	}
+
+	//The last user leaving closes the ip
+	firewall.RevokeUser(store, "alice")
+	if firewall.CheckWhitelist(store, ip) {
+		t.Error("ip is still whitelisted without users")
+	}
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := server.Read(make([]byte, 1)); err == nil {
+		t.Error("alice's conn is still open after alice got revoked")
+	}
+}
+
+// This test checks that a static entry survives a login and logout on its ip, and that a login survives a manual entry on its ip
+func TestEntriesAndLoginsShareIP(t *testing.T) {
+	err := firewall.InitPermissions([]config.PermissionGroup{
+		{ID: 1, Name: "survival", Routes: []string{"survival"}},
+		{ID: 2, Name: "creative", Routes: []string{"creative"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { firewall.InitPermissions(nil) })
+	store := access.NewMemoryStore()
+	survival := &config.ProxyConfig{Name: "survival", Port: ":25565"}
+	creative := &config.ProxyConfig{Name: "creative", Port: ":25566"}
+
+	const office = "198.51.100.20"
+	if err := firewall.LoadStatic(store, []config.StaticWhitelistEntry{{Target: office, Note: "office", GroupID: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	firewall.WhitelistIP(store, office, "alice", 2)
+	if _, ok := firewall.LoginForRoute(store, office, survival); !ok {
+		t.Error("The static entry lost its route when alice logged in")
+	}
+	if user, ok := firewall.LoginForRoute(store, office, creative); !ok || user != "alice" {
+		t.Errorf("Route of alice on the static ip: got %v %v, want alice", user, ok)
+	}
+	firewall.RemoveLogin(store, office, "alice")
+	g, ok := store.Lookup(office)
+	if !ok || g.Source != access.SourceConfig || g.Note != "office" || g.GroupID != 1 || len(g.Logins) != 0 {
+		t.Fatalf("Static entry after the logout of alice: got %+v %v, want it unchanged", g, ok)
+	}
+	if _, ok := firewall.LoginForRoute(store, office, creative); ok {
+		t.Error("The route of alice is still allowed after the logout")
+	}
+
+	//A config reload that drops the entry leaves the logins on it
+	firewall.WhitelistIP(store, office, "alice", 2)
+	if err := firewall.LoadStatic(store, nil); err != nil {
+		t.Fatal(err)
+	}
+	if g, _ := store.Lookup(office); g.Source != "" || !firewall.HasLogin(store, office, "alice") {
+		t.Errorf("After the entry left the config: got %+v, want only the login of alice", g)
+	}
+
+	const home = "198.51.100.21"
+	firewall.WhitelistIP(store, home, "bob", 2)
+	if _, err := firewall.AddManual(store, home, time.Hour, "support", 1); err != nil {
+		t.Fatal(err)
+	}
+	if !firewall.HasLogin(store, home, "bob") {
+		t.Fatal("AddManual dropped the login of bob")
+	}
+	if _, ok := firewall.LoginForRoute(store, home, survival); !ok {
+		t.Error("The manual entry does not allow its route")
+	}
+	firewall.RemoveLogin(store, home, "bob")
+	if g, ok := store.Lookup(home); !ok || g.Source != access.SourceManual || g.Note != "support" || time.Until(g.Expires) < 59*time.Minute {
+		t.Errorf("Manual entry after the logout of bob: got %+v %v, want it unchanged", g, ok)
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"io"
+	"net"
+)
+
+// PrefixConn is used by listeners that have to peek at the first bytes of a conn (handshakes, hellos) before picking a target.
+// Reads are served from r first, so the target still receives everything the client sent.
+type PrefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func NewPrefixConn(conn net.Conn, r io.Reader) *PrefixConn {
+	return &PrefixConn{Conn: conn, r: r}
+}
+
+func (c *PrefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the conn that is wrapped, used to half close it
+func (c *PrefixConn) NetConn() net.Conn {
+	return c.Conn
+}
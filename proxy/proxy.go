@@ -5,8 +5,12 @@ import (
 	"crypto/tls"
 	"io"
 	"log"
+	"mazarin/access"
 	"mazarin/config"
-	"mazarin/state"
+	"mazarin/firewall"
+	"mazarin/proxyproto"
+	"mazarin/sessions"
+	"mazarin/throttle"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -17,37 +21,39 @@ import (
 	"sync"
 )
 
-func HandleProxyConnection(ctx context.Context, clientConn net.Conn, targetAddr, clientIP string, protocol string) {
-	targetConn, err := net.Dial(protocol, targetAddr)
+// HandleProxyConnection pipes the conn to the target, store is where the listener tracked the conn
+func HandleProxyConnection(ctx context.Context, store access.Store, clientConn net.Conn, proxyConf *config.ProxyConfig, clientIP string) {
+	dialer := net.Dialer{Timeout: seconds(proxyConf.DialTimeout, defaultDialTimeout)}
+	targetConn, err := dialer.DialContext(ctx, dialNetwork(proxyConf.Protocol), proxyConf.TargetAddr)
 	if err != nil {
 		log.Println("PROXY: Failed to connect to target:", err)
 		clientConn.Close()
 		return
 	}
 
+	//Let the target know who the real client is
+	if proxyConf.SendProxyProtocol != "" {
+		if err := proxyproto.WriteHeader(targetConn, proxyConf.SendProxyProtocol, clientConn.RemoteAddr(), clientConn.LocalAddr()); err != nil {
+			log.Println("PROXY: Failed to send PROXY protocol header:", err)
+			clientConn.Close()
+			targetConn.Close()
+			return
+		}
+	}
+
 	defer func() {
 		// .Close() redundancy should be fine bcs its a no-op
 		clientConn.Close()
 		targetConn.Close()
 
-		state.Mutex.Lock()
-		defer state.Mutex.Unlock()
-		conns := state.ActiveConns[clientIP]
-		for i, c := range conns {
-			if c == clientConn {
-				state.ActiveConns[clientIP] = append(conns[:i], conns[i+1:]...)
-				break
-			}
-		}
-		if len(state.ActiveConns[clientIP]) == 0 {
-			delete(state.ActiveConns, clientIP)
-		}
+		firewall.ReleaseConn(store, clientIP, clientConn)
 		log.Printf("PROXY: connection closed for %s", clientIP)
 	}()
 
-	// Create a context that will be canceled when either the parent context is canceled or when one of the copy operations completes
+	// Create a context that will be canceled when either the parent context is canceled, a copy fails or a timeout hits
 	copyCtx, cancelCopy := context.WithCancel(ctx)
 	defer cancelCopy()
+	activity := watchTimeouts(copyCtx, cancelCopy, proxyConf, clientIP)
 
 	//this goroutine waits for ctx shutdown from the main loop or this one, for that reason its not in the waitgroup
 	go func() {
@@ -56,23 +62,40 @@ func HandleProxyConnection(ctx context.Context, clientConn net.Conn, targetAddr,
 		targetConn.Close()
 	}()
 
+	//Both directions share the same buckets, so the limit is for up+down combined
+	user, _ := firewall.LoginForRoute(store, clientIP, proxyConf)
+	limiters := throttle.For(proxyConf, user)
+
+	//A clean EOF only closes that direction, the other side might still be sending its answer
+	pipe := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, throttle.NewReader(copyCtx, activity.reader(src), limiters))
+		if err != nil || !closeWrite(dst) {
+			cancelCopy()
+		}
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(1)
+	wg.Add(2)
 	go func() {
 		defer wg.Done()
-		defer cancelCopy()
-		io.Copy(targetConn, clientConn)
+		pipe(targetConn, clientConn)
 	}()
-	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		defer cancelCopy()
-		io.Copy(clientConn, targetConn)
+		pipe(clientConn, targetConn)
 	}()
 
 	wg.Wait()
 }
 
+// Protocols like minecraft are routed by us but are still plain tcp towards the target
+func dialNetwork(protocol string) string {
+	if protocol == "udp" {
+		return "udp"
+	}
+	return "tcp"
+}
+
 func HandleHTTPProxy(w http.ResponseWriter, r *http.Request, template *config.ProxyConfig) {
 	if !strings.HasPrefix(template.TargetAddr, "http://") && !strings.HasPrefix(template.TargetAddr, "https://") {
 		if template.AllowInsecure {
@@ -102,6 +125,15 @@ func HandleHTTPProxy(w http.ResponseWriter, r *http.Request, template *config.Pr
 	//The Director will now call the old func and add our headers
 	originalDirector := proxy.Director
 	proxy.Director = func(req *http.Request) {
+		//Only pass on forwarding headers we can vouch for, the reverse proxy appends the peer to X-Forwarded-For after this
+		if !firewall.FromTrustedProxy(req) {
+			req.Header.Del("X-Forwarded-For")
+			req.Header.Del("Forwarded")
+			req.Header.Del("CF-Connecting-IP")
+			req.Header.Del(firewall.ClientIPHeader())
+		}
+		//The login cookie is valid on every subdomain, a target must not be able to replay it
+		stripCookie(req.Header, sessions.CookieName)
 		originalDirector(req)
 		req.Header.Set("X-Forwarded-Host", req.Host)
 		req.Header.Set("X-Origin-Host", target.Host)
@@ -112,15 +144,45 @@ func HandleHTTPProxy(w http.ResponseWriter, r *http.Request, template *config.Pr
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 	}
 
-	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	clientIP, err := firewall.ClientIP(r)
 	if err != nil {
 		log.Printf("HTTP PROXY: Failed to parse client IP: %v", err)
 		clientIP = "ERROR"
 	}
 	log.Printf("HTTP PROXY: Forwarding request from %v to %v%v", clientIP, target.Host, r.URL.Path)
 
-	// Serve the request
-	proxy.ServeHTTP(w, r)
+	//The router sets this header after checking the whitelist or session
+	limiters := throttle.For(template, r.Header.Get("X-Mazarin-User"))
+
+	// Serve the request, uploads and downloads take from the same buckets
+	r.Body = throttle.NewBody(r.Context(), r.Body, limiters)
+	proxy.ServeHTTP(throttle.NewResponseWriter(r.Context(), w, limiters), r)
+}
+
+// stripCookie removes one cookie from the Cookie headers and keeps the others as they were
+func stripCookie(header http.Header, name string) {
+	var kept []string
+	found := false
+	for _, value := range header.Values("Cookie") {
+		for _, part := range strings.Split(value, ";") {
+			part = strings.TrimSpace(part)
+			cookieName, _, _ := strings.Cut(part, "=")
+			if strings.TrimSpace(cookieName) == name {
+				found = true
+				continue
+			}
+			if part != "" {
+				kept = append(kept, part)
+			}
+		}
+	}
+	if !found {
+		return
+	}
+	header.Del("Cookie")
+	if len(kept) > 0 {
+		header.Set("Cookie", strings.Join(kept, "; "))
+	}
 }
 
 func HandleStaticServe(w http.ResponseWriter, r *http.Request, routeInfo *config.ProxyConfig) {
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"mazarin/config"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const defaultDialTimeout = 10 * time.Second
+
+func seconds(value int, fallback time.Duration) time.Duration {
+	if value <= 0 {
+		return fallback
+	}
+	return time.Duration(value) * time.Second
+}
+
+// activity is when the last byte went through in either direction
+type activity struct {
+	last atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.last.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.last.Load()))
+}
+
+func (a *activity) reader(r io.Reader) io.Reader {
+	return &activityReader{r: r, a: a}
+}
+
+type activityReader struct {
+	r io.Reader
+	a *activity
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.a.touch()
+	}
+	return n, err
+}
+
+// watchTimeouts cancels the conn once it sat idle or lived too long, both are off unless the route sets them
+func watchTimeouts(ctx context.Context, cancel context.CancelFunc, proxyConf *config.ProxyConfig, clientIP string) *activity {
+	a := &activity{}
+	a.touch()
+
+	idleTimeout := seconds(proxyConf.IdleTimeout, 0)
+	lifetime := seconds(proxyConf.MaxLifetime, 0)
+	if idleTimeout == 0 && lifetime == 0 {
+		return a
+	}
+
+	go func() {
+		var lifetimeC <-chan time.Time
+		if lifetime > 0 {
+			timer := time.NewTimer(lifetime)
+			defer timer.Stop()
+			lifetimeC = timer.C
+		}
+		var idleC <-chan time.Time
+		if idleTimeout > 0 {
+			ticker := time.NewTicker(min(idleTimeout/4, 5*time.Second))
+			defer ticker.Stop()
+			idleC = ticker.C
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-lifetimeC:
+				log.Printf("PROXY: Closing connection of %s, it reached the max lifetime of %v", clientIP, lifetime)
+				cancel()
+				return
+			case <-idleC:
+				if a.idle() >= idleTimeout {
+					log.Printf("PROXY: Closing connection of %s, it was idle for %v", clientIP, idleTimeout)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+	return a
+}
+
+// closeWrite sends a FIN to the peer, conns that can't do that (udp) return false and get closed fully instead.
+// Wrapped conns (peeked handshakes, PROXY headers) are unwrapped first
+func closeWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
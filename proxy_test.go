@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"io"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/proxy"
+	"mazarin/sessions"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// proxyPair starts a proxied conn towards target and returns the client side of it
+func proxyPair(t *testing.T, route *config.ProxyConfig) *net.TCPConn {
+	t.Helper()
+	front, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { front.Close() })
+
+	go func() {
+		conn, err := front.Accept()
+		if err != nil {
+			return
+		}
+		proxy.HandleProxyConnection(context.Background(), access.NewMemoryStore(), conn, route, "127.0.0.1")
+	}()
+
+	client, err := net.Dial("tcp", front.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client.(*net.TCPConn)
+}
+
+// This test checks that a client closing its write side still gets the answer the target sends after it
+func TestProxyHalfClose(t *testing.T) {
+	//The target only answers after the client is done sending, like a request/response protocol would
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		request, _ := io.ReadAll(conn)
+		conn.Write(append([]byte("got "), request...))
+	}()
+
+	client := proxyPair(t, &config.ProxyConfig{TargetAddr: target.Addr().String(), Protocol: "tcp"})
+	client.Write([]byte("ping"))
+	client.CloseWrite()
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answer, err := io.ReadAll(client)
+	if err != nil || string(answer) != "got ping" {
+		t.Fatalf("answer after half close = %q, %v", answer, err)
+	}
+}
+
+// This test checks that idle_timeout only closes a conn after that long without traffic, not while data flows
+func TestProxyIdleTimeout(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	client := proxyPair(t, &config.ProxyConfig{TargetAddr: target.Addr().String(), Protocol: "tcp", IdleTimeout: 1})
+
+	//Traffic keeps it open past the timeout
+	buf := make([]byte, 4)
+	for range 3 {
+		time.Sleep(500 * time.Millisecond)
+		client.Write([]byte("ping"))
+		if _, err := io.ReadFull(client, buf); err != nil {
+			t.Fatal("active conn got closed:", err)
+		}
+	}
+
+	//Silence closes it
+	start := time.Now()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(buf); err != io.EOF {
+		t.Fatal("idle conn was not closed:", err)
+	}
+	if waited := time.Since(start); waited < time.Second {
+		t.Fatalf("idle conn was closed after %v, before the timeout", waited)
+	}
+}
+
+// This test checks that the login cookie never reaches a web target while the other cookies do
+func TestProxyStripsSessionCookie(t *testing.T) {
+	var got string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("Cookie")
+	}))
+	defer target.Close()
+
+	r := httptest.NewRequest("GET", "http://app.domain.com/", nil)
+	r.Header.Add("Cookie", "theme=dark; "+sessions.CookieName+"=secret")
+	r.Header.Add("Cookie", "lang=en")
+	proxy.HandleHTTPProxy(httptest.NewRecorder(), r, &config.ProxyConfig{TargetAddr: target.URL})
+
+	if got != "theme=dark; lang=en" {
+		t.Errorf("Cookie: got %q, want %q", got, "theme=dark; lang=en")
+	}
+}
@@ -0,0 +1,80 @@
+package proxyproto
+
+import (
+	"bufio"
+	"log"
+	"mazarin/firewall"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long a trusted source gets to send its header
+const headerTimeout = 5 * time.Second
+
+// Listener only parses PROXY headers from trusted sources, anyone else could just spoof their address otherwise
+type Listener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func NewListener(listener net.Listener, trusted []*net.IPNet) *Listener {
+	return &Listener{Listener: listener, trusted: trusted}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok || !firewall.ContainsIP(l.trusted, tcpAddr.IP) {
+		return conn, nil
+	}
+	return &Conn{Conn: conn, br: bufio.NewReader(conn)}, nil
+}
+
+// Conn reads the header lazily on the first Read or RemoteAddr, so a slow source doesnt block the accept loop
+type Conn struct {
+	net.Conn
+	br     *bufio.Reader
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.remote, c.err = ReadHeader(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if ne, ok := c.err.(net.Error); ok && ne.Timeout() {
+			c.err = nil //nothing was sent, probably a protocol where the server talks first
+		}
+		if c.err != nil {
+			log.Printf("PROXY PROTOCOL: Failed to read header from %v: %v", c.Conn.RemoteAddr(), c.err)
+		}
+	})
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.br.Read(p)
+}
+
+// NetConn returns the conn that is wrapped, used to half close it
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
@@ -0,0 +1,173 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol spec: https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+
+var v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	v1MaxLen = 107
+
+	v2CmdLocal = 0x0
+	v2CmdProxy = 0x1
+	v2FamTCP4  = 0x11
+	v2FamTCP6  = 0x21
+)
+
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// WriteHeader sends a PROXY header for a tcp conn from src to dst, version is "v1" or "v2"
+func WriteHeader(w io.Writer, version string, src, dst net.Addr) error {
+	srcTCP, srcOK := src.(*net.TCPAddr)
+	dstTCP, dstOK := dst.(*net.TCPAddr)
+
+	switch version {
+	case "v1":
+		if !srcOK || !dstOK {
+			_, err := io.WriteString(w, "PROXY UNKNOWN\r\n")
+			return err
+		}
+		family := "TCP6"
+		if srcTCP.IP.To4() != nil && dstTCP.IP.To4() != nil {
+			family = "TCP4"
+		}
+		_, err := fmt.Fprintf(w, "PROXY %v %v %v %v %v\r\n", family, srcTCP.IP, dstTCP.IP, srcTCP.Port, dstTCP.Port)
+		return err
+
+	case "v2":
+		var header bytes.Buffer
+		header.Write(v2Signature)
+		if !srcOK || !dstOK {
+			header.Write([]byte{0x20 | v2CmdLocal, 0x00, 0x00, 0x00})
+			_, err := w.Write(header.Bytes())
+			return err
+		}
+
+		header.WriteByte(0x20 | v2CmdProxy)
+		src4, dst4 := srcTCP.IP.To4(), dstTCP.IP.To4()
+		if src4 != nil && dst4 != nil {
+			header.WriteByte(v2FamTCP4)
+			binary.Write(&header, binary.BigEndian, uint16(12))
+			header.Write(src4)
+			header.Write(dst4)
+		} else {
+			header.WriteByte(v2FamTCP6)
+			binary.Write(&header, binary.BigEndian, uint16(36))
+			header.Write(srcTCP.IP.To16())
+			header.Write(dstTCP.IP.To16())
+		}
+		binary.Write(&header, binary.BigEndian, uint16(srcTCP.Port))
+		binary.Write(&header, binary.BigEndian, uint16(dstTCP.Port))
+		_, err := w.Write(header.Bytes())
+		return err
+	}
+	return fmt.Errorf("unknown PROXY protocol version %q", version)
+}
+
+// ReadHeader reads a v1 or v2 header if the stream starts with one.
+// It returns a nil addr when there is no header or the header doesnt carry an address (LOCAL/UNKNOWN).
+func ReadHeader(br *bufio.Reader) (net.Addr, error) {
+	first, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch first[0] {
+	case 'P':
+		start, err := br.Peek(6)
+		if err != nil || string(start) != "PROXY " {
+			return nil, nil
+		}
+		return readV1(br)
+	case v2Signature[0]:
+		start, err := br.Peek(len(v2Signature))
+		if err != nil || !bytes.Equal(start, v2Signature) {
+			return nil, nil
+		}
+		return readV2(br)
+	}
+	return nil, nil
+}
+
+func readV1(br *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < v1MaxLen {
+		b, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, ErrInvalidHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 0x2 {
+		return nil, ErrInvalidHeader
+	}
+	command := header[12] & 0x0F
+	family := header[13]
+	length := binary.BigEndian.Uint16(header[14:16])
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return nil, err
+	}
+
+	if command == v2CmdLocal {
+		return nil, nil
+	}
+	if command != v2CmdProxy {
+		return nil, ErrInvalidHeader
+	}
+
+	switch family {
+	case v2FamTCP4:
+		if length < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case v2FamTCP6:
+		if length < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	}
+	//udp and unix sockets are not something we proxy, keep the address of the peer
+	return nil, nil
+}
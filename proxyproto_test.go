@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"mazarin/proxyproto"
+	"net"
+	"testing"
+)
+
+// This test writes a PROXY header of both versions and checks we read the same client address back, without eating the payload
+func TestProxyProtocolRoundTrip(t *testing.T) {
+	cases := []struct {
+		version string
+		src     *net.TCPAddr
+		dst     *net.TCPAddr
+	}{
+		{"v1", &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("192.168.129.2"), Port: 25565}},
+		{"v2", &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("192.168.129.2"), Port: 25565}},
+		{"v1", &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443}},
+		{"v2", &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 443}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8443}},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := proxyproto.WriteHeader(&buf, c.version, c.src, c.dst); err != nil {
+			t.Fatalf("[%v %v] Failed to write header: %v", c.version, c.src, err)
+		}
+		buf.WriteString("payload")
+
+		br := bufio.NewReader(&buf)
+		addr, err := proxyproto.ReadHeader(br)
+		if err != nil {
+			t.Fatalf("[%v %v] Failed to read header: %v", c.version, c.src, err)
+		}
+		if addr == nil || addr.String() != c.src.String() {
+			t.Errorf("[%v %v] Addr: got %v, want %v", c.version, c.src, addr, c.src)
+		}
+		rest, _ := br.ReadString(0)
+		if rest != "payload" {
+			t.Errorf("[%v %v] Payload: got %q, want %q", c.version, c.src, rest, "payload")
+		}
+	}
+
+	//No header at all should leave the stream alone
+	br := bufio.NewReader(bytes.NewBufferString("GET / HTTP/1.1\r\n"))
+	addr, err := proxyproto.ReadHeader(br)
+	if addr != nil || err != nil {
+		t.Errorf("No header: got %v %v, want nil nil", addr, err)
+	}
+	if br.Buffered() != len("GET / HTTP/1.1\r\n") {
+		t.Errorf("No header: stream got consumed")
+	}
+}
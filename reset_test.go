@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// loginCookie logs in from ip and returns the session cookie, the ip is whitelisted in the store of the test after it
+func loginCookie(t *testing.T, name, key, ip string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/auth", strings.NewReader(`{"username":"`+name+`","key":"`+key+`"}`))
+	r.RemoteAddr = ip + ":5000"
+	w := httptest.NewRecorder()
+	webserver.AuthHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Login of %v: got %v %v, want 200", name, w.Code, w.Body.String())
+	}
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == webserver.SessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatalf("Login of %v set no session cookie", name)
+	return nil
+}
+
+// resetToken asks the admin api for a reset token of username
+func resetToken(t *testing.T, admin *http.Cookie, username string) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/admin/api/users/"+username+"/reset", nil)
+	r.AddCookie(admin)
+	w := httptest.NewRecorder()
+	webserver.AdminHandler(w, r)
+	var answer struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&answer); err != nil || answer.Token == "" {
+		t.Fatalf("Reset of %v: got %v, want a token", username, w.Code)
+	}
+	return answer.Token
+}
+
+func postReset(token, newKey string) int {
+	w := httptest.NewRecorder()
+	webserver.ResetHandler(w, httptest.NewRequest("POST", "/reset", strings.NewReader(`{"token":"`+token+`","new_key":"`+newKey+`"}`)))
+	return w.Code
+}
+
+// loggedOut checks that the old cookie and the whitelisted ip of a user stopped working
+func loggedOut(t *testing.T, store access.Store, cookie *http.Cookie, ip string) {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	if name, ok := webserver.SessionUser(r); ok {
+		t.Errorf("The old cookie still logs in %v", name)
+	}
+	if firewall.CheckWhitelist(store, ip) {
+		t.Errorf("%v is still whitelisted", ip)
+	}
+}
+
+// This test checks that a reset token works once, that only the newest one works and that the reset logs the user out
+func TestResetToken(t *testing.T) {
+	adminHash, _ := webserver.HashKey("admin_password_1")
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	_, store := testWebserver(t, config.WebserverConfig{},
+		webserver.User{Name: "admin", Hash: adminHash, Admin: true},
+		webserver.User{Name: "alice", Hash: aliceHash},
+	)
+	admin := loginCookie(t, "admin", "admin_password_1", "192.0.2.10")
+	alice := loginCookie(t, "alice", "alice_password_1", "192.0.2.11")
+
+	replaced := resetToken(t, admin, "alice")
+	token := resetToken(t, admin, "alice")
+	if code := postReset(replaced, "alice_password_2"); code != http.StatusForbidden {
+		t.Errorf("Replaced token: got %v, want 403", code)
+	}
+	if code := postReset(token, "alice_password_2"); code != http.StatusOK {
+		t.Fatalf("Reset: got %v, want 200", code)
+	}
+	if code := postReset(token, "alice_password_3"); code != http.StatusForbidden {
+		t.Errorf("Reused token: got %v, want 403", code)
+	}
+
+	loggedOut(t, store, alice, "192.0.2.11")
+	loginCookie(t, "alice", "alice_password_2", "192.0.2.11")
+}
+
+// This test checks that changing the key logs out every session of the user but not the other users
+func TestPasswordChangeRevokes(t *testing.T) {
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	bobHash, _ := webserver.HashKey("bob_password_1")
+	_, store := testWebserver(t, config.WebserverConfig{},
+		webserver.User{Name: "alice", Hash: aliceHash},
+		webserver.User{Name: "bob", Hash: bobHash},
+	)
+	alice := loginCookie(t, "alice", "alice_password_1", "192.0.2.20")
+	loginCookie(t, "alice", "alice_password_1", "192.0.2.21")
+	loginCookie(t, "bob", "bob_password_1", "192.0.2.22")
+
+	r := httptest.NewRequest("POST", "/password", strings.NewReader(`{"old_key":"alice_password_1","new_key":"alice_password_2"}`))
+	r.RemoteAddr = "192.0.2.20:5000"
+	r.AddCookie(alice)
+	w := httptest.NewRecorder()
+	webserver.PasswordHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Password change: got %v %v, want 200", w.Code, w.Body.String())
+	}
+
+	loggedOut(t, store, alice, "192.0.2.20")
+	if firewall.CheckWhitelist(store, "192.0.2.21") {
+		t.Error("The other login of alice is still whitelisted")
+	}
+	if !firewall.CheckWhitelist(store, "192.0.2.22") {
+		t.Error("bob got logged out by the password change of alice")
+	}
+}
+
+// This test checks that /logout without a cookie changes nothing, and that with one only that user leaves the shared ip
+func TestLogoutNeedsCookie(t *testing.T) {
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	bobHash, _ := webserver.HashKey("bob_password_1")
+	_, store := testWebserver(t, config.WebserverConfig{},
+		webserver.User{Name: "alice", Hash: aliceHash},
+		webserver.User{Name: "bob", Hash: bobHash},
+	)
+	alice := loginCookie(t, "alice", "alice_password_1", "192.0.2.25")
+	loginCookie(t, "bob", "bob_password_1", "192.0.2.25")
+
+	logout := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest("POST", "/logout", nil)
+		r.RemoteAddr = "192.0.2.25:5000"
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		webserver.LogoutHandler(w, r)
+		return w.Code
+	}
+	if code := logout(nil); code != http.StatusUnauthorized {
+		t.Errorf("Logout without cookie: got %v, want 401", code)
+	}
+	if !firewall.HasLogin(store, "192.0.2.25", "alice") || !firewall.HasLogin(store, "192.0.2.25", "bob") {
+		t.Fatal("A logout without cookie logged users out")
+	}
+
+	if code := logout(alice); code != http.StatusOK {
+		t.Errorf("Logout of alice: got %v, want 200", code)
+	}
+	if firewall.HasLogin(store, "192.0.2.25", "alice") {
+		t.Error("alice is still logged in after the logout")
+	}
+	if !firewall.HasLogin(store, "192.0.2.25", "bob") {
+		t.Error("bob got logged out with alice")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/database"
+	"mazarin/firewall"
+	"mazarin/sessions"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// storedSession is a saved login cookie, the snapshot only has the hash of the token
+func storedSession(token, user, ip string, expires time.Time) sessions.Stored {
+	sum := sha256.Sum256([]byte(token))
+	return sessions.Stored{TokenHash: hex.EncodeToString(sum[:]), Username: user, IPAddress: ip, CreatedAt: expires.Add(-time.Hour), ExpiresAt: expires}
+}
+
+func cookieUser(token string) (string, bool) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: webserver.SessionCookieName, Value: token})
+	return webserver.SessionUser(r)
+}
+
+// This test checks that sessions.json brings back what is still valid, and leaves out what ran out or belongs to a disabled user
+func TestRestoreState(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	key, _ := apiKey("eeee5555", "restoresecret", webserver.ScopeSession)
+	conf, store := testWebserver(t, config.WebserverConfig{},
+		webserver.User{Name: "alice", Hash: hash, APIKeys: []webserver.APIKey{key}},
+		webserver.User{Name: "carol", Hash: hash, Disabled: true},
+	)
+
+	now := time.Now()
+	saved := map[string]any{
+		"sessions": []sessions.Stored{
+			storedSession("valid-token", "alice", "192.0.2.90", now.Add(time.Hour)),
+			storedSession("expired-token", "alice", "192.0.2.90", now.Add(-time.Minute)),
+			storedSession("disabled-token", "carol", "192.0.2.91", now.Add(time.Hour)),
+		},
+		"leases": []firewall.Lease{
+			{ID: "lease-valid", IP: "192.0.2.92", User: "alice", KeyID: "eeee5555", Expires: now.Add(time.Hour)},
+			{ID: "lease-expired", IP: "192.0.2.93", User: "alice", KeyID: "eeee5555", Expires: now.Add(-time.Minute)},
+			{ID: "lease-deleted-key", IP: "192.0.2.94", User: "alice", KeyID: "ffff6666", Expires: now.Add(time.Hour)},
+		},
+		"whitelist": []firewall.WhitelistEntry{
+			{IP: "192.0.2.90", User: "alice"},
+			{IP: "192.0.2.95", User: "carol"},
+		},
+		"manual": []access.Grant{
+			{IP: "198.51.100.0/28", Source: access.SourceManual, Expires: now.Add(time.Hour)},
+			{IP: "198.51.100.16/28", Source: access.SourceManual, Expires: now.Add(-time.Minute)},
+		},
+	}
+	data, _ := json.Marshal(saved)
+	if err := os.WriteFile(filepath.Join(conf.KeysDir, "sessions.json"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	webserver.RestoreState()
+
+	if name, ok := cookieUser("valid-token"); !ok || name != "alice" {
+		t.Errorf("Valid session: got %q %v, want alice", name, ok)
+	}
+	for _, token := range []string{"expired-token", "disabled-token"} {
+		if name, ok := cookieUser(token); ok {
+			t.Errorf("%v: got restored for %v", token, name)
+		}
+	}
+
+	want := map[string]bool{
+		"192.0.2.90":    true,  //login of alice, waits for the page to come back
+		"192.0.2.91":    false, //only had a session of the disabled carol
+		"192.0.2.92":    true,  //lease that still runs
+		"192.0.2.93":    false, //lease that ran out while mazarin was down
+		"192.0.2.94":    false, //lease of a deleted api key
+		"192.0.2.95":    false, //login of the disabled carol
+		"198.51.100.5":  true,
+		"198.51.100.20": false,
+	}
+	for ip, whitelisted := range want {
+		if got := firewall.CheckWhitelist(store, ip); got != whitelisted {
+			t.Errorf("%v: whitelisted %v, want %v", ip, got, whitelisted)
+		}
+	}
+}
+
+// This test checks that the db hands back only the sessions and leases that did not run out since they were saved
+func TestStateDBDropsExpired(t *testing.T) {
+	if err := database.InitDb(&config.WebserverConfig{DbDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+	now := time.Now()
+	err := database.SaveState(
+		[]sessions.Stored{
+			storedSession("valid-token", "alice", "192.0.2.90", now.Add(time.Hour)),
+			storedSession("expired-token", "alice", "192.0.2.90", now.Add(-time.Minute)),
+		},
+		[]firewall.Lease{
+			{ID: "lease-valid", IP: "192.0.2.92", User: "alice", KeyID: "eeee5555", Expires: now.Add(time.Hour)},
+			{ID: "lease-expired", IP: "192.0.2.93", User: "alice", KeyID: "eeee5555", Expires: now.Add(-time.Minute)},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, leases, err := database.LoadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 1 || stored[0].TokenHash != storedSession("valid-token", "", "", now).TokenHash {
+		t.Errorf("Sessions: got %+v, want only the valid one", stored)
+	}
+	if len(leases) != 1 || leases[0].ID != "lease-valid" || leases[0].Expires.Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("Leases: got %+v, want only the valid one", leases)
+	}
+}
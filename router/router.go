@@ -4,21 +4,27 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"mazarin/access"
 	"mazarin/config"
+	"mazarin/extauthz"
 	"mazarin/firewall"
 	"mazarin/proxy"
 	"mazarin/webserver"
-	"net"
 	"net/http"
+	"net/url"
 	"strings"
 )
 
 var routes = make(map[string]config.ProxyConfig)
+var loginURL string
+var store access.Store //whitelist and bans, the same store the listeners and the webserver use
 
-func InitRouter(routConf []config.ProxyConfig) {
+func InitRouter(routConf []config.ProxyConfig, webLoginURL string, accessStore access.Store) {
 	for _, route := range routConf {
 		routes[route.ListenUrl+route.Port] = route
 	}
+	loginURL = webLoginURL
+	store = accessStore
 }
 
 func RouteWithCfg(ctx context.Context, webConf *config.WebserverConfig, firewallConf *config.FirewallConfig) http.HandlerFunc {
@@ -31,22 +37,69 @@ func route(ctx context.Context, webConf *config.WebserverConfig, firewallConf *c
 	reqHost := strings.Split(strings.ToLower(r.Host), ":") //TODO check what happens on ipv6
 
 	//FIREWALL
-	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	clientIP, err := firewall.ClientIP(r)
 	if err != nil {
 		log.Printf("ROUTER: Failed to parse client IP: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
+	if firewall.IsBanned(store, clientIP) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	//Lookup first, the firewall needs to know how the route wants to be protected
+	var currentPort string
+	if len(reqHost) == 1 {
+		if r.TLS == nil {
+			currentPort = "80"
+		} else {
+			currentPort = "443"
+		}
+	} else {
+		currentPort = reqHost[1]
+	}
+
+	var routeSearchPath string
+	if r.URL.Path != "/" {
+		routeSearchPath = fmt.Sprintf("%v%v:%v", reqHost[0], r.URL.Path, currentPort)
+	}
+	routeInfo, found := routes[routeSearchPath]
+	if !found {
+		routeInfo, found = routes[fmt.Sprintf("%v:%v", reqHost[0], currentPort)]
+	}
 
-	if firewallConf.EnableFirewall {
+	//Never trust identity headers from the client, we set them ourselves below
+	for key := range r.Header {
+		if strings.HasPrefix(key, "X-Mazarin-") {
+			r.Header.Del(key)
+		}
+	}
+
+	var user string
+	groupID := 0         //0 allows every route
+	whitelisted := false //the group check then goes over every user of the ip
+	if found && routeInfo.Auth == "session" {
+		//Session routes are protected by the login cookie instead of the ip whitelist
+		sessionUser, ok := webserver.SessionUser(r)
+		if !ok {
+			log.Printf("ROUTER: IP: %v has no valid session for: %v", clientIP, reqHost[0])
+			redirectToLogin(w, r)
+			return
+		}
+		user = sessionUser
+		groupID = webserver.UserGroup(user)
+	} else if firewallConf.EnableFirewall {
 		//Add blacklist/whitelist here in the future
 		if !firewallConf.DefaultAllow {
-			if !firewall.CheckWhitelist(clientIP) && reqHost[0] != webConf.ListenURL { //Make sure the router still allows the proxy auth page to load :p
+			whitelisted = firewall.CheckWhitelist(store, clientIP)
+			if !whitelisted && reqHost[0] != webConf.ListenURL { //Make sure the router still allows the proxy auth page to load :p
 				log.Printf("ROUTER: IP: %v access denied for: %v", clientIP, reqHost[0])
 				http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
 				return
 			}
 		}
+		user = firewall.UserForIP(store, clientIP)
 	}
 
 	if !firewall.ValidateInput(r.URL.Path, "path") {
@@ -62,34 +115,50 @@ func route(ctx context.Context, webConf *config.WebserverConfig, firewallConf *c
 	//------
 
 	//ROUTING
-	var currentPort string
-	if len(reqHost) == 1 {
-		if r.TLS == nil {
-			currentPort = "80"
-		} else {
-			currentPort = "443"
+	log.Println(r.URL.Path)
+	if !found {
+		log.Printf("ROUTER: Requested url is not a configured route: %v", reqHost[0])
+		http.Error(w, "Domain does not exist", http.StatusBadRequest)
+		return
+	}
+	if whitelisted {
+		//Several users can share the ip, the route goes to the newest of them that may use it
+		routeUser, allowed := firewall.LoginForRoute(store, clientIP, &routeInfo)
+		if !allowed {
+			log.Printf("ROUTER: No user of IP %v has permission for: %v", clientIP, reqHost[0])
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
 		}
-	} else {
-		currentPort = reqHost[1]
+		user = routeUser
+	} else if !firewall.GroupAllows(groupID, &routeInfo) {
+		log.Printf("ROUTER: User %v (%v) has no permission for: %v", user, clientIP, reqHost[0])
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
 	}
-
-	log.Println(r.URL.Path)
-	var routeSearchPath string
-	var routeInfo config.ProxyConfig
-	if r.URL.Path != "/" {
-		routeSearchPath = fmt.Sprintf("%v%v:%v", reqHost[0], r.URL.Path, currentPort)
+	if user != "" {
+		r.Header.Set("X-Mazarin-User", user)
 	}
-	if routeInfoPath, ok := routes[routeSearchPath]; ok {
-		routeInfo = routeInfoPath
-	} else {
-		routeSearch := fmt.Sprintf("%v:%v", reqHost[0], currentPort)
-		routeInfoNP, ok := routes[routeSearch]
-		if !ok {
-			log.Printf("ROUTER: Requested url is not a configured route: %v", reqHost[0])
-			http.Error(w, "Domain does not exist", http.StatusBadRequest)
+
+	if routeInfo.ExtAuthz != nil {
+		decision := extauthz.Check(r.Context(), routeInfo.ExtAuthz, extauthz.Request{
+			Method:   r.Method,
+			Host:     reqHost[0],
+			Path:     r.URL.Path,
+			ClientIP: clientIP,
+			User:     user,
+		})
+		if !decision.Allow {
+			log.Printf("ROUTER: IP: %v denied by ext_authz for: %v%v", clientIP, reqHost[0], r.URL.Path)
+			if decision.ContentType != "" {
+				w.Header().Set("Content-Type", decision.ContentType)
+			}
+			w.WriteHeader(decision.Status)
+			w.Write([]byte(decision.Body))
 			return
 		}
-		routeInfo = routeInfoNP
+		for key, val := range decision.Headers {
+			r.Header.Set(key, val)
+		}
 	}
 
 	if !routeInfo.NoHeaders {
@@ -122,14 +191,54 @@ func route(ctx context.Context, webConf *config.WebserverConfig, firewallConf *c
 			//Currently only our webserver uses func, the func type is meant for routes that call code in the program
 			//TODO make this more configurable
 			routeInfo.TargetAddr = webConf.StaticDir
+			switch {
+			case strings.HasPrefix(r.URL.Path, "/admin/api/"):
+				webserver.AdminHandler(w, r)
+				return
+			case strings.HasPrefix(r.URL.Path, "/api/"):
+				webserver.APIHandler(w, r)
+				return
+			case strings.HasPrefix(r.URL.Path, "/account/apikeys"):
+				webserver.APIKeysHandler(w, r)
+				return
+			}
 			switch r.URL.Path {
 			case "/auth":
 				webserver.AuthHandler(w, r)
+			case "/logout":
+				webserver.LogoutHandler(w, r)
+			case "/register":
+				webserver.RegisterHandler(w, r)
 			case "/sse":
 				webserver.SseHandler(ctx, webConf, w, r)
+			case "/account/renew":
+				webserver.RenewHandler(w, r)
+			case "/account/password":
+				webserver.PasswordHandler(w, r)
+			case "/account/reset":
+				webserver.ResetHandler(w, r)
+			case "/account/totp/setup":
+				webserver.TOTPSetupHandler(w, r)
+			case "/account/totp/confirm":
+				webserver.TOTPConfirmHandler(w, r)
 			default:
 				proxy.HandleStaticServe(w, r, &routeInfo)
 			}
 		}
 	}
 }
+
+// redirectToLogin sends browsers to our auth page, which sends them back after logging in
+func redirectToLogin(w http.ResponseWriter, r *http.Request) {
+	if loginURL == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	scheme := "http://"
+	if r.TLS != nil {
+		scheme = "https://"
+	}
+	original := scheme + r.Host + r.URL.RequestURI()
+	http.Redirect(w, r, loginURL+"/?redirect="+url.QueryEscape(original), http.StatusFound)
+}
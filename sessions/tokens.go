@@ -1,18 +1,24 @@
 package sessions
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"log"
 	"sync"
 	"time"
 )
 
-//Not in use yet
+// CookieName is the login cookie, the http proxy strips it so proxy targets never get to see it
+const CookieName = "mazarin_session"
 
 var (
 	mu       = sync.RWMutex{}
-	sessions = make(map[string]*Session)
-	cleanup  = make(chan struct{})
+	sessions = make(map[string]*Session) //sha256 of the token -> session, so a leaked snapshot holds no usable cookies
+	cleanup  = make(chan struct{}, 1)
+	changed  = make(chan struct{}, 1)
 )
 
 type Session struct {
@@ -22,6 +28,33 @@ type Session struct {
 	IPAddress string
 }
 
+// Stored is a session the way it gets written to disk
+type Stored struct {
+	TokenHash string    `json:"token_hash"`
+	Username  string    `json:"username"`
+	IPAddress string    `json:"ip"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// notify wakes whoever persists the sessions, never blocks
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Changed fires after sessions got created or removed
+func Changed() <-chan struct{} {
+	return changed
+}
+
 func generateToken() string {
 	b := make([]byte, 32)
 	rand.Read(b)
@@ -38,20 +71,134 @@ func CreateSession(username, ipAddress string, duration time.Duration) string {
 	}
 	mu.Lock()
 	defer mu.Unlock()
-	sessions[token] = session
+	sessions[tokenKey(token)] = session
+	notify(changed)
 	return token
 }
 
 func ValidateSession(token string) (string, string, bool) {
 	mu.RLock()
 	defer mu.RUnlock()
-	session, ok := sessions[token]
+	session, ok := sessions[tokenKey(token)]
 	if !ok {
 		return "", "", false
 	}
 	if time.Now().After(session.ExpiresAt) {
 		// Cleanup goroutine will handle expired sessions
+		notify(cleanup)
 		return "", "", false
 	}
 	return session.Username, session.IPAddress, true
 }
+
+// RevokeUser removes every session of a user, returns how many there were
+func RevokeUser(username string) int {
+	mu.Lock()
+	defer mu.Unlock()
+	count := 0
+	for key, session := range sessions {
+		if session.Username == username {
+			delete(sessions, key)
+			count++
+		}
+	}
+	if count > 0 {
+		notify(changed)
+	}
+	return count
+}
+
+func DeleteSession(token string) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(sessions, tokenKey(token))
+	notify(changed)
+}
+
+// Lookup returns a copy of a valid session
+func Lookup(token string) (Session, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	session, ok := sessions[tokenKey(token)]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// Snapshot returns every session that is still valid
+func Snapshot() []Stored {
+	mu.RLock()
+	defer mu.RUnlock()
+	now := time.Now()
+	stored := make([]Stored, 0, len(sessions))
+	for key, session := range sessions {
+		if now.After(session.ExpiresAt) {
+			continue
+		}
+		stored = append(stored, Stored{
+			TokenHash: key,
+			Username:  session.Username,
+			IPAddress: session.IPAddress,
+			CreatedAt: session.CreatedAt,
+			ExpiresAt: session.ExpiresAt,
+		})
+	}
+	return stored
+}
+
+// Restore puts saved sessions back after a restart, expired ones are skipped. Returns how many were restored
+func Restore(stored []Stored) int {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	count := 0
+	for _, s := range stored {
+		if s.TokenHash == "" || now.After(s.ExpiresAt) {
+			continue
+		}
+		sessions[s.TokenHash] = &Session{
+			Username:  s.Username,
+			CreatedAt: s.CreatedAt,
+			ExpiresAt: s.ExpiresAt,
+			IPAddress: s.IPAddress,
+		}
+		count++
+	}
+	return count
+}
+
+// Prune drops expired sessions, returns how many it removed
+func Prune() int {
+	mu.Lock()
+	defer mu.Unlock()
+	now := time.Now()
+	count := 0
+	for key, session := range sessions {
+		if now.After(session.ExpiresAt) {
+			delete(sessions, key)
+			count++
+		}
+	}
+	if count > 0 {
+		notify(changed)
+	}
+	return count
+}
+
+// RunCleanup is the janitor, it prunes on an interval and whenever a lookup runs into an expired session
+func RunCleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-cleanup:
+		}
+		if count := Prune(); count > 0 {
+			log.Printf("SESSIONS: Pruned %v expired sessions", count)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/listeners"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startSNI runs a sni listener with the given routes on a free local port and returns its address
+func startSNI(t *testing.T, routes ...*config.ProxyConfig) string {
+	t.Helper()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.Addr().String()
+	free.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go listeners.ListenSNI(ctx, nil, &config.FirewallConfig{}, access.NewMemoryStore(), &config.ParsedProxy{Port: addr, LinkedProxies: routes}, nil, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	for range 50 {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("sni listener on %v did not start", addr)
+	return ""
+}
+
+// tlsTarget is a https server answering with its own name, the sni listener passes the tls stream to it untouched
+func tlsTarget(t *testing.T, name string) string {
+	t.Helper()
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(target.Close)
+	return target.Listener.Addr().String()
+}
+
+// getThroughSNI does a https request with serverName in the ClientHello, an empty serverName sends no SNI at all
+func getThroughSNI(addr, serverName string) (string, error) {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, addr)
+			},
+			TLSClientConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+		},
+	}
+	resp, err := client.Get("https://" + addr + "/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+// This test checks that the ClientHello server name picks the route and that the target does the tls handshake itself
+func TestSNIRouting(t *testing.T) {
+	addr := startSNI(t,
+		&config.ProxyConfig{Protocol: "sni", ListenUrl: "app.domain.com", TargetAddr: tlsTarget(t, "app")},
+		&config.ProxyConfig{Protocol: "sni", ListenUrl: "other.domain.com", TargetAddr: tlsTarget(t, "other")},
+	)
+
+	for serverName, want := range map[string]string{"app.domain.com": "app", "Other.Domain.com": "other"} {
+		got, err := getThroughSNI(addr, serverName)
+		if err != nil {
+			t.Fatalf("%v: request failed: %v", serverName, err)
+		}
+		if got != want {
+			t.Errorf("%v: got routed to %q, want %q", serverName, got, want)
+		}
+	}
+
+	//Without a fallback unknown names get dropped
+	if got, err := getThroughSNI(addr, "unknown.domain.com"); err == nil {
+		t.Errorf("unknown.domain.com: got routed to %q, want the conn closed", got)
+	}
+}
+
+// This test checks that a hello without SNI goes to the fallback route and that a malformed hello is dropped
+func TestSNIMissingAndMalformed(t *testing.T) {
+	addr := startSNI(t,
+		&config.ProxyConfig{Protocol: "sni", ListenUrl: "app.domain.com", TargetAddr: tlsTarget(t, "app")},
+		&config.ProxyConfig{Protocol: "sni", TargetAddr: tlsTarget(t, "fallback")},
+	)
+
+	got, err := getThroughSNI(addr, "")
+	if err != nil {
+		t.Fatalf("No SNI: request failed: %v", err)
+	}
+	if got != "fallback" {
+		t.Errorf("No SNI: got routed to %q, want fallback", got)
+	}
+
+	//Plain http is no ClientHello, it must not reach the fallback either
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: app.domain.com\r\n\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	answer, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Malformed hello: conn was not closed: %v", err)
+	}
+	if len(answer) != 0 {
+		t.Errorf("Malformed hello: got %q, want the conn closed without an answer", answer)
+	}
+}
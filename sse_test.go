@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mazarin/config"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// openSSE opens /sse from ip with the cookie, the server side is shut down right away so it returns after the answer
+func openSSE(conf *config.WebserverConfig, cookie *http.Cookie, ip string) int {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("GET", "/sse", nil)
+	r.RemoteAddr = ip + ":5000"
+	if cookie != nil {
+		r.AddCookie(cookie)
+	}
+	w := httptest.NewRecorder()
+	webserver.SseHandler(ctx, conf, w, r)
+	return w.Code
+}
+
+// This test checks that a login cookie only whitelists the ip it was made on again, a copied cookie gets nothing
+func TestSSECookieStaysOnItsIP(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	conf, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash})
+	cookie := loginCookie(t, "alice", "alice_password_1", "192.0.2.60")
+
+	if code := openSSE(conf, cookie, "192.0.2.61"); code != http.StatusUnauthorized {
+		t.Errorf("Cookie from another ip: got %v, want 401", code)
+	}
+	if firewall.CheckWhitelist(store, "192.0.2.61") {
+		t.Error("A copied cookie whitelisted another ip")
+	}
+
+	firewall.RemoveIP(store, "192.0.2.60")
+	if code := openSSE(conf, cookie, "192.0.2.60"); code != http.StatusOK {
+		t.Errorf("Cookie from its own ip: got %v, want 200", code)
+	}
+	if !firewall.CheckWhitelist(store, "192.0.2.60") {
+		t.Error("The cookie did not whitelist its own ip again")
+	}
+}
+
+// streamWriter is the browser end of a /sse stream. A stuck one hangs on the first notice until stuck is closed,
+// the others pass every notice they get on to notices
+type streamWriter struct {
+	header  http.Header
+	stuck   chan struct{}
+	notices chan string
+	event   string //what counts as a notice, "notice" when empty
+}
+
+func (s *streamWriter) Header() http.Header { return s.header }
+func (s *streamWriter) WriteHeader(int)     {}
+func (s *streamWriter) Flush()              {}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	event := cmp.Or(s.event, "notice")
+	if bytes.Contains(p, []byte("event: "+event+"\n")) {
+		if s.stuck != nil {
+			<-s.stuck
+		} else {
+			select {
+			case s.notices <- string(p):
+			default:
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// This test checks that a stream that stopped reading neither blocks broadcasts nor keeps them from the other streams
+func TestBroadcastSkipsStuckStream(t *testing.T) {
+	hash, _ := webserver.HashKey("alice_password_1")
+	conf, store := testWebserver(t, config.WebserverConfig{}, webserver.User{Name: "alice", Hash: hash})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+
+	stuck := &streamWriter{header: http.Header{}, stuck: make(chan struct{})}
+	fast := &streamWriter{header: http.Header{}, notices: make(chan string, 100)}
+	for i, w := range []*streamWriter{stuck, fast} {
+		ip := fmt.Sprintf("192.0.2.%v", 70+i)
+		firewall.WhitelistIP(store, ip, "alice", 0)
+		r := httptest.NewRequest("GET", "/sse", nil)
+		r.RemoteAddr = ip + ":5000"
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			webserver.SseHandler(ctx, conf, w, r)
+		}()
+	}
+	t.Cleanup(func() {
+		close(stuck.stuck)
+		cancel()
+		//A publish that blocks holds the bus for good, dont hang the whole run on it
+		waited := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(waited)
+		}()
+		select {
+		case <-waited:
+		case <-time.After(5 * time.Second):
+			t.Error("The streams did not end")
+		}
+	})
+	for start := time.Now(); len(webserver.Sessions()) < 2; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The streams did not open")
+		}
+	}
+
+	//Way more than the stuck stream buffers, a blocking send would hang here for good
+	done := make(chan struct{})
+	go func() {
+		for i := range 100 {
+			webserver.Broadcast(fmt.Sprintf("notice %v", i))
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Broadcast blocked on the stuck stream")
+	}
+
+	//The fast stream may have dropped some of the burst, a notice after it has to get through
+	deadline := time.After(5 * time.Second)
+	for {
+		webserver.Broadcast("last")
+		select {
+		case notice := <-fast.notices:
+			if strings.Contains(notice, `"last"`) {
+				return
+			}
+			continue
+		case <-deadline:
+			t.Fatal("The fast stream did not get the notice after the burst")
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// startStream opens a /sse stream from ip with the cookie and waits until it is registered, drop makes the browser go away
+func startStream(t *testing.T, conf *config.WebserverConfig, cookie *http.Cookie, ip string) (drop func()) {
+	t.Helper()
+	return startStreamTo(t, conf, cookie, ip, &streamWriter{header: http.Header{}})
+}
+
+// startStreamTo is startStream with the browser end of the stream given
+func startStreamTo(t *testing.T, conf *config.WebserverConfig, cookie *http.Cookie, ip string, w *streamWriter) (drop func()) {
+	t.Helper()
+	before := len(webserver.Sessions())
+	ctx, cancel := context.WithCancel(context.Background())
+	r := httptest.NewRequestWithContext(ctx, "GET", "/sse", nil)
+	r.RemoteAddr = ip + ":5000"
+	r.AddCookie(cookie)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		webserver.SseHandler(context.Background(), conf, w, r)
+	}()
+	for start := time.Now(); len(webserver.Sessions()) == before; time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("The stream did not open")
+		}
+	}
+	drop = func() {
+		cancel()
+		<-done
+	}
+	t.Cleanup(drop)
+	return drop
+}
+
+// This test checks that a reconnect within grace_period_seconds keeps the login, and that only the same user on the same ip counts as one
+func TestGracePeriodReconnect(t *testing.T) {
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	bobHash, _ := webserver.HashKey("bob_password_1")
+	conf, store := testWebserver(t, config.WebserverConfig{GracePeriodSeconds: 1},
+		webserver.User{Name: "alice", Hash: aliceHash},
+		webserver.User{Name: "bob", Hash: bobHash},
+	)
+	alice := loginCookie(t, "alice", "alice_password_1", "192.0.2.80")
+	bob := loginCookie(t, "bob", "bob_password_1", "192.0.2.80")
+
+	startStream(t, conf, alice, "192.0.2.80")()
+	if !firewall.HasLogin(store, "192.0.2.80", "alice") {
+		t.Fatal("alice got removed before the grace period was over")
+	}
+	dropAgain := startStream(t, conf, alice, "192.0.2.80")
+	time.Sleep(1500 * time.Millisecond)
+	if !firewall.HasLogin(store, "192.0.2.80", "alice") {
+		t.Fatal("alice got removed although the stream came back within the grace period")
+	}
+
+	//A stream of bob on the same ip is no reconnect of alice
+	dropAgain()
+	startStream(t, conf, bob, "192.0.2.80")
+	time.Sleep(1500 * time.Millisecond)
+	if firewall.HasLogin(store, "192.0.2.80", "alice") {
+		t.Error("alice is still logged in after the grace period")
+	}
+	if !firewall.HasLogin(store, "192.0.2.80", "bob") {
+		t.Error("bob lost the ip with the cleanup of alice")
+	}
+}
+
+// nextAccess waits for the next access event on a stream that passes them on to notices
+func nextAccess(t *testing.T, notices chan string) string {
+	t.Helper()
+	select {
+	case raw := <-notices:
+		_, data, _ := strings.Cut(raw, "data: ")
+		return strings.TrimSpace(data)
+	case <-time.After(5 * time.Second):
+		t.Fatal("No access event")
+		return ""
+	}
+}
+
+// This test checks that users only get their own login out of the access events of their ip, and admins the whole grant
+func TestAccessEventsPerUser(t *testing.T) {
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	bobHash, _ := webserver.HashKey("bob_password_1")
+	adminHash, _ := webserver.HashKey("admin_password_1")
+	conf, _ := testWebserver(t, config.WebserverConfig{},
+		webserver.User{Name: "alice", Hash: aliceHash},
+		webserver.User{Name: "bob", Hash: bobHash},
+		webserver.User{Name: "admin", Hash: adminHash, Admin: true},
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go webserver.WatchAccess(ctx)
+
+	const shared = "192.0.2.140"
+	alice := loginCookie(t, "alice", "alice_password_1", shared)
+	admin := loginCookie(t, "admin", "admin_password_1", "192.0.2.141")
+	aliceStream := &streamWriter{header: http.Header{}, notices: make(chan string, 10), event: "access"}
+	adminStream := &streamWriter{header: http.Header{}, notices: make(chan string, 10), event: "access"}
+	startStreamTo(t, conf, alice, shared, aliceStream)
+	startStreamTo(t, conf, admin, "192.0.2.141", adminStream)
+
+	loginCookie(t, "bob", "bob_password_1", shared)
+	var own webserver.AccessEvent
+	data := nextAccess(t, aliceStream.notices)
+	if err := json.Unmarshal([]byte(data), &own); err != nil {
+		t.Fatal(err)
+	}
+	//A login from the page lasts until logout, so it has no expiry
+	if own.Type != "grant" || own.IP != shared || own.Login == nil || own.Login.User != "alice" || !own.Login.Expires.IsZero() {
+		t.Errorf("Event of alice: got %v, want her own login", data)
+	}
+	if strings.Contains(data, "bob") {
+		t.Errorf("alice learned who else is on her ip: %v", data)
+	}
+	if data := nextAccess(t, adminStream.notices); !strings.Contains(data, `"user":"bob"`) || !strings.Contains(data, `"user":"alice"`) {
+		t.Errorf("Event of the admin: got %v, want the whole grant", data)
+	}
+}
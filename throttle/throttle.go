@@ -0,0 +1,189 @@
+package throttle
+
+import (
+	"context"
+	"io"
+	"mazarin/config"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Max bytes a single read/write may take from a bucket in one go, smaller chunks = fairer sharing between conns
+const chunkSize = 16 * 1024
+
+var (
+	mu            = sync.RWMutex{}
+	globalLimiter *Limiter
+	defaultRate   int64
+	userRates     = make(map[string]int64)
+	userLimiters  = make(map[string]*Limiter)
+	routeLimiters = make(map[string]*Limiter)
+)
+
+func Init(conf *config.LimitsConfig) {
+	mu.Lock()
+	defer mu.Unlock()
+	globalLimiter = NewLimiter(conf.GlobalRate)
+	defaultRate = conf.UserRate
+}
+
+// SetUserRates sets the per user overrides (from keys.json), users without an override get the default user_rate
+func SetUserRates(rates map[string]int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	userRates = rates
+	userLimiters = make(map[string]*Limiter)
+}
+
+// For returns every limiter that applies to traffic of this route and user, global last
+func For(route *config.ProxyConfig, user string) []*Limiter {
+	var limiters []*Limiter
+
+	if l := routeLimiter(route); l != nil {
+		limiters = append(limiters, l)
+	}
+	if l := userLimiter(user); l != nil {
+		limiters = append(limiters, l)
+	}
+
+	mu.RLock()
+	if globalLimiter != nil {
+		limiters = append(limiters, globalLimiter)
+	}
+	mu.RUnlock()
+
+	return limiters
+}
+
+func routeLimiter(route *config.ProxyConfig) *Limiter {
+	if route == nil || route.RateLimit <= 0 {
+		return nil
+	}
+	key := route.ListenUrl + route.Port
+
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok := routeLimiters[key]
+	if !ok {
+		l = NewLimiter(route.RateLimit)
+		routeLimiters[key] = l
+	}
+	return l
+}
+
+func userLimiter(user string) *Limiter {
+	if user == "" {
+		return nil
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if l, ok := userLimiters[user]; ok {
+		return l
+	}
+	rate, ok := userRates[user]
+	if !ok || rate == 0 {
+		rate = defaultRate
+	}
+	l := NewLimiter(rate) //nil when unlimited, still cache it so we dont redo the lookup
+	userLimiters[user] = l
+	return l
+}
+
+// waitAll reserves the bytes on every limiter at once and sleeps off the longest debt, so the strictest limit applies
+func waitAll(ctx context.Context, limiters []*Limiter, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	var wait time.Duration
+	for _, l := range limiters {
+		if l != nil {
+			wait = max(wait, l.reserve(n))
+		}
+	}
+	return sleep(ctx, wait)
+}
+
+// Reader throttles everything read through it
+type Reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func NewReader(ctx context.Context, r io.Reader, limiters []*Limiter) io.Reader {
+	if len(limiters) == 0 {
+		return r
+	}
+	return &Reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+func (tr *Reader) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := tr.r.Read(p)
+	if n > 0 {
+		if werr := waitAll(tr.ctx, tr.limiters, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+// Body throttles a http request body, uploads share the buckets with the response
+type Body struct {
+	io.Reader
+	body io.ReadCloser
+}
+
+func NewBody(ctx context.Context, body io.ReadCloser, limiters []*Limiter) io.ReadCloser {
+	if len(limiters) == 0 || body == nil || body == http.NoBody {
+		return body
+	}
+	return &Body{Reader: NewReader(ctx, body, limiters), body: body}
+}
+
+func (b *Body) Close() error {
+	return b.body.Close()
+}
+
+// ResponseWriter throttles the body of a http response
+type ResponseWriter struct {
+	http.ResponseWriter
+	ctx      context.Context
+	limiters []*Limiter
+}
+
+func NewResponseWriter(ctx context.Context, w http.ResponseWriter, limiters []*Limiter) http.ResponseWriter {
+	if len(limiters) == 0 {
+		return w
+	}
+	return &ResponseWriter{ResponseWriter: w, ctx: ctx, limiters: limiters}
+}
+
+func (tw *ResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > chunkSize {
+			chunk = chunk[:chunkSize]
+		}
+		if err := waitAll(tw.ctx, tw.limiters, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController (used by the reverse proxy) reach the Flusher underneath
+func (tw *ResponseWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mazarin/throttle"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// indebt returns a limiter that already owes the given time, a cancelled wait keeps its reservation
+func indebt(rate int64, debt time.Duration) *throttle.Limiter {
+	l := throttle.NewLimiter(rate)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	l.WaitN(ctx, int(rate+int64(debt.Seconds()*float64(rate))))
+	return l
+}
+
+// This test checks that with several limiters the strictest one decides the delay, instead of the delays adding up
+func TestThrottleStrictestLimiter(t *testing.T) {
+	const rate = 100000
+	limiters := []*throttle.Limiter{indebt(rate, 300*time.Millisecond), nil, indebt(rate, 500*time.Millisecond)}
+
+	start := time.Now()
+	r := throttle.NewReader(context.Background(), strings.NewReader("x"), limiters)
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if waited := time.Since(start); waited < 450*time.Millisecond || waited > 750*time.Millisecond {
+		t.Fatalf("waited %v, want about 500ms", waited)
+	}
+
+	//A done ctx stops the wait right away
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r = throttle.NewReader(ctx, strings.NewReader("x"), []*throttle.Limiter{indebt(rate, time.Minute)})
+	if _, err := io.ReadAll(r); err != context.Canceled {
+		t.Fatalf("read with a done ctx = %v, want context.Canceled", err)
+	}
+}
+
+// This test checks that http uploads are throttled too, not only the response
+func TestThrottleRequestBody(t *testing.T) {
+	const rate = 100000
+	limiters := []*throttle.Limiter{throttle.NewLimiter(rate)}
+
+	//The first rate worth of bytes is the burst, the second half second has to be waited for
+	upload := bytes.Repeat([]byte("u"), rate+rate/2)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(upload))
+	body := throttle.NewBody(req.Context(), req.Body, limiters)
+
+	start := time.Now()
+	got, err := io.ReadAll(body)
+	if err != nil || len(got) != len(upload) {
+		t.Fatalf("read %v bytes, %v", len(got), err)
+	}
+	if waited := time.Since(start); waited < 400*time.Millisecond {
+		t.Fatalf("upload took %v, it was not throttled", waited)
+	}
+	if err := body.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if throttle.NewBody(req.Context(), http.NoBody, limiters) != http.NoBody {
+		t.Fatal("an empty body got wrapped")
+	}
+}
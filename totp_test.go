@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/webserver"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// This test checks the codes against the sha1 test vectors of RFC 6238, we use the last 6 of their 8 digits
+func TestTOTPCode(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+	vectors := map[uint64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1111111111:  "050471",
+		1234567890:  "005924",
+		2000000000:  "279037",
+		20000000000: "353130",
+	}
+	for unix, want := range vectors {
+		got, err := webserver.TOTPCode(secret, unix/30)
+		if err != nil {
+			t.Fatalf("T=%v: %v", unix, err)
+		}
+		if got != want {
+			t.Errorf("T=%v: got %v, want %v", unix, got, want)
+		}
+	}
+	if _, err := webserver.TOTPCode("not base32!", 1); err == nil {
+		t.Error("Expected an error for a broken secret")
+	}
+}
+
+// This test checks that a recovery code logs in exactly once, even when two logins race with it
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	dir := t.TempDir()
+	hash, err := webserver.HashKey("alice_password_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryHash := func(code string) string {
+		sum := sha256.Sum256([]byte(code))
+		return hex.EncodeToString(sum[:])
+	}
+	keys, _ := json.Marshal(webserver.UsersData{Users: []webserver.User{{
+		Name:          "alice",
+		Hash:          hash,
+		TotpSecret:    "JBSWY3DPEHPK3PXP",
+		RecoveryCodes: []string{recoveryHash("abcd-efgh"), recoveryHash("wxyz-2345")},
+	}}})
+	if err := os.WriteFile(filepath.Join(dir, "keys.json"), keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.WebserverConfig{KeysDir: dir}
+	if err := webserver.OpenUsers(conf, access.NewMemoryStore()); err != nil {
+		t.Fatal(err)
+	}
+	resetWebserver(t)
+
+	login := func() int {
+		body := `{"username":"alice","key":"alice_password_1","otp":"abcd-efgh"}`
+		w := httptest.NewRecorder()
+		webserver.AuthHandler(w, httptest.NewRequest("POST", "/auth", strings.NewReader(body)))
+		if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), `"success"`) {
+			t.Errorf("Login answered 200 without success: %v", w.Body.String())
+		}
+		return w.Code
+	}
+
+	var wg sync.WaitGroup
+	codes := make([]int, 2)
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = login()
+		}()
+	}
+	wg.Wait()
+	succeeded := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			succeeded++
+		}
+	}
+	if succeeded != 1 {
+		t.Fatalf("Racing logins: got statuses %v, want exactly one 200", codes)
+	}
+	if code := login(); code != http.StatusUnauthorized {
+		t.Errorf("Reused code: got status %v, want 401", code)
+	}
+
+	users := webserver.LoadUsers(conf)
+	if left := users["alice"].RecoveryCodes; len(left) != 1 || left[0] != recoveryHash("wxyz-2345") {
+		t.Errorf("keys.json recovery codes: got %v, want only the unused one", left)
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/database"
+	"mazarin/firewall"
+	"mazarin/webserver"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testWebserver points the webserver at a temp keys dir holding these users and a store of its own, it gets empty ones again when the test ends
+func testWebserver(t *testing.T, conf config.WebserverConfig, users ...webserver.User) (*config.WebserverConfig, access.Store) {
+	t.Helper()
+	if conf.KeysDir == "" {
+		conf.KeysDir = t.TempDir()
+	}
+	keys, err := json.Marshal(webserver.UsersData{Users: users})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(conf.KeysDir, "keys.json"), keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := access.NewMemoryStore()
+	webserver.Init(webserver.LoadUsers(&conf), &conf, store)
+	resetWebserver(t)
+	return &conf, store
+}
+
+// resetWebserver gives the webserver empty users, config and store again when the test ends, and closes the db if the test opened one
+func resetWebserver(t *testing.T) {
+	empty := &config.WebserverConfig{KeysDir: t.TempDir()}
+	t.Cleanup(func() {
+		database.Close()
+		webserver.Init(map[string]webserver.User{}, empty, access.NewMemoryStore())
+	})
+}
+
+// This test checks that keys.json moves into the db on the first start with enable_db, and that user changes end up in the db
+func TestUsersMoveIntoDB(t *testing.T) {
+	dir := t.TempDir()
+	keys := `{"users": [{"name": "alice", "hash": "$2a$10$f.qQVxQMikTkKZWYekqYfOi17O8f1/83HA5CX8TADYtQGhHmptZha", "admin": true}]}`
+	if err := os.WriteFile(filepath.Join(dir, "keys.json"), []byte(keys), 0600); err != nil {
+		t.Fatal(err)
+	}
+	conf := &config.WebserverConfig{KeysDir: dir, DbDir: filepath.Join(dir, "db"), EnableDB: true}
+
+	if err := webserver.OpenUsers(conf, access.NewMemoryStore()); err != nil {
+		t.Fatal(err)
+	}
+	resetWebserver(t)
+	if _, err := os.Stat(filepath.Join(dir, "keys.json.migrated")); err != nil {
+		t.Fatal("keys.json was not moved aside:", err)
+	}
+	if err := webserver.AddUser("bob", "bob_password_1", 0, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := webserver.AddUser("bob", "bob_password_1", 0, false, "test"); err == nil {
+		t.Fatal("a second bob was created")
+	}
+	if err := webserver.AddUser("carol", "short", 0, false, "test"); err == nil {
+		t.Fatal("a key that fails validation was accepted")
+	}
+	if err := webserver.SetUserDisabled("alice", true, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	//Everything has to come back from the db alone
+	users := webserver.LoadUsers(conf)
+	if len(users) != 2 || !users["alice"].Admin || !users["alice"].Disabled || users["bob"].Hash == "" {
+		t.Fatalf("users did not survive the db: %+v", users)
+	}
+	if err := webserver.RemoveUser("bob", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if users := webserver.LoadUsers(conf); len(users) != 1 {
+		t.Fatalf("removed user is still in the db: %+v", users)
+	}
+}
+
+// This test checks that a user the user subcommands wrote into the db while mazarin runs survives the next save of mazarin
+func TestDBKeepsOfflineUsers(t *testing.T) {
+	dir := t.TempDir()
+	conf := &config.WebserverConfig{KeysDir: dir, DbDir: filepath.Join(dir, "db"), EnableDB: true}
+	if err := webserver.OpenUsers(conf, access.NewMemoryStore()); err != nil {
+		t.Fatal(err)
+	}
+	resetWebserver(t)
+	if err := webserver.AddUser("alice", "alice_password_1", 0, false, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	//What `mazarin user add` does from its own process, the running users never see it
+	hash, _ := webserver.HashKey("carol_password_1")
+	if err := database.SaveUsers([]database.User{{Username: "carol", PasswordHash: hash, Active: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := webserver.AddUser("carol", "carol_password_2", 0, false, "test"); err == nil {
+		t.Error("carol got added over the row the user subcommand wrote")
+	}
+	if err := webserver.SetUserDisabled("alice", true, "test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := webserver.RemoveUser("alice", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	users := webserver.LoadUsers(conf)
+	if _, ok := users["carol"]; !ok || len(users) != 1 {
+		t.Fatalf("Users in the db: got %+v, want only carol", users)
+	}
+	if ok, _ := webserver.ValidateUserHash("carol_password_1", users["carol"].Hash); !ok {
+		t.Error("The key of carol got overwritten")
+	}
+}
+
+// This test checks that a reload that moves a user to another permission group logs that user out, and nobody else
+func TestReloadGroupChange(t *testing.T) {
+	aliceHash, _ := webserver.HashKey("alice_password_1")
+	bobHash, _ := webserver.HashKey("bob_password_1")
+	alice := webserver.User{Name: "alice", Hash: aliceHash}
+	bob := webserver.User{Name: "bob", Hash: bobHash}
+	conf, store := testWebserver(t, config.WebserverConfig{}, alice, bob)
+	loginCookie(t, "alice", "alice_password_1", "192.0.2.30")
+	loginCookie(t, "bob", "bob_password_1", "192.0.2.31")
+
+	alice.PermissionGroupID = 2
+	keys, _ := json.Marshal(webserver.UsersData{Users: []webserver.User{alice, bob}})
+	if err := os.WriteFile(filepath.Join(conf.KeysDir, "keys.json"), keys, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := webserver.ReloadKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	if firewall.CheckWhitelist(store, "192.0.2.30") {
+		t.Error("alice is still whitelisted with the old group")
+	}
+	if !firewall.CheckWhitelist(store, "192.0.2.31") {
+		t.Error("bob got logged out by a reload that did not touch bob")
+	}
+}
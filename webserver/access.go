@@ -0,0 +1,121 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"mazarin/access"
+	"mazarin/firewall"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// accessStore is the whitelist the firewall checks, Init and OpenUsers get it from main or the command line
+var accessStore access.Store
+
+// GrantInfo is a whitelisted ip for the admin api
+type GrantInfo struct {
+	access.Grant
+	Conns int `json:"conns"`
+}
+
+// AccessEvent is what a user sees of a whitelist change on their ip. Only their own login, not who else shares the ip
+type AccessEvent struct {
+	Type  access.EventType `json:"type"`
+	IP    string           `json:"ip"`
+	Login *access.Login    `json:"login,omitempty"` //nil when the user has no login on the ip (anymore)
+}
+
+// WatchAccess passes whitelist changes to the sse streams, every admin sees all of them and users only the ones of their own ip
+func WatchAccess(ctx context.Context) {
+	events, stop := accessStore.Subscribe()
+	defer stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-events:
+			//Looked up before publish, the bus lock is never held while taking the users lock
+			admins := make(map[string]bool)
+			for _, user := range listUsers() {
+				if user.Admin {
+					admins[user.Name] = true
+				}
+			}
+			publishEach("access", func(s *sseSession) (any, bool) {
+				if admins[s.user] {
+					return e, true
+				}
+				return ownAccess(e, s.user), s.ip == e.Grant.IP
+			})
+		}
+	}
+}
+
+// ownAccess cuts an event down to the login of user
+func ownAccess(e access.Event, user string) AccessEvent {
+	own := AccessEvent{Type: e.Type, IP: e.Grant.IP}
+	if e.Type != access.EventGrant {
+		return own
+	}
+	for _, login := range e.Grant.Logins {
+		if login.User == user && user != "" {
+			own.Login = &login
+		}
+	}
+	return own
+}
+
+func adminListWhitelist(w http.ResponseWriter, r *http.Request) {
+	grants := accessStore.List()
+	slices.SortFunc(grants, func(a, b access.Grant) int { return strings.Compare(a.IP, b.IP) })
+	list := make([]GrantInfo, 0, len(grants))
+	for _, g := range grants {
+		list = append(list, GrantInfo{Grant: g, Conns: accessStore.Conns(g.IP)})
+	}
+	writeJSON(w, list)
+}
+
+func adminRemoveWhitelist(w http.ResponseWriter, r *http.Request) {
+	if !RemoveWhitelist(r.PathValue("ip"), r.Header.Get("X-Mazarin-User")) {
+		http.Error(w, "IP is not whitelisted", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+type BanRequest struct {
+	Target          string `json:"target"`
+	Reason          string `json:"reason"`
+	DurationMinutes int    `json:"duration_minutes"` //0 bans until unbanned
+}
+
+func adminListBans(w http.ResponseWriter, r *http.Request) {
+	bans := firewall.Bans(accessStore)
+	slices.SortFunc(bans, func(a, b access.Ban) int { return strings.Compare(a.Target, b.Target) })
+	writeJSON(w, bans)
+}
+
+func adminBan(w http.ResponseWriter, r *http.Request) {
+	var req BanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Target == "" || req.DurationMinutes < 0 {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	ban, err := Ban(req.Target, req.Reason, time.Duration(req.DurationMinutes)*time.Minute, r.Header.Get("X-Mazarin-User"))
+	if err != nil {
+		http.Error(w, "Invalid ip or cidr", http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, ban)
+}
+
+func adminUnban(w http.ResponseWriter, r *http.Request) {
+	if !firewall.Unban(accessStore, r.PathValue("target")) {
+		http.Error(w, "Ban not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
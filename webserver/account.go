@@ -0,0 +1,200 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"mazarin/firewall"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Enroll tokens let a user that is forced to use 2FA set it up before they get a real session
+const enrollTimeout = 10 * time.Minute
+
+type enrollEntry struct {
+	Username string
+	Expires  time.Time
+}
+
+type pendingSecret struct {
+	Secret  string
+	Expires time.Time
+}
+
+var (
+	enrollMu       = sync.Mutex{}
+	enrollTokens   = make(map[string]enrollEntry)   //token -> user
+	pendingSecrets = make(map[string]pendingSecret) //user -> secret waiting for its first code
+)
+
+type TOTPRequest struct {
+	EnrollToken string `json:"enroll_token"`
+	Code        string `json:"code"`
+}
+
+func randomToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+func newEnrollToken(username string) string {
+	token := randomToken()
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+	enrollTokens[token] = enrollEntry{Username: username, Expires: time.Now().Add(enrollTimeout)}
+	return token
+}
+
+// accountUser is the user behind a session cookie, or behind an enroll token for the 2FA setup
+func accountUser(r *http.Request, enrollToken string) (string, bool) {
+	if username, ok := SessionUser(r); ok {
+		return username, true
+	}
+	if enrollToken == "" {
+		return "", false
+	}
+
+	enrollMu.Lock()
+	defer enrollMu.Unlock()
+	entry, ok := enrollTokens[enrollToken]
+	if !ok || time.Now().After(entry.Expires) {
+		delete(enrollTokens, enrollToken)
+		return "", false
+	}
+	return entry.Username, true
+}
+
+// TOTPSetupHandler creates a new secret for the user, it only gets saved after TOTPConfirmHandler saw a valid code
+func TOTPSetupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	username, ok := accountUser(r, req.EnrollToken)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	user, ok := getUser(username)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user.TotpSecret != "" {
+		http.Error(w, "2FA is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret := newTOTPSecret()
+	enrollMu.Lock()
+	pendingSecrets[username] = pendingSecret{Secret: secret, Expires: time.Now().Add(enrollTimeout)}
+	enrollMu.Unlock()
+
+	log.Printf("WEBSERVER: User %v started 2FA setup", username)
+	writeJSON(w, map[string]string{
+		"status": "success",
+		"secret": secret,
+		"uri":    totpURI(username, secret),
+	})
+}
+
+// TOTPConfirmHandler enables 2FA once the user proves their app works, the recovery codes are only shown here
+func TOTPConfirmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req TOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if !firewall.ValidateInput(req.Code, firewall.TypeOTP) {
+		http.Error(w, "Invalid characters in input", http.StatusBadRequest)
+		return
+	}
+	username, ok := accountUser(r, req.EnrollToken)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	enrollMu.Lock()
+	pending, ok := pendingSecrets[username]
+	enrollMu.Unlock()
+	if !ok || time.Now().After(pending.Expires) {
+		http.Error(w, "No 2FA setup in progress", http.StatusBadRequest)
+		return
+	}
+	secret := pending.Secret
+
+	if !validTOTP(username, secret, req.Code, true) {
+		log.Printf("WEBSERVER: User %v entered a wrong code during 2FA setup", username)
+		http.Error(w, "Invalid code", http.StatusUnauthorized)
+		return
+	}
+
+	user, ok := getUser(username)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	user.TotpSecret = secret
+	user.RecoveryCodes = hashes
+	if err := updateUser(user); err != nil {
+		log.Printf("WEBSERVER: Failed to save 2FA for %v: %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	enrollMu.Lock()
+	delete(pendingSecrets, username)
+	if req.EnrollToken != "" {
+		delete(enrollTokens, req.EnrollToken)
+	}
+	enrollMu.Unlock()
+
+	log.Printf("WEBSERVER: User %v enabled 2FA", username)
+	writeJSON(w, map[string]any{
+		"status":         "success",
+		"message":        "2FA enabled. Store your recovery codes somewhere safe, they are only shown once.",
+		"recovery_codes": codes,
+	})
+}
+
+// checkSecondFactor accepts a code from the app or a recovery code, a used recovery code gets removed
+// The user is looked up again, 2FA could have been reset or a code used since the login checked the key
+func checkSecondFactor(name string, otp string) bool {
+	if len(otp) == totpDigits {
+		user, ok := getUser(name)
+		return ok && user.TotpSecret != "" && validTOTP(name, user.TotpSecret, otp, true)
+	}
+
+	left, ok, err := burnRecoveryCode(name, otp)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to burn recovery code of %v: %v", name, err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+	log.Printf("WEBSERVER: User %v logged in with a recovery code, %v left", name, left)
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, data any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
@@ -0,0 +1,212 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mazarin/firewall"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// The admin api lives under /admin/api/ and needs the session cookie of a user with "admin": true in keys.json
+var adminMux = newAdminMux()
+
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/api/lockouts", adminListLockouts)
+	mux.HandleFunc("DELETE /admin/api/lockouts/{username}", adminClearLockout)
+	mux.HandleFunc("GET /admin/api/invites", adminListInvites)
+	mux.HandleFunc("POST /admin/api/invites", adminCreateInvite)
+	mux.HandleFunc("DELETE /admin/api/invites/{id}", adminDeleteInvite)
+	mux.HandleFunc("GET /admin/api/users", adminListUsers)
+	mux.HandleFunc("POST /admin/api/users/{username}/approve", adminApproveUser)
+	mux.HandleFunc("DELETE /admin/api/users/{username}", adminDeleteUser)
+	mux.HandleFunc("POST /admin/api/users/{username}/reset", adminResetUser)
+	mux.HandleFunc("DELETE /admin/api/users/{username}/apikeys/{id}", adminDeleteAPIKey)
+	mux.HandleFunc("POST /admin/api/users/{username}/kick", adminKickUser)
+	mux.HandleFunc("POST /admin/api/broadcast", adminBroadcast)
+	mux.HandleFunc("GET /admin/api/whitelist", adminListWhitelist)
+	mux.HandleFunc("DELETE /admin/api/whitelist/{ip}", adminRemoveWhitelist)
+	mux.HandleFunc("GET /admin/api/bans", adminListBans)
+	mux.HandleFunc("POST /admin/api/bans", adminBan)
+	mux.HandleFunc("DELETE /admin/api/bans/{target...}", adminUnban) //cidrs have a slash in them
+	return mux
+}
+
+func AdminHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := SessionUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if user, _ := getUser(username); !user.Admin {
+		log.Printf("WEBSERVER: Non admin user %v tried to use the admin api", username)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	r.Header.Set("X-Mazarin-User", username)
+	adminMux.ServeHTTP(w, r)
+}
+
+func adminListLockouts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Lockouts())
+}
+
+func adminClearLockout(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if !clearFailures(username) {
+		http.Error(w, "No failed logins for this user", http.StatusNotFound)
+		return
+	}
+	log.Printf("WEBSERVER: Admin %v cleared the lockout of %v", r.Header.Get("X-Mazarin-User"), username)
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+type InviteRequest struct {
+	Uses              int `json:"uses"`
+	ExpiresHours      int `json:"expires_hours"`
+	PermissionGroupID int `json:"permission_group_id"`
+}
+
+// UserInfo is what the admin api shows of a user, never the hashes
+type UserInfo struct {
+	Name              string `json:"name"`
+	Admin             bool   `json:"admin"`
+	Pending           bool   `json:"pending"`
+	Disabled          bool   `json:"disabled"`
+	PermissionGroupID int    `json:"permission_group_id"`
+	Totp              bool   `json:"totp"`
+	APIKeys           int    `json:"api_keys"`
+}
+
+func adminListInvites(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, listInvites())
+}
+
+func adminCreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req InviteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresHours < 0 {
+		http.Error(w, "expires_hours can't be negative, use 0 for an invite that never expires", http.StatusBadRequest)
+		return
+	}
+	//Users registered into a missing group could log in but reach no route
+	if !firewall.GroupExists(req.PermissionGroupID) {
+		http.Error(w, "Permission group not found", http.StatusBadRequest)
+		return
+	}
+
+	code, invite, err := newInvite(req.Uses, time.Duration(req.ExpiresHours)*time.Hour, req.PermissionGroupID, r.Header.Get("X-Mazarin-User"))
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to save invite: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("WEBSERVER: Admin %v created invite %v with %v uses", invite.CreatedBy, invite.ID, invite.UsesLeft)
+	writeJSON(w, map[string]any{
+		"code":   code,
+		"invite": invite,
+	})
+}
+
+func adminDeleteInvite(w http.ResponseWriter, r *http.Request) {
+	if !deleteInvite(r.PathValue("id")) {
+		http.Error(w, "Invite not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+func adminListUsers(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, Users())
+}
+
+func adminApproveUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := getUser(r.PathValue("username"))
+	if !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	user.Pending = false
+	if err := updateUser(user); err != nil {
+		log.Printf("WEBSERVER: Failed to approve user %v: %v", user.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("WEBSERVER: Admin %v approved user %v", r.Header.Get("X-Mazarin-User"), user.Name)
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+func adminDeleteUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if username == r.Header.Get("X-Mazarin-User") {
+		http.Error(w, "You can not delete yourself", http.StatusBadRequest)
+		return
+	}
+	if err := RemoveUser(username, r.Header.Get("X-Mazarin-User")); err != nil {
+		if errors.Is(err, errNoUser) {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("WEBSERVER: Failed to delete user %v: %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+// adminResetUser gives out a one time token, the user sets a new key with it on /reset.html
+func adminResetUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+	if _, ok := getUser(username); !ok {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+
+	token := newResetToken(username)
+	log.Printf("WEBSERVER: Admin %v created a password reset for %v", r.Header.Get("X-Mazarin-User"), username)
+	writeJSON(w, map[string]string{
+		"token":   token,
+		"path":    "/reset.html?token=" + url.QueryEscape(token),
+		"expires": time.Now().Add(resetTimeout).Format(time.RFC3339),
+	})
+}
+
+func adminDeleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !removeAPIKey(r.PathValue("username"), r.PathValue("id")) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+type MessageRequest struct {
+	Message string `json:"message"`
+}
+
+// adminKickUser logs a user out everywhere, the reason shows up on their login page
+func adminKickUser(w http.ResponseWriter, r *http.Request) {
+	var req MessageRequest
+	json.NewDecoder(r.Body).Decode(&req)
+
+	if err := KickUser(r.PathValue("username"), req.Message, r.Header.Get("X-Mazarin-User")); err != nil {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+func adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	var req MessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Message == "" {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	Broadcast(req.Message)
+	writeJSON(w, map[string]string{"status": "success"})
+}
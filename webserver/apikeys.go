@@ -0,0 +1,275 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"mazarin/firewall"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// API keys let scripts and launchers whitelist their ip without the browser login.
+// The key is "mzk_<id>_<secret>", only a sha256 of the secret is stored in keys.json
+type APIKey struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash,omitempty"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+}
+
+const (
+	apiKeyPrefix        = "mzk_"
+	ScopeSession        = "session" //may whitelist its ip through /api/session
+	defaultLeaseMinutes = 60
+)
+
+var apiScopes = []string{ScopeSession}
+
+type APIKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+type LeaseRequest struct {
+	DurationSeconds int `json:"duration_seconds"`
+}
+
+var accountMux = newAccountMux()
+
+func newAccountMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /account/apikeys", listAPIKeys)
+	mux.HandleFunc("POST /account/apikeys", createAPIKey)
+	mux.HandleFunc("DELETE /account/apikeys/{id}", deleteAPIKey)
+	return mux
+}
+
+var apiMux = newAPIMux()
+
+func newAPIMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/session", createLease)
+	mux.HandleFunc("POST /api/session/{lease}/renew", renewLease)
+	mux.HandleFunc("DELETE /api/session/{lease}", releaseLease)
+	return mux
+}
+
+// APIKeysHandler manages the api keys of the logged in user
+func APIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	username, ok := SessionUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	r.Header.Set("X-Mazarin-User", username)
+	accountMux.ServeHTTP(w, r)
+}
+
+// APIHandler serves the api for api key clients
+func APIHandler(w http.ResponseWriter, r *http.Request) {
+	apiMux.ServeHTTP(w, r)
+}
+
+func hashAPISecret(secret string) string {
+	return hashRecoveryCode(secret)
+}
+
+func listAPIKeys(w http.ResponseWriter, r *http.Request) {
+	user, _ := getUser(r.Header.Get("X-Mazarin-User"))
+	keys := make([]APIKey, 0, len(user.APIKeys))
+	for _, key := range user.APIKeys {
+		key.Hash = ""
+		keys = append(keys, key)
+	}
+	writeJSON(w, keys)
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req APIKeyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if !firewall.ValidateInput(req.Name, firewall.TypeUsername) {
+		http.Error(w, "Invalid name, use 1-64 letters, numbers, _ or -", http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{ScopeSession}
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(apiScopes, scope) {
+			http.Error(w, "Unknown scope: "+scope, http.StatusBadRequest)
+			return
+		}
+	}
+
+	idBytes := make([]byte, 4)
+	rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	secret := strings.TrimRight(randomToken(), "=")
+
+	user, ok := getUser(r.Header.Get("X-Mazarin-User"))
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	key := APIKey{
+		ID:      id,
+		Name:    req.Name,
+		Hash:    hashAPISecret(secret),
+		Scopes:  req.Scopes,
+		Created: time.Now().UTC(),
+	}
+	user.APIKeys = append(user.APIKeys, key)
+	if err := updateUser(user); err != nil {
+		log.Printf("WEBSERVER: Failed to save api key for %v: %v", user.Name, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("WEBSERVER: User %v created api key %v (%v)", user.Name, id, req.Name)
+	key.Hash = ""
+	writeJSON(w, map[string]any{
+		"key":     apiKeyPrefix + id + "_" + secret, //only shown this once
+		"api_key": key,
+	})
+}
+
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	if !removeAPIKey(r.Header.Get("X-Mazarin-User"), r.PathValue("id")) {
+		http.Error(w, "API key not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+// removeAPIKey deletes the key and ends every lease it made
+func removeAPIKey(username, id string) bool {
+	user, ok := getUser(username)
+	if !ok {
+		return false
+	}
+	index := slices.IndexFunc(user.APIKeys, func(key APIKey) bool { return key.ID == id })
+	if index < 0 {
+		return false
+	}
+	user.APIKeys = slices.Delete(slices.Clone(user.APIKeys), index, index+1)
+	if err := updateUser(user); err != nil {
+		log.Printf("WEBSERVER: Failed to delete api key %v of %v: %v", id, username, err)
+		return false
+	}
+	firewall.ReleaseKeyLeases(accessStore, ipHasSessions, id)
+	log.Printf("WEBSERVER: Deleted api key %v of %v", id, username)
+	return true
+}
+
+// apiKeyUser checks the "Authorization: Bearer mzk_..." header
+func apiKeyUser(r *http.Request, scope string) (User, APIKey, bool) {
+	raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	raw, found := strings.CutPrefix(raw, apiKeyPrefix)
+	if !found {
+		return User{}, APIKey{}, false
+	}
+	id, secret, found := strings.Cut(raw, "_")
+	if !found || id == "" || secret == "" {
+		return User{}, APIKey{}, false
+	}
+
+	hash := hashAPISecret(secret)
+	for _, user := range listUsers() {
+		for _, key := range user.APIKeys {
+			if key.ID != id {
+				continue
+			}
+			if subtle.ConstantTimeCompare([]byte(key.Hash), []byte(hash)) != 1 || !user.CanLogin() || !slices.Contains(key.Scopes, scope) {
+				return User{}, APIKey{}, false
+			}
+			return user, key, true
+		}
+	}
+	return User{}, APIKey{}, false
+}
+
+// leaseDuration clamps the requested duration to api_max_lease_minutes
+func leaseDuration(r *http.Request) (time.Duration, bool) {
+	var req LeaseRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return 0, false
+		}
+	}
+	maxMinutes := webConfig.APIMaxLeaseMinutes
+	if maxMinutes <= 0 {
+		maxMinutes = defaultLeaseMinutes
+	}
+	maxDuration := time.Duration(maxMinutes) * time.Minute
+	duration := time.Duration(req.DurationSeconds) * time.Second
+	if duration <= 0 || duration > maxDuration {
+		duration = maxDuration
+	}
+	return duration, true
+}
+
+func createLease(w http.ResponseWriter, r *http.Request) {
+	clientIP, err := firewall.ClientIP(r)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	user, key, ok := apiKeyUser(r, ScopeSession)
+	if !ok {
+		log.Printf("WEBSERVER: Invalid api key from IP %v", clientIP)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	duration, ok := leaseDuration(r)
+	if !ok {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	lease := firewall.GrantLease(accessStore, ipHasSessions, clientIP, user.Name, user.PermissionGroupID, key.ID, duration)
+	log.Printf("WEBSERVER: Api key %v of %v whitelisted IP %v", key.ID, user.Name, clientIP)
+	writeJSON(w, lease)
+}
+
+func renewLease(w http.ResponseWriter, r *http.Request) {
+	_, key, ok := apiKeyUser(r, ScopeSession)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	duration, ok := leaseDuration(r)
+	if !ok {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+
+	lease, ok := firewall.RenewLease(r.PathValue("lease"), key.ID, duration)
+	if !ok {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, lease)
+}
+
+func releaseLease(w http.ResponseWriter, r *http.Request) {
+	_, key, ok := apiKeyUser(r, ScopeSession)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if !firewall.ReleaseLease(accessStore, ipHasSessions, r.PathValue("lease"), key.ID) {
+		http.Error(w, "Lease not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, map[string]string{"status": "success"})
+}
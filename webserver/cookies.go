@@ -0,0 +1,155 @@
+package webserver
+
+import (
+	"log"
+	"mazarin/firewall"
+	"mazarin/sessions"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const SessionCookieName = sessions.CookieName
+
+func sessionDuration() time.Duration {
+	if webConfig == nil || webConfig.SessionHours <= 0 {
+		return 12 * time.Hour
+	}
+	return time.Duration(webConfig.SessionHours) * time.Hour
+}
+
+// secureCookie is true when the browser reached us over https, directly or through a trusted proxy.
+// A Secure cookie set over plain http gets dropped by the browser, so local http setups would never stay logged in
+func secureCookie(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	return firewall.FromTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// setSessionCookie gives the browser a session that is valid on every subdomain of cookie_domain
+func setSessionCookie(w http.ResponseWriter, r *http.Request, username, clientIP string) string {
+	duration := sessionDuration()
+	token := sessions.CreateSession(username, clientIP, duration)
+
+	cookie := &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    token,
+		Path:     "/",
+		Expires:  time.Now().Add(duration),
+		MaxAge:   int(duration.Seconds()),
+		Secure:   secureCookie(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode, //Lax so the cookie survives the redirect back from the login page
+	}
+	if webConfig != nil {
+		cookie.Domain = webConfig.CookieDomain
+	}
+	http.SetCookie(w, cookie)
+	return token
+}
+
+// SessionUser returns the user of the session cookie on this request
+func SessionUser(r *http.Request) (string, bool) {
+	username, _, ok := cookieSession(r)
+	return username, ok
+}
+
+// sessionUserOnIP is SessionUser for cookies that were made on clientIP, a cookie that got copied elsewhere gets nothing
+func sessionUserOnIP(r *http.Request, clientIP string) (string, bool) {
+	username, ip, ok := cookieSession(r)
+	if !ok || ip != clientIP {
+		return "", false
+	}
+	return username, true
+}
+
+// cookieSession returns the user and the login ip of the session cookie on this request
+func cookieSession(r *http.Request) (string, string, bool) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return "", "", false
+	}
+	username, ip, ok := sessions.ValidateSession(cookie.Value)
+	if !ok {
+		return "", "", false
+	}
+
+	//The user could have been removed or disabled since the session was made
+	if user, exists := getUser(username); !exists || !user.CanLogin() {
+		return "", "", false
+	}
+	return username, ip, true
+}
+
+// safeRedirect only allows sending users back to our own domains, otherwise the login page is an open redirect
+func safeRedirect(redirect string) string {
+	if redirect == "" || webConfig == nil {
+		return ""
+	}
+	target, err := url.Parse(redirect)
+	if err != nil || (target.Scheme != "https" && target.Scheme != "http") {
+		return ""
+	}
+
+	host := strings.ToLower(target.Hostname())
+	domain := strings.ToLower(strings.TrimPrefix(webConfig.CookieDomain, "."))
+	if host == strings.ToLower(webConfig.ListenURL) || (domain != "" && (host == domain || strings.HasSuffix(host, "."+domain))) {
+		return target.String()
+	}
+	return ""
+}
+
+// clearSessionCookie ends the session of this request and tells the browser to drop the cookie
+func clearSessionCookie(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(SessionCookieName)
+	if err != nil {
+		return
+	}
+	sessions.DeleteSession(cookie.Value)
+
+	expired := &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   secureCookie(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if webConfig != nil {
+		expired.Domain = webConfig.CookieDomain
+	}
+	http.SetCookie(w, expired)
+}
+
+// RenewHandler swaps the login cookie for a fresh one, open streams of that login get the new expiry
+func RenewHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	username, ok := SessionUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	clientIP, err := firewall.ClientIP(r)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	oldCookie, _ := r.Cookie(SessionCookieName)
+	newToken := setSessionCookie(w, r, username, clientIP)
+	sessions.DeleteSession(oldCookie.Value)
+	expires := time.Now().Add(sessionDuration())
+	renewSessions(oldCookie.Value, newToken, expires)
+
+	log.Printf("WEBSERVER: User %v renewed their session from %v", username, clientIP)
+	writeJSON(w, map[string]string{
+		"status":     "success",
+		"expires_at": expires.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,195 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Every open /sse stream is a session on this bus. Events are dropped for clients that are too slow to keep up,
+// ending a session has its own channel so that never gets lost
+const (
+	eventBuffer = 16
+	renewBefore = 10 * time.Minute //when the renew prompt shows up
+)
+
+type sseEvent struct {
+	Name string
+	Data any
+}
+
+type sseSession struct {
+	id      uint64
+	ip      string
+	user    string
+	group   int
+	token   string //login cookie, empty when the ip was whitelisted without one
+	expires time.Time
+	started time.Time
+	events  chan sseEvent
+	end     chan string //reason the session got ended
+}
+
+var (
+	busMu       = sync.Mutex{}
+	busSessions = make(map[uint64]*sseSession)
+	busNextID   uint64
+)
+
+func registerSession(ip, user string, group int, token string, expires time.Time) *sseSession {
+	busMu.Lock()
+	defer busMu.Unlock()
+
+	busNextID++
+	session := &sseSession{
+		id:      busNextID,
+		ip:      ip,
+		user:    user,
+		group:   group,
+		token:   token,
+		expires: expires,
+		started: time.Now(),
+		events:  make(chan sseEvent, eventBuffer),
+		end:     make(chan string, 1),
+	}
+
+	//allowed_sessions, the oldest streams of this user make room for the new one
+	if allowed := userAllowedSessions(user); allowed > 0 {
+		var own []*sseSession
+		for _, other := range busSessions {
+			if other.user == user {
+				own = append(own, other)
+			}
+		}
+		for len(own) >= allowed {
+			oldest := 0
+			for i := range own {
+				if own[i].id < own[oldest].id {
+					oldest = i
+				}
+			}
+			endLocked(own[oldest], "session replaced by a newer login")
+			own = append(own[:oldest], own[oldest+1:]...)
+		}
+	}
+
+	busSessions[session.id] = session
+	return session
+}
+
+// unregisterSession returns how many streams the user still has open on this ip
+func unregisterSession(session *sseSession) int {
+	busMu.Lock()
+	defer busMu.Unlock()
+	delete(busSessions, session.id)
+
+	remaining := 0
+	for _, other := range busSessions {
+		if other.ip == session.ip && other.user == session.user {
+			remaining++
+		}
+	}
+	return remaining
+}
+
+func ipHasSessions(ip, user string) bool {
+	busMu.Lock()
+	defer busMu.Unlock()
+	for _, session := range busSessions {
+		if session.ip == ip && session.user == user {
+			return true
+		}
+	}
+	return false
+}
+
+func userAllowedSessions(name string) int {
+	user, _ := getUser(name)
+	return user.AllowedSessions
+}
+
+// publish sends an event to every matching session without waiting on any of them
+func publish(match func(*sseSession) bool, name string, data any) {
+	publishEach(name, func(s *sseSession) (any, bool) { return data, match(s) })
+}
+
+// publishEach is publish with its own data for every session, data returns false for sessions that get nothing
+func publishEach(name string, data func(*sseSession) (any, bool)) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	for _, session := range busSessions {
+		payload, ok := data(session)
+		if !ok {
+			continue
+		}
+		select {
+		case session.events <- sseEvent{Name: name, Data: payload}:
+		default:
+			log.Printf("WEBSERVER: Dropped %v event for slow sse client %v", name, session.ip)
+		}
+	}
+}
+
+func endSessions(match func(*sseSession) bool, reason string) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	for _, session := range busSessions {
+		if match(session) {
+			endLocked(session, reason)
+		}
+	}
+}
+
+func endLocked(session *sseSession, reason string) {
+	select {
+	case session.end <- reason:
+	default: //already ending
+	}
+}
+
+func endSSE(ips []string, reason string) {
+	set := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		set[ip] = true
+	}
+	endSessions(func(s *sseSession) bool { return set[s.ip] }, reason)
+}
+
+// Broadcast shows a notice on every open login page and client
+func Broadcast(message string) {
+	publish(func(*sseSession) bool { return true }, "notice", map[string]string{"message": message})
+	log.Printf("WEBSERVER: Broadcast sent: %v", message)
+}
+
+// renewSessions moves the expiry of the streams that belong to a renewed login cookie
+func renewSessions(oldToken, newToken string, expires time.Time) {
+	busMu.Lock()
+	defer busMu.Unlock()
+	for _, session := range busSessions {
+		if session.token == oldToken {
+			session.token = newToken
+			session.expires = expires
+		}
+	}
+}
+
+func (s *sseSession) expiresAt() time.Time {
+	busMu.Lock()
+	defer busMu.Unlock()
+	return s.expires
+}
+
+func writeEvent(w http.ResponseWriter, flusher http.Flusher, name string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, payload); err != nil {
+		return err
+	}
+	flusher.Flush()
+	return nil
+}
@@ -0,0 +1,103 @@
+package webserver
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// After an sse stream drops the ip stays whitelisted for grace_period_seconds,
+// so a short network hiccup doesnt kill the game connections of that ip
+type pendingCleanup struct {
+	timer *time.Timer
+}
+
+// Removals are per user, other users on the same ip have their own streams
+type cleanupKey struct {
+	ip   string
+	user string
+}
+
+var (
+	graceMu         = sync.Mutex{}
+	pendingCleanups = make(map[cleanupKey]*pendingCleanup) //removal waiting for the grace period
+)
+
+func gracePeriod() time.Duration {
+	if webConfig == nil || webConfig.GracePeriodSeconds <= 0 {
+		return 0
+	}
+	return time.Duration(webConfig.GracePeriodSeconds) * time.Second
+}
+
+// scheduleCleanup removes the user from the ip after the grace period, unless a stream of the same user comes back first
+func scheduleCleanup(ip, user string) {
+	scheduleCleanupAfter(ip, user, gracePeriod())
+}
+
+func scheduleCleanupAfter(ip, user string, grace time.Duration) {
+	if grace == 0 {
+		cleanupConnection(ip, user)
+		return
+	}
+
+	key := cleanupKey{ip, user}
+	graceMu.Lock()
+	defer graceMu.Unlock()
+	if pending, ok := pendingCleanups[key]; ok {
+		pending.timer.Stop()
+	}
+	pending := &pendingCleanup{}
+	pending.timer = time.AfterFunc(grace, func() {
+		graceMu.Lock()
+		if pendingCleanups[key] != pending {
+			graceMu.Unlock()
+			return
+		}
+		delete(pendingCleanups, key)
+		graceMu.Unlock()
+
+		//The user logged in again on this ip in the meantime
+		if ipHasSessions(ip, user) {
+			return
+		}
+		log.Printf("WEBSERVER: Grace period for %v on IP %v is over", user, ip)
+		cleanupConnection(ip, user)
+	})
+	pendingCleanups[key] = pending
+	log.Printf("WEBSERVER: IP %v keeps its whitelist for %v while %v reconnects", ip, grace, user)
+}
+
+// cancelCleanup is called by a new stream or login of the user, returns true when it took over a pending removal
+func cancelCleanup(ip, user string) bool {
+	graceMu.Lock()
+	defer graceMu.Unlock()
+	key := cleanupKey{ip, user}
+	pending, ok := pendingCleanups[key]
+	if !ok {
+		return false
+	}
+	pending.timer.Stop()
+	delete(pendingCleanups, key)
+	return true
+}
+
+// dropCleanup forgets the pending removals of every user of these ips, used when the ips are removed
+func dropCleanup(ips ...string) {
+	graceMu.Lock()
+	defer graceMu.Unlock()
+	for _, ip := range ips {
+		for key, pending := range pendingCleanups {
+			if key.ip == ip {
+				pending.timer.Stop()
+				delete(pendingCleanups, key)
+			}
+		}
+	}
+}
+
+// cleanupNow skips the grace period, for streams the server ended on purpose
+func cleanupNow(ip, user string) {
+	cancelCleanup(ip, user)
+	cleanupConnection(ip, user)
+}
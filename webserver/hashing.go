@@ -1,65 +1,231 @@
 package webserver
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"log"
+	"fmt"
+	"mazarin/config"
 	"mazarin/firewall"
 	"os"
+	"strings"
 
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Name            string `json:"name"`
-	Hash            string `json:"hash"`
-	AllowedSessions int    `json:"allowed_sessions"`
+	Name              string   `json:"name"`
+	Hash              string   `json:"hash"`
+	AllowedSessions   int      `json:"allowed_sessions"`
+	PermissionGroupID int      `json:"permission_group_id,omitempty"` //0 means every route
+	RateLimit         int64    `json:"rate_limit"`
+	RequireTotp       bool     `json:"require_totp,omitempty"`
+	Admin             bool     `json:"admin,omitempty"`
+	Pending           bool     `json:"pending,omitempty"` //registered but not approved yet
+	Disabled          bool     `json:"disabled,omitempty"`
+	TotpSecret        string   `json:"totp_secret,omitempty"`
+	RecoveryCodes     []string `json:"recovery_codes,omitempty"`
+	APIKeys           []APIKey `json:"api_keys,omitempty"`
 }
 
 type UsersData struct {
 	Users []User `json:"users"`
 }
 
-func LoadKeys(fileDir string) map[string]User {
-	var usersMap = make(map[string]User)
+// CanLogin is false for users that still need approval or got disabled
+func (u User) CanLogin() bool {
+	return !u.Pending && !u.Disabled
+}
 
+// readKeys parses and checks keys.json, on any error nothing is returned so the caller keeps its old users
+func readKeys(fileDir string) (map[string]User, error) {
 	data, err := os.ReadFile(fileDir + "/keys.json")
 	if err != nil {
-		log.Println("HASHING: LoadKeys error ", err)
-		return nil
+		return nil, err
 	}
 
 	var usersData UsersData
 	err = json.Unmarshal(data, &usersData)
 	if err != nil {
-		log.Println("HASHING: Unmarshal error ", err)
-		return nil
+		return nil, fmt.Errorf("unmarshal error: %w", err)
 	}
+	return usersByName(usersData.Users)
+}
 
-	for _, users := range usersData.Users {
+// usersByName refuses users without a name and names that are used twice
+func usersByName(list []User) (map[string]User, error) {
+	var usersMap = make(map[string]User)
+	for _, users := range list {
+		if users.Name == "" {
+			return nil, errors.New("a user has no name")
+		}
 		_, ok := usersMap[users.Name]
 		if ok {
-			log.Printf("HASHING: Cant have two users named '%v' ", users.Name)
-			return nil
+			return nil, fmt.Errorf("cant have two users named '%v'", users.Name)
 		}
 		usersMap[users.Name] = users
 	}
 
-	return usersMap
+	return usersMap, nil
+}
+
+// The hashing policy new hashes are made with, older hashes get upgraded on login
+var hashPolicy = config.HashingConfig{Algorithm: "bcrypt", BcryptCost: bcrypt.DefaultCost}
+
+const (
+	argon2SaltLen = 16
+	argon2KeyLen  = 32
+)
+
+// SetHashPolicy fills in the defaults for everything left empty in the config
+func SetHashPolicy(conf config.HashingConfig) error {
+	switch conf.Algorithm {
+	case "", "bcrypt":
+		conf.Algorithm = "bcrypt"
+		if conf.BcryptCost == 0 {
+			conf.BcryptCost = bcrypt.DefaultCost
+		}
+		if conf.BcryptCost < bcrypt.MinCost || conf.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt_cost has to be between %v and %v", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	case "argon2id":
+		if conf.Argon2Memory == 0 {
+			conf.Argon2Memory = 19456 //19 MiB, the OWASP minimum
+		}
+		if conf.Argon2Time == 0 {
+			conf.Argon2Time = 2
+		}
+		if conf.Argon2Threads == 0 {
+			conf.Argon2Threads = 1
+		}
+	default:
+		return fmt.Errorf("unknown hashing algorithm %q, use bcrypt or argon2id", conf.Algorithm)
+	}
+	hashPolicy = conf
+	makeDummyHash(conf)
+	return nil
 }
 
 func HashKey(key string) (string, error) {
-	if !firewall.ValidateInput(key, "password") {
-		return "", errors.New("ERROR: Invalid password format. Only use letters,numbers and these symbols: _:/?#@!$&'()*+,;=- Between 12 and 64 characters")
+	if !validNewKey(key) {
+		return "", fmt.Errorf("ERROR: Invalid password format, use %v", keyRules())
+	}
+	return hashPassword(key)
+}
+
+// validNewKey checks a key that is about to be hashed. bcrypt only uses the first 72 bytes, so longer keys need argon2id
+func validNewKey(key string) bool {
+	if hashPolicy.Algorithm == "argon2id" {
+		return firewall.ValidateInput(key, firewall.TypeLongPassword)
+	}
+	return firewall.ValidateInput(key, firewall.TypePassword)
+}
+
+// keyRules is what validNewKey takes, for the error messages
+func keyRules() string {
+	if hashPolicy.Algorithm == "argon2id" {
+		return "12-256 letters, numbers and _:/?#@!$&'()*+,;=-"
+	}
+	return "12-64 letters, numbers and _:/?#@!$&'()*+,;=-"
+}
+
+func hashPassword(key string) (string, error) {
+	return hashWith(key, hashPolicy)
+}
+
+func hashWith(key string, policy config.HashingConfig) (string, error) {
+	if policy.Algorithm == "argon2id" {
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		sum := argon2.IDKey([]byte(key), salt, policy.Argon2Time, policy.Argon2Memory, policy.Argon2Threads, argon2KeyLen)
+		//PHC string format, the same one the argon2 cli and most libraries use
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, policy.Argon2Memory, policy.Argon2Time, policy.Argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(sum)), nil
 	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(key), bcrypt.DefaultCost)
+	hash, err := bcrypt.GenerateFromPassword([]byte(key), policy.BcryptCost)
 	return string(hash), err
 }
 
+// hashParams are the settings a stored hash was made with, as a policy that makes the same kind of hash
+func hashParams(hash string) (config.HashingConfig, bool) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, _, _, err := parseArgon2(hash)
+		return params, err == nil
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return config.HashingConfig{Algorithm: "bcrypt", BcryptCost: cost}, err == nil
+}
+
+// ValidateUserHash detects the algorithm from the stored hash, a wrong password is false without an error
 func ValidateUserHash(password string, hash string) (bool, error) {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		params, salt, sum, err := parseArgon2(hash)
+		if err != nil {
+			return false, err
+		}
+		check := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, uint32(len(sum)))
+		return subtle.ConstantTimeCompare(check, sum) == 1, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 	if err == nil {
 		return true, nil
 	}
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	}
 	return false, err
 }
+
+// needsRehash is true for hashes made with another algorithm or weaker settings than the current policy
+func needsRehash(hash string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		if hashPolicy.Algorithm != "argon2id" {
+			return true
+		}
+		params, salt, sum, err := parseArgon2(hash)
+		return err != nil || params.Argon2Memory < hashPolicy.Argon2Memory || params.Argon2Time < hashPolicy.Argon2Time ||
+			params.Argon2Threads < hashPolicy.Argon2Threads || len(salt) < argon2SaltLen || len(sum) < argon2KeyLen
+	}
+
+	if hashPolicy.Algorithm != "bcrypt" {
+		return true
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost < hashPolicy.BcryptCost
+}
+
+func parseArgon2(hash string) (config.HashingConfig, []byte, []byte, error) {
+	var params config.HashingConfig
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2id version")
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Argon2Memory, &params.Argon2Time, &params.Argon2Threads); err != nil {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+	if params.Argon2Time == 0 || params.Argon2Threads == 0 {
+		return params, nil, nil, errors.New("invalid argon2id parameters")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	sum, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(sum) == 0 {
+		return params, nil, nil, errors.New("invalid argon2id hash")
+	}
+	params.Algorithm = "argon2id"
+	return params, salt, sum, nil
+}
@@ -0,0 +1,158 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"maps"
+	"mazarin/config"
+	"mazarin/firewall"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The health checker dials every proxy target, logged in users get told when a route they can reach goes up or down
+const (
+	healthInterval = 30 * time.Second
+	healthTimeout  = 3 * time.Second
+)
+
+type RouteHealth struct {
+	Route   string `json:"route"`
+	Healthy bool   `json:"healthy"`
+}
+
+type healthTarget struct {
+	route   *config.ProxyConfig
+	name    string
+	address string
+}
+
+var (
+	healthMu      = sync.Mutex{}
+	healthTargets []healthTarget
+	healthState   = make(map[string]bool) //route name -> last result
+)
+
+// WatchHealth checks the targets until ctx is done
+func WatchHealth(ctx context.Context, proxies []*config.ProxyConfig) {
+	var targets []healthTarget
+	seen := make(map[string]bool)
+	for _, route := range proxies {
+		address := healthAddress(route)
+		name := RouteName(route)
+		if address == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		targets = append(targets, healthTarget{route: route, name: name, address: address})
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	healthMu.Lock()
+	healthTargets = targets
+	healthMu.Unlock()
+
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		checkHealth(ctx, targets)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func checkHealth(ctx context.Context, targets []healthTarget) {
+	dialer := net.Dialer{Timeout: healthTimeout}
+	for _, target := range targets {
+		conn, err := dialer.DialContext(ctx, "tcp", target.address)
+		healthy := err == nil
+		if healthy {
+			conn.Close()
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		healthMu.Lock()
+		previous, known := healthState[target.name]
+		healthState[target.name] = healthy
+		healthMu.Unlock()
+
+		if known && previous != healthy {
+			log.Printf("WEBSERVER: Route %v is now healthy: %v", target.name, healthy)
+			route := target.route
+			publish(func(s *sseSession) bool { return firewall.GroupAllows(s.group, route) }, "health",
+				[]RouteHealth{{Route: target.name, Healthy: healthy}})
+		}
+	}
+}
+
+// sendHealth gives a new stream the current state of every route it can reach
+func sendHealth(w http.ResponseWriter, flusher http.Flusher, session *sseSession) {
+	healthMu.Lock()
+	var list []RouteHealth
+	for _, target := range healthTargets {
+		healthy, known := healthState[target.name]
+		if known && firewall.GroupAllows(session.group, target.route) {
+			list = append(list, RouteHealth{Route: target.name, Healthy: healthy})
+		}
+	}
+	healthMu.Unlock()
+
+	if len(list) > 0 {
+		writeEvent(w, flusher, "health", list)
+	}
+}
+
+// Health is the last check result of every checked route by name, routes that were never checked are missing
+func Health() map[string]bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	return maps.Clone(healthState)
+}
+
+// healthAddress is the host:port to dial, empty for routes without a network target
+func healthAddress(route *config.ProxyConfig) string {
+	if route.Protocol == "udp" || route.Type == "static" || route.Type == "func" || route.Type == "redirect" {
+		return ""
+	}
+	target := route.TargetAddr
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return ""
+		}
+		if u.Port() != "" {
+			return u.Host
+		}
+		if u.Scheme == "https" {
+			return net.JoinHostPort(u.Hostname(), "443")
+		}
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		return ""
+	}
+	return target
+}
+
+// RouteName is how routes show up in health events and listings
+func RouteName(route *config.ProxyConfig) string {
+	switch {
+	case route.Name != "":
+		return route.Name
+	case route.ListenUrl != "":
+		return route.ListenUrl
+	default:
+		return route.Protocol + route.Port
+	}
+}
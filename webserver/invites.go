@@ -0,0 +1,182 @@
+package webserver
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Invites are made by admins and let people create their own account on /register.
+// Only a sha256 of the code is stored, the id is the start of that hash so admins can list and delete them
+type Invite struct {
+	ID                string    `json:"id"`
+	Hash              string    `json:"hash"`
+	UsesLeft          int       `json:"uses_left"`
+	Expires           time.Time `json:"expires,omitzero"`
+	PermissionGroupID int       `json:"permission_group_id,omitempty"`
+	CreatedBy         string    `json:"created_by"`
+}
+
+type invitesFile struct {
+	Invites []Invite `json:"invites"`
+}
+
+var (
+	invitesMu = sync.Mutex{}
+	invites   = make(map[string]Invite) //hash -> invite
+)
+
+var errInvalidInvite = errors.New("invalid or used invite code")
+
+func loadInvites(keysDir string) {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+
+	invites = make(map[string]Invite)
+	data, err := os.ReadFile(filepath.Join(keysDir, "invites.json"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Println("WEBSERVER: Failed to read invites.json ", err)
+		}
+		return
+	}
+
+	var file invitesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		log.Println("WEBSERVER: Unmarshal invites.json error ", err)
+		return
+	}
+	for _, invite := range file.Invites {
+		invites[invite.Hash] = invite
+	}
+}
+
+// newInvite returns the plain code, this is the only time anyone sees it
+func newInvite(uses int, validFor time.Duration, groupID int, createdBy string) (string, Invite, error) {
+	raw := make([]byte, 10)
+	rand.Read(raw)
+	code := strings.ToLower(b32.EncodeToString(raw)) //16 chars
+	code = code[:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:]
+
+	hash := hashRecoveryCode(code)
+	invite := Invite{
+		ID:                hash[:8],
+		Hash:              hash,
+		UsesLeft:          max(uses, 1),
+		PermissionGroupID: groupID,
+		CreatedBy:         createdBy,
+	}
+	if validFor > 0 {
+		invite.Expires = time.Now().Add(validFor)
+	}
+
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+	invites[hash] = invite
+	if err := saveInvitesLocked(); err != nil {
+		delete(invites, hash)
+		return "", Invite{}, err
+	}
+	return code, invite, nil
+}
+
+// useInvite takes one use of the code, refundInvite gives it back when creating the user failed
+func useInvite(code string) (Invite, error) {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+
+	hash := hashRecoveryCode(code)
+	invite, ok := invites[hash]
+	if !ok || invite.UsesLeft <= 0 || (!invite.Expires.IsZero() && time.Now().After(invite.Expires)) {
+		return Invite{}, errInvalidInvite
+	}
+
+	invite.UsesLeft--
+	if invite.UsesLeft == 0 {
+		delete(invites, hash)
+	} else {
+		invites[hash] = invite
+	}
+	if err := saveInvitesLocked(); err != nil {
+		invite.UsesLeft++
+		invites[hash] = invite
+		return Invite{}, err
+	}
+	return invite, nil
+}
+
+func refundInvite(invite Invite) {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+
+	if current, ok := invites[invite.Hash]; ok {
+		invite = current
+	}
+	invite.UsesLeft++
+	invites[invite.Hash] = invite
+	if err := saveInvitesLocked(); err != nil {
+		log.Printf("WEBSERVER: Failed to refund invite %v: %v", invite.ID, err)
+	}
+}
+
+func deleteInvite(id string) bool {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+
+	for hash, invite := range invites {
+		if invite.ID == id {
+			delete(invites, hash)
+			if err := saveInvitesLocked(); err != nil {
+				invites[hash] = invite
+				log.Printf("WEBSERVER: Failed to delete invite %v: %v", id, err)
+				return false
+			}
+			return true
+		}
+	}
+	return false
+}
+
+func listInvites() []Invite {
+	invitesMu.Lock()
+	defer invitesMu.Unlock()
+
+	list := make([]Invite, 0, len(invites))
+	for _, invite := range invites {
+		list = append(list, invite)
+	}
+	slices.SortFunc(list, func(a, b Invite) int { return strings.Compare(a.ID, b.ID) })
+	return list
+}
+
+// Same tmp file + rename as keys.json, callers hold invitesMu
+func saveInvitesLocked() error {
+	if webConfig == nil {
+		return errors.New("webserver not initialized")
+	}
+
+	file := invitesFile{Invites: make([]Invite, 0, len(invites))}
+	for _, invite := range invites {
+		file.Invites = append(file.Invites, invite)
+	}
+	slices.SortFunc(file.Invites, func(a, b Invite) int { return strings.Compare(a.ID, b.ID) })
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(webConfig.KeysDir, "invites.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,201 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"mazarin/config"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Failed logins are counted per username, unknown names included so a lock says nothing about which users exist
+const (
+	defaultMaxAttempts    = 5
+	defaultLockMinutes    = 1
+	defaultMaxLockMinutes = 60
+	failureStep           = 500 * time.Millisecond //every failure in a row adds this to the response time
+	maxFailureDelay       = 5 * time.Second
+	forgetFailuresAfter   = 24 * time.Hour
+	maxTrackedNames       = 10000
+)
+
+type lockEntry struct {
+	Failures    int
+	Locks       int
+	LockedUntil time.Time
+	LastFailure time.Time
+}
+
+type LockoutInfo struct {
+	Username    string    `json:"username"`
+	Failures    int       `json:"failures"`
+	Locks       int       `json:"locks"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+var (
+	lockMu   = sync.Mutex{}
+	lockouts = make(map[string]*lockEntry)
+
+	dummyMu     = sync.Mutex{}
+	dummyHashes = make(map[config.HashingConfig]string) //settings -> hash made with them
+)
+
+// checkPassword always hashes, for unknown users against a dummy hash with the settings of the stored keys, so both take the same time
+func checkPassword(user User, exists bool, password string) bool {
+	hash := user.Hash
+	if !exists {
+		hash = dummyHash()
+	}
+	ok, err := ValidateUserHash(password, hash)
+	if err != nil && exists {
+		log.Printf("WEBSERVER: Stored hash of %v is invalid: %v", user.Name, err)
+	}
+	return ok && exists
+}
+
+// dummyHash uses the settings most stored keys have, those are the ones an unknown name gets compared against.
+// The policy can be newer than the keys (they only get rehashed on login), so it is only used when there are no users
+func dummyHash() string {
+	params := hashPolicy
+	counts := make(map[config.HashingConfig]int)
+	for _, user := range listUsers() {
+		stored, ok := hashParams(user.Hash)
+		if !ok {
+			continue
+		}
+		counts[stored]++
+		if counts[stored] > counts[params] {
+			params = stored
+		}
+	}
+
+	return makeDummyHash(params)
+}
+
+// makeDummyHash returns the dummy hash for these settings. SetHashPolicy and loading the users build them ahead,
+// so the first unknown name doesn't pay for an extra hash and stand out by its timing
+func makeDummyHash(params config.HashingConfig) string {
+	dummyMu.Lock()
+	defer dummyMu.Unlock()
+	if hash, ok := dummyHashes[params]; ok {
+		return hash
+	}
+	hash, err := hashWith("mazarin-dummy-password", params)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to make a dummy hash: %v", err)
+	}
+	dummyHashes[params] = hash
+	return hash
+}
+
+// makeDummyHashes builds the dummy hashes for every setting the stored keys use
+func makeDummyHashes(users map[string]User) {
+	for _, user := range users {
+		if params, ok := hashParams(user.Hash); ok {
+			makeDummyHash(params)
+		}
+	}
+}
+
+// lockedUntil returns when the lock on a username ends, zero if it is not locked
+func lockedUntil(username string) time.Time {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	entry, ok := lockouts[username]
+	if !ok || time.Now().After(entry.LockedUntil) {
+		return time.Time{}
+	}
+	return entry.LockedUntil
+}
+
+// registerFailure counts a failed login and returns how long the response should be delayed
+func registerFailure(username string) time.Duration {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+
+	now := time.Now()
+	if len(lockouts) > maxTrackedNames {
+		pruneLockouts(now)
+	}
+	entry, ok := lockouts[username]
+	if !ok || now.Sub(entry.LastFailure) > forgetFailuresAfter {
+		entry = &lockEntry{}
+		lockouts[username] = entry
+	}
+	entry.Failures++
+	entry.LastFailure = now
+
+	//Earlier locks keep counting towards the delay
+	maxAttempts, lockTime, maxLockTime := lockoutSettings()
+	delay := min(time.Duration(entry.Failures+entry.Locks*maxAttempts)*failureStep, maxFailureDelay)
+	if entry.Failures >= maxAttempts {
+		entry.Locks++
+		entry.Failures = 0
+		lock := min(lockTime<<(min(entry.Locks, 16)-1), maxLockTime)
+		entry.LockedUntil = now.Add(lock)
+		log.Printf("WEBSERVER: Account %v locked for %v after too many failed logins", username, lock)
+	}
+	return delay
+}
+
+func clearFailures(username string) bool {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+	_, ok := lockouts[username]
+	delete(lockouts, username)
+	return ok
+}
+
+// Lockouts lists every username with failed logins, locked or not
+func Lockouts() []LockoutInfo {
+	lockMu.Lock()
+	defer lockMu.Unlock()
+
+	list := make([]LockoutInfo, 0, len(lockouts))
+	for name, entry := range lockouts {
+		list = append(list, LockoutInfo{
+			Username:    name,
+			Failures:    entry.Failures,
+			Locks:       entry.Locks,
+			LockedUntil: entry.LockedUntil,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Username < list[j].Username })
+	return list
+}
+
+func pruneLockouts(now time.Time) {
+	for name, entry := range lockouts {
+		if now.After(entry.LockedUntil) && now.Sub(entry.LastFailure) > forgetFailuresAfter {
+			delete(lockouts, name)
+		}
+	}
+}
+
+func lockoutSettings() (int, time.Duration, time.Duration) {
+	maxAttempts, lockMinutes, maxLockMinutes := defaultMaxAttempts, defaultLockMinutes, defaultMaxLockMinutes
+	if webConfig != nil {
+		if webConfig.Lockout.MaxAttempts > 0 {
+			maxAttempts = webConfig.Lockout.MaxAttempts
+		}
+		if webConfig.Lockout.LockMinutes > 0 {
+			lockMinutes = webConfig.Lockout.LockMinutes
+		}
+		if webConfig.Lockout.MaxLockMinutes > 0 {
+			maxLockMinutes = webConfig.Lockout.MaxLockMinutes
+		}
+	}
+	return maxAttempts, time.Duration(lockMinutes) * time.Minute, time.Duration(maxLockMinutes) * time.Minute
+}
+
+// sleepCtx waits out a failure delay, stops early when the client is gone
+func sleepCtx(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
@@ -0,0 +1,34 @@
+package webserver
+
+import (
+	"mazarin/config"
+	"testing"
+	"time"
+)
+
+// This test checks that every lock in a row doubles the lock time, up to max_lock_minutes.
+// A lock lasts minutes, so it is ended by hand instead of waiting for it
+func TestLockDoubles(t *testing.T) {
+	saved := webConfig
+	webConfig = &config.WebserverConfig{Lockout: config.LockoutConfig{MaxAttempts: 2, LockMinutes: 1, MaxLockMinutes: 5}}
+	t.Cleanup(func() {
+		webConfig = saved
+		clearFailures("lock_doubles")
+	})
+
+	for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		registerFailure("lock_doubles")
+		if !lockedUntil("lock_doubles").IsZero() {
+			t.Fatal("Locked before max_attempts")
+		}
+		registerFailure("lock_doubles")
+		left := time.Until(lockedUntil("lock_doubles"))
+		if left <= want-time.Second || left > want {
+			t.Errorf("Lock %v: got %v, want %v", lockouts["lock_doubles"].Locks, left, want)
+		}
+
+		lockMu.Lock()
+		lockouts["lock_doubles"].LockedUntil = time.Now().Add(-time.Second)
+		lockMu.Unlock()
+	}
+}
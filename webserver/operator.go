@@ -0,0 +1,181 @@
+package webserver
+
+import (
+	"cmp"
+	"errors"
+	"log"
+	"mazarin/access"
+	"mazarin/firewall"
+	"slices"
+	"time"
+)
+
+// Operations shared by the admin api and the control socket, by is who asked for it and only ends up in the logs
+
+var (
+	errNoUser  = errors.New("user not found")
+	errNoGroup = errors.New("permission group not found")
+)
+
+// SessionInfo is an open login page or client
+type SessionInfo struct {
+	ID      uint64    `json:"id"`
+	User    string    `json:"user"`
+	IP      string    `json:"ip"`
+	Group   int       `json:"permission_group_id"`
+	Started time.Time `json:"started"`
+	Expires time.Time `json:"expires_at"`
+}
+
+func Sessions() []SessionInfo {
+	busMu.Lock()
+	defer busMu.Unlock()
+	list := make([]SessionInfo, 0, len(busSessions))
+	for _, s := range busSessions {
+		list = append(list, SessionInfo{ID: s.id, User: s.user, IP: s.ip, Group: s.group, Started: s.started, Expires: s.expires})
+	}
+	slices.SortFunc(list, func(a, b SessionInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return list
+}
+
+// KickUser logs a user out everywhere, the message shows up on their login page
+func KickUser(username, message, by string) error {
+	if _, ok := getUser(username); !ok {
+		return errNoUser
+	}
+	reason := "kicked by admin"
+	if message != "" {
+		reason += ": " + message
+	}
+	revokeUser(username, reason)
+	log.Printf("WEBSERVER: %v kicked %v", by, username)
+	return nil
+}
+
+// RemoveWhitelist takes an ip or cidr off the whitelist, its login pages get closed too
+func RemoveWhitelist(target, by string) bool {
+	if normal, _, err := access.ParseTarget(target); err == nil {
+		target = normal
+	}
+	if _, ok := accessStore.Lookup(target); !ok {
+		return false
+	}
+	dropCleanup(target)
+	endSSE([]string{target}, "removed from the whitelist by an admin")
+	firewall.RemoveIP(accessStore, target)
+	log.Printf("WEBSERVER: %v removed %v from the whitelist", by, target)
+	return true
+}
+
+// Ban also closes the login pages of every ip it covers
+func Ban(target, reason string, duration time.Duration, by string) (access.Ban, error) {
+	ban, err := firewall.BanIP(accessStore, target, reason, duration)
+	if err != nil {
+		return ban, err
+	}
+	endSessions(func(s *sseSession) bool { return ban.Matches(s.ip) }, "banned")
+	log.Printf("WEBSERVER: %v banned %v", by, ban.Target)
+	return ban, nil
+}
+
+// AddUser creates an account that can log in right away
+func AddUser(name, key string, groupID int, admin bool, by string) error {
+	if !firewall.ValidateInput(name, firewall.TypeUsername) {
+		return errors.New("invalid username")
+	}
+	if !firewall.GroupExists(groupID) {
+		return errNoGroup
+	}
+	hash, err := HashKey(key)
+	if err != nil {
+		return err
+	}
+	if err := createUser(User{Name: name, Hash: hash, PermissionGroupID: groupID, Admin: admin}); err != nil {
+		return err
+	}
+	log.Printf("WEBSERVER: %v created user %v", by, name)
+	return nil
+}
+
+// SetUserDisabled blocks or unblocks logins, disabling logs the user out everywhere
+func SetUserDisabled(name string, disabled bool, by string) error {
+	user, ok := getUser(name)
+	if !ok {
+		return errNoUser
+	}
+	user.Disabled = disabled
+	if err := updateUser(user); err != nil {
+		return err
+	}
+	if disabled {
+		revokeUser(name, "account disabled")
+	}
+	log.Printf("WEBSERVER: %v set disabled=%v for %v", by, disabled, name)
+	return nil
+}
+
+// RemoveUser deletes an account, its sessions and api leases end right away
+func RemoveUser(name, by string) error {
+	user, ok := getUser(name)
+	if !ok {
+		return errNoUser
+	}
+	if err := deleteUser(name); err != nil {
+		return err
+	}
+	revokeUser(name, "user deleted")
+	for _, key := range user.APIKeys {
+		firewall.ReleaseKeyLeases(accessStore, ipHasSessions, key.ID)
+	}
+	log.Printf("WEBSERVER: %v deleted user %v", by, name)
+	return nil
+}
+
+// SetUserKey replaces the key of a user, they get logged out everywhere
+func SetUserKey(name, key, by string) error {
+	user, ok := getUser(name)
+	if !ok {
+		return errNoUser
+	}
+	if err := setPassword(user, key); err != nil {
+		return err
+	}
+	log.Printf("WEBSERVER: %v changed the key of %v", by, name)
+	return nil
+}
+
+// SetUserGroup moves a user to another permission group, their sessions end so the new group applies on the next login
+func SetUserGroup(name string, groupID int, by string) error {
+	if !firewall.GroupExists(groupID) {
+		return errNoGroup
+	}
+	user, ok := getUser(name)
+	if !ok {
+		return errNoUser
+	}
+	user.PermissionGroupID = groupID
+	if err := updateUser(user); err != nil {
+		return err
+	}
+	revokeUser(name, "permission group changed")
+	log.Printf("WEBSERVER: %v moved %v to permission group %v", by, name, groupID)
+	return nil
+}
+
+// Users lists every account the way the admin api shows them, sorted by name
+func Users() []UserInfo {
+	users := listUsers()
+	list := make([]UserInfo, 0, len(users))
+	for _, user := range users {
+		list = append(list, UserInfo{
+			Name:              user.Name,
+			Admin:             user.Admin,
+			Pending:           user.Pending,
+			Disabled:          user.Disabled,
+			PermissionGroupID: user.PermissionGroupID,
+			Totp:              user.TotpSecret != "",
+			APIKeys:           len(user.APIKeys),
+		})
+	}
+	return list
+}
@@ -0,0 +1,175 @@
+package webserver
+
+import (
+	"encoding/json"
+	"log"
+	"mazarin/firewall"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Reset tokens are made by an admin and let a user pick a new key once, only the hash is kept
+const resetTimeout = 24 * time.Hour
+
+type resetEntry struct {
+	Username string
+	Expires  time.Time
+}
+
+var (
+	resetMu     = sync.Mutex{}
+	resetTokens = make(map[string]resetEntry) //token hash -> user
+)
+
+type PasswordRequest struct {
+	OldKey string `json:"old_key"`
+	NewKey string `json:"new_key"`
+}
+
+type ResetRequest struct {
+	Token  string `json:"token"`
+	NewKey string `json:"new_key"`
+}
+
+func newResetToken(username string) string {
+	token := randomToken()
+	resetMu.Lock()
+	defer resetMu.Unlock()
+
+	//Only the newest token of a user works
+	for hash, entry := range resetTokens {
+		if entry.Username == username || time.Now().After(entry.Expires) {
+			delete(resetTokens, hash)
+		}
+	}
+	resetTokens[hashRecoveryCode(token)] = resetEntry{Username: username, Expires: time.Now().Add(resetTimeout)}
+	return token
+}
+
+func useResetToken(token string) (string, bool) {
+	resetMu.Lock()
+	defer resetMu.Unlock()
+
+	hash := hashRecoveryCode(token)
+	entry, ok := resetTokens[hash]
+	delete(resetTokens, hash)
+	if !ok || time.Now().After(entry.Expires) {
+		return "", false
+	}
+	return entry.Username, true
+}
+
+// setPassword stores the new hash and logs the user out everywhere
+func setPassword(user User, newKey string) error {
+	hash, err := HashKey(newKey)
+	if err != nil {
+		return err
+	}
+	user.Hash = hash
+	if err := updateUser(user); err != nil {
+		return err
+	}
+	revokeUser(user.Name, "password changed")
+	return nil
+}
+
+// PasswordHandler changes the key of the logged in user, the old key has to be sent along
+func PasswordHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP, err := firewall.ClientIP(r)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	//The login cookie, or the user that whitelisted this ip when cookies dont work (plain http)
+	username, ok := SessionUser(r)
+	if !ok {
+		username = firewall.UserForIP(accessStore, clientIP)
+	}
+	if username == "" {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req PasswordRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if !validNewKey(req.NewKey) {
+		http.Error(w, "Invalid new key, use "+keyRules(), http.StatusBadRequest)
+		return
+	}
+
+	if until := lockedUntil(username); !until.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		http.Error(w, "Account locked, try again later", http.StatusTooManyRequests)
+		return
+	}
+	user, exists := getUser(username)
+	if !firewall.ValidateInput(req.OldKey, firewall.TypeLongPassword) || !checkPassword(user, exists, req.OldKey) {
+		log.Printf("WEBSERVER: Wrong old key on password change for %v from IP %v", username, clientIP)
+		failedLogin(w, r, username)
+		return
+	}
+
+	if err := setPassword(user, req.NewKey); err != nil {
+		log.Printf("WEBSERVER: Failed to change password of %v: %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("WEBSERVER: User %v changed their password from IP %v", username, clientIP)
+	writeJSON(w, map[string]string{
+		"status":  "success",
+		"message": "Key changed, log in again with your new key.",
+	})
+}
+
+// ResetHandler sets a new key with a reset token from an admin, no login needed
+func ResetHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req ResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	if !validNewKey(req.NewKey) {
+		http.Error(w, "Invalid new key, use "+keyRules(), http.StatusBadRequest)
+		return
+	}
+
+	username, ok := useResetToken(req.Token)
+	if !ok {
+		http.Error(w, "Invalid or expired reset token", http.StatusForbidden)
+		return
+	}
+	user, exists := getUser(username)
+	if !exists {
+		http.Error(w, "Invalid or expired reset token", http.StatusForbidden)
+		return
+	}
+
+	if err := setPassword(user, req.NewKey); err != nil {
+		log.Printf("WEBSERVER: Failed to reset password of %v: %v", username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	clearFailures(username)
+	log.Printf("WEBSERVER: User %v reset their password", username)
+	writeJSON(w, map[string]string{
+		"status":  "success",
+		"message": "Key changed, you can log in now.",
+	})
+}
@@ -0,0 +1,194 @@
+package webserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"mazarin/access"
+	"mazarin/database"
+	"mazarin/firewall"
+	"mazarin/sessions"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sessions, api leases and the whitelist survive a restart, in the db when enable_db is on and in sessions.json otherwise
+
+const (
+	saveDelay     = 2 * time.Second //changes usually come in bursts, a login creates a session and whitelists an ip
+	saveInterval  = time.Minute
+	restoreWindow = 2 * time.Minute //how long a restored ip waits for its login page to reconnect
+)
+
+type savedState struct {
+	Sessions  []sessions.Stored         `json:"sessions"`
+	Leases    []firewall.Lease          `json:"leases"`
+	Whitelist []firewall.WhitelistEntry `json:"whitelist"`
+	Manual    []access.Grant            `json:"manual,omitempty"` //mazarin whitelist add, the sqlite store keeps these itself
+}
+
+func stateFile() string {
+	return filepath.Join(webConfig.KeysDir, "sessions.json")
+}
+
+func loadState() (savedState, error) {
+	var saved savedState
+	if webConfig.EnableDB {
+		//The sqlite access store kept the whitelist itself
+		var err error
+		saved.Sessions, saved.Leases, err = database.LoadState()
+		saved.Whitelist = firewall.WhitelistEntries(accessStore)
+		return saved, err
+	}
+
+	data, err := os.ReadFile(stateFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return saved, nil
+		}
+		return saved, err
+	}
+	err = json.Unmarshal(data, &saved)
+	return saved, err
+}
+
+func saveState() error {
+	if webConfig == nil {
+		return errors.New("webserver not initialized")
+	}
+	saved := savedState{
+		Sessions: sessions.Snapshot(),
+		Leases:   firewall.Leases(),
+	}
+	if webConfig.EnableDB {
+		return database.SaveState(saved.Sessions, saved.Leases)
+	}
+
+	saved.Whitelist = firewall.WhitelistEntries(accessStore)
+	for _, g := range accessStore.List() {
+		if g.Source == access.SourceManual {
+			saved.Manual = append(saved.Manual, g.Entry()) //the logins on it are in Whitelist
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := stateFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, stateFile())
+}
+
+// RestoreState brings back what was saved before the last shutdown, users that got removed or disabled in the meantime are left out
+func RestoreState() {
+	saved, err := loadState()
+	if err != nil {
+		log.Println("WEBSERVER: Failed to load saved sessions ", err)
+		return
+	}
+
+	canLogin := func(name string) bool {
+		user, ok := getUser(name)
+		return ok && user.CanLogin()
+	}
+
+	var keep []sessions.Stored
+	for _, s := range saved.Sessions {
+		if canLogin(s.Username) {
+			keep = append(keep, s)
+		}
+	}
+	restoredSessions := sessions.Restore(keep)
+
+	restoredLeases := 0
+	leased := make(map[string]bool)
+	for _, lease := range saved.Leases {
+		user, ok := getUser(lease.User)
+		if !ok || !user.CanLogin() || !hasAPIKey(user, lease.KeyID) {
+			continue
+		}
+		lease.GroupID = user.PermissionGroupID
+		if firewall.RestoreLease(accessStore, ipHasSessions, lease) {
+			leased[lease.IP] = true
+			restoredLeases++
+		}
+	}
+
+	for _, g := range saved.Manual {
+		if !g.Expired(time.Now()) {
+			firewall.GrantEntry(accessStore, g)
+		}
+	}
+
+	//Browser logins only stay if their page comes back, same as after a dropped connection
+	restoredIPs := 0
+	for _, entry := range saved.Whitelist {
+		if leased[entry.IP] || entry.User == "" { //leases restore themselves, entries without a user weren't made by a login
+			continue
+		}
+		if !canLogin(entry.User) {
+			firewall.RemoveIP(accessStore, entry.IP) //only does something when the db kept it
+			continue
+		}
+		firewall.WhitelistIP(accessStore, entry.IP, entry.User, UserGroup(entry.User))
+		scheduleCleanupAfter(entry.IP, entry.User, max(gracePeriod(), restoreWindow))
+		restoredIPs++
+	}
+	log.Printf("WEBSERVER: Restored %v sessions, %v leases and %v whitelisted IPs", restoredSessions, restoredLeases, restoredIPs)
+}
+
+func hasAPIKey(user User, id string) bool {
+	for _, key := range user.APIKeys {
+		if key.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PersistState saves shortly after every change and once more on shutdown
+func PersistState(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	delay := time.NewTimer(saveDelay)
+	delay.Stop()
+	dirty := false
+
+	save := func() {
+		if err := saveState(); err != nil {
+			log.Println("WEBSERVER: Failed to save sessions ", err)
+			return
+		}
+		dirty = false
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			log.Println("WEBSERVER: Sessions saved for the next start")
+			return
+		case <-sessions.Changed():
+		case <-firewall.Changed():
+		case <-delay.C:
+			save()
+			continue
+		case <-ticker.C:
+			if dirty {
+				save()
+			}
+			continue
+		}
+		if !dirty {
+			dirty = true
+			delay.Reset(saveDelay)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mazarin/firewall"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type RegisterRequest struct {
+	Username string `json:"username"`
+	Key      string `json:"key"`
+	Invite   string `json:"invite"`
+}
+
+// RegisterHandler creates an account for anyone with a valid invite code
+func RegisterHandler(w http.ResponseWriter, r *http.Request) {
+	if webConfig == nil || !webConfig.EnableRegister {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP, err := firewall.ClientIP(r)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	//Guessing invite codes counts towards the same lockout as logins, keyed on the ip
+	lockKey := "register@" + clientIP
+	if until := lockedUntil(lockKey); !until.IsZero() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		http.Error(w, "Too many attempts, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	var req RegisterRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("WEBSERVER: Invalid register body from IP %v: %v", clientIP, err)
+		http.Error(w, "Invalid request format", http.StatusBadRequest)
+		return
+	}
+	req.Invite = strings.ToLower(strings.TrimSpace(req.Invite))
+
+	if !firewall.ValidateInput(req.Username, firewall.TypeUsername) {
+		http.Error(w, "Invalid username, use 1-64 letters, numbers, _ or -", http.StatusBadRequest)
+		return
+	}
+	if !validNewKey(req.Key) {
+		http.Error(w, "Invalid password, use "+keyRules(), http.StatusBadRequest)
+		return
+	}
+	if !firewall.ValidateInput(req.Invite, firewall.TypeInvite) {
+		failedRegister(w, r, lockKey)
+		return
+	}
+
+	//Hash before taking the invite, so a slow bcrypt doesnt hold the invite lock
+	hash, err := HashKey(req.Key)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to hash password on register: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	invite, err := useInvite(req.Invite)
+	if err != nil {
+		if errors.Is(err, errInvalidInvite) {
+			log.Printf("WEBSERVER: Invalid invite code from IP %v", clientIP)
+			failedRegister(w, r, lockKey)
+			return
+		}
+		log.Printf("WEBSERVER: Failed to use invite: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	user := User{
+		Name:              req.Username,
+		Hash:              hash,
+		PermissionGroupID: invite.PermissionGroupID,
+		Pending:           webConfig.RequireApproval,
+	}
+	if err := createUser(user); err != nil {
+		refundInvite(invite)
+		if errors.Is(err, errUserExists) {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+		log.Printf("WEBSERVER: Failed to create user %v: %v", req.Username, err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	clearFailures(lockKey)
+
+	log.Printf("WEBSERVER: User %v registered from IP %v with invite %v (pending: %v)", user.Name, clientIP, invite.ID, user.Pending)
+	message := "Account created, you can log in now."
+	if user.Pending {
+		message = "Account created, an admin has to approve it before you can log in."
+	}
+	writeJSON(w, map[string]string{
+		"status":  "success",
+		"message": message,
+	})
+}
+
+func failedRegister(w http.ResponseWriter, r *http.Request, lockKey string) {
+	sleepCtx(r.Context(), registerFailure(lockKey))
+	http.Error(w, "Invalid or used invite code", http.StatusForbidden)
+}
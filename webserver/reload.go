@@ -0,0 +1,102 @@
+package webserver
+
+import (
+	"context"
+	"log"
+	"mazarin/firewall"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// keys.json gets reloaded on SIGHUP and when its mod time changes, callers of keysModTime hold usersMu
+const keysPollInterval = 5 * time.Second
+
+var keysModTime time.Time
+
+func keysFileModTime(keysDir string) time.Time {
+	info, err := os.Stat(filepath.Join(keysDir, "keys.json"))
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// ReloadKeys swaps in a fresh keys.json (or the users table), a broken file keeps the old users.
+// Users that got removed, disabled, a new hash or another permission group lose their sessions, removed api keys lose their leases
+func ReloadKeys() error {
+	if webConfig == nil {
+		return nil
+	}
+	fresh, err := readUsers(webConfig)
+	if err != nil {
+		//Remember the broken version so the watcher only tries again after the next edit
+		usersMu.Lock()
+		keysModTime = keysFileModTime(webConfig.KeysDir)
+		usersMu.Unlock()
+		log.Printf("WEBSERVER: Keeping the old users, reload failed: %v", err)
+		return err
+	}
+
+	var revoked, droppedKeys []string
+	usersMu.Lock()
+	for name, old := range userData {
+		user, exists := fresh[name]
+		switch {
+		case !exists:
+			revoked = append(revoked, name)
+		case !user.CanLogin() && old.CanLogin():
+			revoked = append(revoked, name)
+		case user.Hash != old.Hash:
+			revoked = append(revoked, name)
+		case user.PermissionGroupID != old.PermissionGroupID:
+			//The whitelist entries still carry the old group, the next login gets the new one
+			revoked = append(revoked, name)
+		}
+		for _, key := range old.APIKeys {
+			if !slices.ContainsFunc(user.APIKeys, func(k APIKey) bool { return k.ID == key.ID }) {
+				droppedKeys = append(droppedKeys, key.ID)
+			}
+		}
+	}
+	userData = fresh
+	keysModTime = keysFileModTime(webConfig.KeysDir)
+	usersMu.Unlock()
+
+	setUserRates(fresh)
+	makeDummyHashes(fresh)
+	for _, id := range droppedKeys {
+		firewall.ReleaseKeyLeases(accessStore, ipHasSessions, id)
+	}
+	for _, name := range revoked {
+		revokeUser(name, "account changed")
+	}
+	log.Printf("WEBSERVER: Reloaded the users, %v users, %v logged out", len(fresh), len(revoked))
+	return nil
+}
+
+// WatchKeys polls the mod time of keys.json until ctx is done
+func WatchKeys(ctx context.Context) {
+	//The db has no mod time to poll, SIGHUP and `mazarin reload` still work
+	if webConfig.EnableDB {
+		return
+	}
+	ticker := time.NewTicker(keysPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			modTime := keysFileModTime(webConfig.KeysDir)
+			usersMu.RLock()
+			changed := !modTime.IsZero() && !modTime.Equal(keysModTime)
+			usersMu.RUnlock()
+			if changed {
+				ReloadKeys()
+			}
+		}
+	}
+}
@@ -0,0 +1,43 @@
+const messageDiv = document.getElementById('message');
+
+async function register() {
+  const payload = {
+    username: document.getElementById('username').value,
+    key: document.getElementById('key').value,
+    invite: document.getElementById('invite').value.trim()
+  };
+
+  messageDiv.textContent = 'Creating account...';
+  messageDiv.style.color = 'blue';
+
+  try {
+    const response = await fetch('/register', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify(payload)
+    });
+
+    if (!response.ok) {
+      //the server explains what was wrong in plain text
+      messageDiv.textContent = await response.text();
+      messageDiv.style.color = 'red';
+      return;
+    }
+
+    const data = await response.json();
+    messageDiv.textContent = data.message;
+    messageDiv.style.color = 'green';
+    document.getElementById('registerForm').reset();
+  } catch (error) {
+    console.error('Registration error:', error);
+    messageDiv.textContent = 'Registration failed, please try again.';
+    messageDiv.style.color = 'red';
+  }
+}
+
+document.getElementById('registerForm').addEventListener('submit', function(e) {
+  e.preventDefault();
+  register();
+});
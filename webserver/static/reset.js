@@ -0,0 +1,39 @@
+const messageDiv = document.getElementById('message');
+
+//The admin gives out a link with the one time token in it
+async function resetKey() {
+  const payload = {
+    token: new URLSearchParams(window.location.search).get('token') || '',
+    new_key: document.getElementById('newKey').value
+  };
+
+  try {
+    const response = await fetch('/account/reset', {
+      method: 'POST',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      body: JSON.stringify(payload)
+    });
+
+    if (!response.ok) {
+      messageDiv.textContent = await response.text();
+      messageDiv.style.color = 'red';
+      return;
+    }
+
+    const data = await response.json();
+    messageDiv.textContent = data.message;
+    messageDiv.style.color = 'green';
+    document.getElementById('resetForm').reset();
+  } catch (error) {
+    console.error('Reset error:', error);
+    messageDiv.textContent = 'Reset failed, please try again.';
+    messageDiv.style.color = 'red';
+  }
+}
+
+document.getElementById('resetForm').addEventListener('submit', function(e) {
+  e.preventDefault();
+  resetKey();
+});
@@ -2,13 +2,25 @@ let eventSource = null;
 const messageDiv = document.getElementById('message');
 const pingDiv = document.getElementById('serverPing');
 const dcButton = document.getElementById('dcButton');
+const otpInput = document.getElementById('otp');
+const totpButton = document.getElementById('totpButton');
+const totpSetupDiv = document.getElementById('totpSetup');
+const passwordButton = document.getElementById('passwordButton');
+const passwordChangeDiv = document.getElementById('passwordChange');
+const sessionInfoDiv = document.getElementById('sessionInfo');
+const noticeDiv = document.getElementById('notice');
+const healthList = document.getElementById('health');
+const renewButton = document.getElementById('renewButton');
+let enrollToken = '';
 
-async function authenticate(username, key) {
+async function authenticate(username, key, otp) {
   try {
-    // Create JSON payload
+    // Create JSON payload, redirect is set when a session protected route sent us here
     const payload = JSON.stringify({
       username: username,
-      key: key
+      key: key,
+      otp: otp,
+      redirect: new URLSearchParams(window.location.search).get('redirect') || ''
     });
     
     //send auth
@@ -22,15 +34,15 @@ async function authenticate(username, key) {
     
     if (!response.ok) {
       console.error('Authentication failed');
-      return false;
+      return null;
     }
   
-    //return auth
+    //return auth, totp_required and totp_enroll_required are handled by the caller
     const data = await response.json();
-    return data.status === 'success';
+    return data;
   } catch (error) {
     console.error('Authentication error:', error);
-    return false;
+    return null;
   }
 }
 
@@ -58,6 +70,8 @@ function connectSSE() {
     messageDiv.innerText = 'Successfully authenticated!\nDO NOT Close this window or the session will end';
     messageDiv.style.color = 'green';
     dcButton.style.visibility = 'visible'
+    totpButton.style.visibility = 'visible'
+    passwordButton.style.visibility = 'visible'
     console.log('SSE connection established');
   };
   
@@ -65,19 +79,26 @@ function connectSSE() {
     messageDiv.textContent = 'Connection error. Please try again.';
     messageDiv.style.color = 'red';
     dcButton.style.visibility = 'hidden'
+    totpButton.style.visibility = 'hidden'
+    passwordButton.style.visibility = 'hidden'
     pingDiv.textContent = ``;
+    clearSessionInfo();
     console.error('SSE connection error:', error);
     eventSource.close();
   };
 
   eventSource.addEventListener("close", function(event) {
-    console.log("Server is shutting down"); //todo add event data to this
+    const reason = JSON.parse(event.data).reason;
+    console.log("Session closed by the server:", reason);
     eventSource.close();
 
-    messageDiv.textContent = 'Server shutting down... Disconnected';
+    messageDiv.textContent = reason === 'server shutdown' ? 'Server shutting down... Disconnected' : 'Disconnected: ' + reason;
     messageDiv.style.color = 'blue';
     dcButton.style.visibility = 'hidden'
+    totpButton.style.visibility = 'hidden'
+    passwordButton.style.visibility = 'hidden'
     pingDiv.textContent = ``;
+    clearSessionInfo();
   });
   
   eventSource.addEventListener("ping", function(event) {
@@ -86,18 +107,85 @@ function connectSSE() {
     /*pingDiv.textContent = `Ping: ${ping}ms`;
     pingDiv.style.color = '#064a72';*/
   });
+
+  eventSource.addEventListener("session", function(event) {
+    const data = JSON.parse(event.data);
+    const minutes = Math.floor(data.remaining_seconds / 60);
+    sessionInfoDiv.textContent = `Session ends in ${Math.floor(minutes / 60)}h ${minutes % 60}m`;
+  });
+
+  eventSource.addEventListener("renew", function(event) {
+    const data = JSON.parse(event.data);
+    if (data.can_renew) {
+      renewButton.classList.remove('hidden');
+    } else {
+      sessionInfoDiv.textContent = 'Your session ends soon, log in again to continue.';
+    }
+  });
+
+  eventSource.addEventListener("notice", function(event) {
+    noticeDiv.textContent = JSON.parse(event.data).message;
+    noticeDiv.classList.remove('hidden');
+  });
+
+  //The first health event has every route we can reach, later ones only the routes that changed
+  eventSource.addEventListener("health", function(event) {
+    for (const route of JSON.parse(event.data)) {
+      let item = document.getElementById('health-' + route.route);
+      if (!item) {
+        item = document.createElement('li');
+        item.id = 'health-' + route.route;
+        healthList.appendChild(item);
+      }
+      item.textContent = `${route.route}: ${route.healthy ? 'online' : 'offline'}`;
+      item.className = route.healthy ? '' : 'down';
+    }
+  });
+}
+
+function clearSessionInfo() {
+  sessionInfoDiv.textContent = '';
+  healthList.replaceChildren();
+  renewButton.classList.add('hidden');
+}
+
+async function renewSession() {
+  try {
+    await postJSON('/account/renew', {});
+    renewButton.classList.add('hidden');
+    sessionInfoDiv.textContent = 'Session renewed';
+  } catch (error) {
+    sessionInfoDiv.textContent = 'Renewing failed, log in again to continue.';
+  }
 }
 
 async function loginAndConnect() {
   const username = document.getElementById('username').value;
   const key = document.getElementById('key').value;
+  const otp = otpInput.value;
   
   messageDiv.textContent = 'Authenticating...';
   messageDiv.style.color = 'blue';
   
-  const success = await authenticate(username, key);
+  const result = await authenticate(username, key, otp);
   
-  if (success) {
+  if (result && result.status === 'totp_required') {
+    //Second step, the user submits the form again with the code filled in
+    otpInput.classList.remove('hidden');
+    otpInput.focus();
+    messageDiv.textContent = result.message;
+    messageDiv.style.color = 'blue';
+  } else if (result && result.status === 'totp_enroll_required') {
+    messageDiv.textContent = result.message;
+    messageDiv.style.color = 'blue';
+    enrollToken = result.enroll_token;
+    startTotpSetup();
+  } else if (result && result.status === 'success' && result.redirect) {
+    //Session routes only need the cookie, send the user back to where they came from
+    messageDiv.textContent = 'Authentication successful. Redirecting...';
+    window.location.href = result.redirect;
+  } else if (result && result.status === 'success') {
+    otpInput.value = '';
     messageDiv.textContent = 'Authentication successful. Connecting...';
     connectSSE();
   } else {
@@ -106,6 +194,80 @@ async function loginAndConnect() {
   }
 }
 
+async function postJSON(url, body) {
+  const response = await fetch(url, {
+    method: 'POST',
+    headers: {
+      'Content-Type': 'application/json'
+    },
+    body: JSON.stringify(body)
+  });
+  if (!response.ok) {
+    throw new Error(await response.text());
+  }
+  return response.json();
+}
+
+//2FA setup, works with the session cookie or with the enroll token from a forced setup
+async function startTotpSetup() {
+  try {
+    const data = await postJSON('/account/totp/setup', { enroll_token: enrollToken });
+    document.getElementById('totpUri').href = data.uri;
+    document.getElementById('totpSecret').textContent = data.secret;
+    document.getElementById('recoveryCodes').classList.add('hidden');
+    totpSetupDiv.classList.remove('hidden');
+  } catch (error) {
+    messageDiv.textContent = '2FA setup failed: ' + error.message;
+    messageDiv.style.color = 'red';
+  }
+}
+
+async function confirmTotpSetup() {
+  const code = document.getElementById('totpCode').value.trim();
+  try {
+    const data = await postJSON('/account/totp/confirm', { enroll_token: enrollToken, code: code });
+    const codesDiv = document.getElementById('recoveryCodes');
+    codesDiv.textContent = 'Recovery codes:\n' + data.recovery_codes.join('\n');
+    codesDiv.classList.remove('hidden');
+    messageDiv.textContent = data.message;
+    messageDiv.style.color = 'green';
+    if (enrollToken) {
+      //Forced setup, now log in for real with a code
+      enrollToken = '';
+      otpInput.classList.remove('hidden');
+    }
+  } catch (error) {
+    messageDiv.textContent = 'Invalid code, please try again.';
+    messageDiv.style.color = 'red';
+  }
+}
+
+async function changePassword() {
+  try {
+    const data = await postJSON('/account/password', {
+      old_key: document.getElementById('oldKey').value,
+      new_key: document.getElementById('newKey').value
+    });
+    //The server ends every session of this user, the sse close event follows
+    passwordChangeDiv.classList.add('hidden');
+    document.getElementById('oldKey').value = '';
+    document.getElementById('newKey').value = '';
+    messageDiv.textContent = data.message;
+    messageDiv.style.color = 'green';
+  } catch (error) {
+    messageDiv.textContent = 'Changing the key failed: ' + error.message;
+    messageDiv.style.color = 'red';
+  }
+}
+
+document.getElementById('totpConfirm').addEventListener('click', confirmTotpSetup);
+renewButton.addEventListener('click', renewSession);
+document.getElementById('passwordConfirm').addEventListener('click', changePassword);
+passwordButton.addEventListener('click', function() {
+  passwordChangeDiv.classList.toggle('hidden');
+});
+totpButton.addEventListener('click', startTotpSetup);
+
 document.getElementById('authForm').addEventListener('submit', function(e) {
   e.preventDefault();
   loginAndConnect();
@@ -118,7 +280,10 @@ dcButton.addEventListener('click', function() {
     messageDiv.textContent = 'Disconnected';
     messageDiv.style.color = 'blue';
     dcButton.style.visibility = 'hidden'
+    totpButton.style.visibility = 'hidden'
+    passwordButton.style.visibility = 'hidden'
     pingDiv.textContent = ``;
+    clearSessionInfo();
 });
 
 // Cleanup function for page unload
@@ -0,0 +1,154 @@
+package webserver
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TOTP as in RFC 6238 with the defaults every authenticator app understands: sha1, 6 digits, 30 second steps
+
+const (
+	totpIssuer    = "Mazarin"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1 //steps we accept before/after now, covers clocks that are a bit off
+	recoveryCount = 10
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Last step a user logged in with, so a code cant be used twice
+var (
+	totpMu       = sync.Mutex{}
+	lastUsedStep = make(map[string]uint64)
+)
+
+func newTOTPSecret() string {
+	secret := make([]byte, 20)
+	rand.Read(secret)
+	return b32.EncodeToString(secret)
+}
+
+func totpURI(username, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", totpIssuer)
+	params.Set("period", fmt.Sprint(totpPeriod))
+	params.Set("digits", fmt.Sprint(totpDigits))
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// TOTPCode is the code of a secret for a time step (unix time / 30)
+func TOTPCode(secret string, step uint64) (string, error) {
+	key, err := b32.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0F
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7FFFFFFF
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000), nil
+}
+
+// validTOTP checks a code around the current time, when used is true the step gets burned
+func validTOTP(username, secret, code string, used bool) bool {
+	now := uint64(time.Now().Unix() / totpPeriod)
+
+	totpMu.Lock()
+	defer totpMu.Unlock()
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		expected, err := TOTPCode(secret, step)
+		if err != nil {
+			return false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			if step <= lastUsedStep[username] {
+				return false
+			}
+			if used {
+				lastUsedStep[username] = step
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// newRecoveryCodes returns the codes to show the user once, and the hashes we store
+func newRecoveryCodes() ([]string, []string) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCount; i++ {
+		raw := make([]byte, 5)
+		rand.Read(raw)
+		code := strings.ToLower(b32.EncodeToString(raw)) //8 chars
+		code = code[:4] + "-" + code[4:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes
+}
+
+// Recovery codes are random enough that a plain sha256 is fine, no need for bcrypt here
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode returns the remaining hashes when the code matched one
+func useRecoveryCode(hashes []string, code string) ([]string, bool) {
+	hash := hashRecoveryCode(code)
+	for i, stored := range hashes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+			remaining := append([]string{}, hashes[:i]...)
+			return append(remaining, hashes[i+1:]...), true
+		}
+	}
+	return hashes, false
+}
+
+// burnRecoveryCode checks and removes the code on the current user in one go under usersMu, two logins racing with the same code cant both pass.
+// Returns how many codes are left
+func burnRecoveryCode(name, code string) (int, bool, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if userData == nil {
+		return 0, false, errors.New("users are not loaded")
+	}
+	user, exists := userData[name]
+	if !exists {
+		return 0, false, nil
+	}
+	remaining, ok := useRecoveryCode(user.RecoveryCodes, code)
+	if !ok {
+		return 0, false, nil
+	}
+
+	old := user
+	user.RecoveryCodes = remaining
+	userData[name] = user
+	if err := saveUsersLocked(name); err != nil {
+		userData[name] = old
+		return 0, false, err
+	}
+	return len(remaining), true, nil
+}
@@ -0,0 +1,146 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"mazarin/access"
+	"mazarin/config"
+	"mazarin/database"
+	"os"
+	"path/filepath"
+)
+
+// With enable_db on the users live in the users table instead of keys.json.
+// The columns hold what other tools might query, the whole user is kept as json next to them
+
+// LoadUsers reads the users from wherever the config keeps them, nil when they can't be read
+func LoadUsers(conf *config.WebserverConfig) map[string]User {
+	users, err := readUsers(conf)
+	if err != nil {
+		log.Println("HASHING: LoadUsers error ", err)
+		return nil
+	}
+	return users
+}
+
+// OpenUsers loads the users for the user subcommands while mazarin is not running, nothing else gets started.
+// Changed users get logged out of store, the command line passes an empty one
+func OpenUsers(conf *config.WebserverConfig, store access.Store) error {
+	if conf.EnableDB {
+		if err := database.InitDb(conf); err != nil {
+			return err
+		}
+	}
+	users, err := readUsers(conf)
+	if errors.Is(err, fs.ErrNotExist) {
+		users = make(map[string]User) //the first user add creates keys.json
+	} else if err != nil {
+		return err
+	}
+
+	usersMu.Lock()
+	userData = users
+	keysModTime = keysFileModTime(conf.KeysDir)
+	usersMu.Unlock()
+	webConfig = conf
+	accessStore = store
+	makeDummyHashes(users)
+	return nil
+}
+
+func readUsers(conf *config.WebserverConfig) (map[string]User, error) {
+	if !conf.EnableDB {
+		return readKeys(conf.KeysDir)
+	}
+	if err := migrateKeys(conf.KeysDir); err != nil {
+		return nil, err
+	}
+	return readUsersDB()
+}
+
+func readUsersDB() (map[string]User, error) {
+	rows, err := database.ListUsers()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]User, 0, len(rows))
+	for _, row := range rows {
+		var user User
+		if row.Data != "" {
+			if err := json.Unmarshal([]byte(row.Data), &user); err != nil {
+				return nil, fmt.Errorf("user %v: %w", row.Username, err)
+			}
+		}
+		//The columns win, they are the part someone could have changed by hand
+		user.Name = row.Username
+		user.Hash = row.PasswordHash
+		user.PermissionGroupID = row.PermissionGroupID
+		user.Disabled = !row.Active
+		list = append(list, user)
+	}
+	return usersByName(list)
+}
+
+// writeUserDB saves the row of one user, or deletes it when the user is gone. The other rows are left alone,
+// the user subcommands can have changed them while we were running
+func writeUserDB(name string, user User, exists bool) error {
+	if !exists {
+		return database.DeleteUserByName(name)
+	}
+	return writeUsersDB(map[string]User{name: user})
+}
+
+// userInDB catches users the user subcommands added to the db while we were running, they are not in userData yet
+func userInDB(name string) bool {
+	if webConfig == nil || !webConfig.EnableDB {
+		return false
+	}
+	_, err := database.GetUserByUsername(name)
+	return err == nil
+}
+
+func writeUsersDB(users map[string]User) error {
+	rows := make([]database.User, 0, len(users))
+	for _, user := range users {
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		rows = append(rows, database.User{
+			Username:          user.Name,
+			PasswordHash:      user.Hash,
+			PermissionGroupID: user.PermissionGroupID,
+			Active:            !user.Disabled,
+			Data:              string(data),
+		})
+	}
+	return database.SaveUsers(rows)
+}
+
+// migrateKeys copies keys.json into an empty users table, the file gets renamed so nobody keeps editing it by mistake
+func migrateKeys(keysDir string) error {
+	rows, err := database.ListUsers()
+	if err != nil || len(rows) > 0 {
+		return err
+	}
+	users, err := readKeys(keysDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("keys.json can't be moved into the database: %w", err)
+	}
+	if err := writeUsersDB(users); err != nil {
+		return err
+	}
+
+	path := filepath.Join(keysDir, "keys.json")
+	if err := os.Rename(path, path+".migrated"); err != nil {
+		return err
+	}
+	log.Printf("WEBSERVER: Moved %v users from keys.json into the database, the old file is now %v.migrated", len(users), path)
+	return nil
+}
@@ -0,0 +1,165 @@
+package webserver
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// userData is the live user store, everything that changes a user goes through updateUser so keys.json (or the db) stays in sync
+var usersMu = sync.RWMutex{}
+
+func getUser(name string) (User, bool) {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	user, ok := userData[name]
+	return user, ok
+}
+
+// updateUser replaces a user and writes keys.json, on a failed write the old user is kept
+func updateUser(user User) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	//Never overwrite a keys.json we failed to load, we would wipe every other user
+	if userData == nil {
+		return errors.New("users are not loaded")
+	}
+
+	old, existed := userData[user.Name]
+	userData[user.Name] = user
+	if err := saveUsersLocked(user.Name); err != nil {
+		if existed {
+			userData[user.Name] = old
+		} else {
+			delete(userData, user.Name)
+		}
+		return err
+	}
+	return nil
+}
+
+var errUserExists = errors.New("user already exists")
+
+// createUser adds a new user, unlike updateUser it never replaces an existing one
+func createUser(user User) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if userData == nil {
+		return errors.New("users are not loaded")
+	}
+	if _, exists := userData[user.Name]; exists || userInDB(user.Name) {
+		return errUserExists
+	}
+
+	userData[user.Name] = user
+	if err := saveUsersLocked(user.Name); err != nil {
+		delete(userData, user.Name)
+		return err
+	}
+	return nil
+}
+
+func deleteUser(name string) error {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+
+	if userData == nil {
+		return errors.New("users are not loaded")
+	}
+	old, exists := userData[name]
+	if !exists {
+		return errors.New("user does not exist")
+	}
+
+	delete(userData, name)
+	if err := saveUsersLocked(name); err != nil {
+		userData[name] = old
+		return err
+	}
+	return nil
+}
+
+func listUsers() []User {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+
+	list := make([]User, 0, len(userData))
+	for _, user := range userData {
+		list = append(list, user)
+	}
+	slices.SortFunc(list, func(a, b User) int { return strings.Compare(a.Name, b.Name) })
+	return list
+}
+
+// saveUsersLocked writes the users to a temp file first so a crash cant leave a half written keys.json, callers hold usersMu.
+// name is the user that changed, with the db only that row is written
+func saveUsersLocked(name string) error {
+	if webConfig == nil {
+		return errors.New("webserver not initialized")
+	}
+	if webConfig.EnableDB {
+		user, exists := userData[name]
+		return writeUserDB(name, user, exists)
+	}
+
+	var usersData UsersData
+	for _, user := range userData {
+		usersData.Users = append(usersData.Users, user)
+	}
+	slices.SortFunc(usersData.Users, func(a, b User) int { return strings.Compare(a.Name, b.Name) })
+
+	data, err := json.MarshalIndent(usersData, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(webConfig.KeysDir, "keys.json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	//Our own write should not look like an outside change to the watcher
+	keysModTime = keysFileModTime(webConfig.KeysDir)
+	return nil
+}
+
+// upgradeHash rehashes the key of a user that just logged in when the stored hash is older than the policy
+func upgradeHash(name, key string) {
+	user, ok := getUser(name)
+	if !ok || !needsRehash(user.Hash) {
+		return
+	}
+	hash, err := hashPassword(key)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to upgrade the hash of %v: %v", name, err)
+		return
+	}
+
+	//Fetch again, the login could have changed the user (2FA counters) while we were hashing
+	user, ok = getUser(name)
+	if !ok {
+		return
+	}
+	user.Hash = hash
+	if err := updateUser(user); err != nil {
+		log.Printf("WEBSERVER: Failed to save the upgraded hash of %v: %v", name, err)
+		return
+	}
+	log.Printf("WEBSERVER: Upgraded the hash of %v to %v", name, hashPolicy.Algorithm)
+}
+
+// UserGroup returns the permission group of a user, 0 when the user has none
+func UserGroup(name string) int {
+	user, _ := getUser(name)
+	return user.PermissionGroupID
+}
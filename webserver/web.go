@@ -5,19 +5,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"mazarin/access"
 	"mazarin/config"
 	"mazarin/firewall"
-	"mazarin/state"
-	"net"
+	"mazarin/sessions"
+	"mazarin/throttle"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
 var userData map[string]User
+var webConfig *config.WebserverConfig
 
 type AuthRequest struct {
 	Username string `json:"username"`
 	Key      string `json:"key"`
+	Redirect string `json:"redirect"`
+	Otp      string `json:"otp"`
 }
 
 func AuthHandler(w http.ResponseWriter, r *http.Request) {
@@ -26,7 +32,7 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	clientIP, err := firewall.ClientIP(r)
 	if err != nil {
 		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -47,43 +53,125 @@ func AuthHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid characters in input", http.StatusBadRequest)
 		return
 	}
-	if !firewall.ValidateInput(authReq.Key, "password") {
+	if !firewall.ValidateInput(authReq.Key, firewall.TypeLongPassword) {
 		log.Printf("WEBSERVER: Client IP %v invalid password characters", clientIP)
 		http.Error(w, "Invalid characters in input", http.StatusBadRequest)
 		return
 	}
 
-	user, ok := userData[authReq.Username]
-	if !ok {
-		log.Printf("WEBSERVER: User not found: %v from IP %v", authReq.Username, clientIP)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if until := lockedUntil(authReq.Username); !until.IsZero() {
+		log.Printf("WEBSERVER: Login for locked account %v from IP %v", authReq.Username, clientIP)
+		w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until).Seconds())+1))
+		http.Error(w, "Account locked, try again later", http.StatusTooManyRequests)
 		return
 	}
-	auth, err := ValidateUserHash(authReq.Key, user.Hash)
-	if err != nil {
-		log.Printf("WEBSERVER: Hash input validation failed from IP %v: %v", clientIP, err)
-		http.Error(w, "Invalid credentials", http.StatusBadRequest)
+
+	//Unknown users and wrong passwords take the same path and time
+	user, exists := getUser(authReq.Username)
+	if !checkPassword(user, exists, authReq.Key) {
+		if !exists {
+			log.Printf("WEBSERVER: User not found: %v from IP %v", authReq.Username, clientIP)
+		} else {
+			log.Printf("WEBSERVER: Invalid login from IP %v with username %v", clientIP, user.Name)
+		}
+		failedLogin(w, r, authReq.Username)
 		return
 	}
-	if !auth {
-		log.Printf("WEBSERVER: Invalid login from IP %v with username %v", clientIP, user.Name)
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	if !user.CanLogin() {
+		log.Printf("WEBSERVER: Pending or disabled user %v tried to log in from IP %v", user.Name, clientIP)
+		message := "Your account is disabled"
+		if user.Pending {
+			message = "Your account is waiting for approval"
+		}
+		http.Error(w, message, http.StatusForbidden)
 		return
 	}
 
-	log.Printf("WEBSERVER: Successful auth for %v from %v", authReq.Username, clientIP)
+	//2FA, the client asks for the code after a totp_required and sends everything again
+	if user.TotpSecret != "" {
+		otp := strings.ToLower(strings.TrimSpace(authReq.Otp))
+		if otp == "" {
+			writeJSON(w, map[string]string{
+				"status":  "totp_required",
+				"message": "Enter the code from your authenticator app or a recovery code.",
+			})
+			return
+		}
+		if !firewall.ValidateInput(otp, firewall.TypeOTP) || !checkSecondFactor(user.Name, otp) {
+			log.Printf("WEBSERVER: Invalid 2FA code from IP %v with username %v", clientIP, user.Name)
+			failedLogin(w, r, user.Name)
+			return
+		}
+	} else if user.RequireTotp || webConfig.RequireTotp {
+		log.Printf("WEBSERVER: User %v has to set up 2FA before logging in", user.Name)
+		writeJSON(w, map[string]string{
+			"status":       "totp_enroll_required",
+			"message":      "Your account requires 2FA, set it up to continue.",
+			"enroll_token": newEnrollToken(user.Name),
+		})
+		return
+	}
 
-	state.Mutex.Lock()
-	state.WhitelistedIPs[clientIP] = true
-	state.Mutex.Unlock()
+	log.Printf("WEBSERVER: Successful auth for %v from %v", authReq.Username, clientIP)
+	clearFailures(user.Name)
+	upgradeHash(user.Name, authReq.Key)
+
+	//A fresh login replaces any removal still waiting on a dropped stream
+	cancelCleanup(clientIP, user.Name)
+	redirect := safeRedirect(authReq.Redirect)
+	if redirect != "" {
+		//The browser leaves for the redirect and never opens a stream that would clean up after it, so the ip goes when the cookie does
+		firewall.WhitelistIPUntil(accessStore, clientIP, user.Name, user.PermissionGroupID, time.Now().Add(sessionDuration()))
+	} else {
+		firewall.WhitelistIP(accessStore, clientIP, user.Name, user.PermissionGroupID)
+	}
 	log.Printf("WEBSERVER: IP %v got whitelisted in the firewall", clientIP)
 
+	setSessionCookie(w, r, user.Name, clientIP)
+
 	// Return success response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
+	response := map[string]string{
 		"status":  "success",
 		"message": "Successfully authenticated. You can now establish an SSE connection.",
-	})
+	}
+	if redirect != "" {
+		response["redirect"] = redirect
+	}
+	writeJSON(w, response)
+}
+
+// LogoutHandler ends the login of the cookie on this ip, for clients that want to release their session right away.
+// Without a cookie nothing changes, the route is open to everyone and other users behind the same nat stay logged in
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP, err := firewall.ClientIP(r)
+	if err != nil {
+		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	username, ok := SessionUser(r)
+	if !ok {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	clearSessionCookie(w, r)
+	endSessions(func(s *sseSession) bool { return s.ip == clientIP && s.user == username }, "logged out")
+	cancelCleanup(clientIP, username)
+	firewall.RemoveLogin(accessStore, clientIP, username)
+	log.Printf("WEBSERVER: %v logged out on IP %v", username, clientIP)
+	writeJSON(w, map[string]string{"status": "success"})
+}
+
+// failedLogin counts the failure and answers after the progressive delay
+func failedLogin(w http.ResponseWriter, r *http.Request, username string) {
+	sleepCtx(r.Context(), registerFailure(username))
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
 }
 
 func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.ResponseWriter, r *http.Request) {
@@ -93,7 +181,7 @@ func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.Res
 	}
 
 	// Extract client IP
-	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	clientIP, err := firewall.ClientIP(r)
 	if err != nil {
 		log.Printf("WEBSERVER: Failed to parse client IP: %v", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
@@ -102,7 +190,19 @@ func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.Res
 
 	log.Printf("WEBSERVER: IP %v contacted /sse", clientIP)
 
-	allowed := firewall.CheckWhitelist(clientIP)
+	allowed := firewall.CheckWhitelist(accessStore, clientIP)
+
+	//A valid login cookie whitelists the ip again, this lets clients reconnect without sending the key (and 2FA) again.
+	//Only from the ip it was made on, a stolen cookie must not whitelist somebody elses ip
+	if !allowed {
+		if username, ok := sessionUserOnIP(r, clientIP); ok {
+			firewall.WhitelistIP(accessStore, clientIP, username, UserGroup(username))
+			log.Printf("WEBSERVER: IP %v whitelisted again by the session of %v", clientIP, username)
+			allowed = true
+		} else if username, ok := SessionUser(r); ok {
+			log.Printf("WEBSERVER: Session of %v was made on another IP, not whitelisting %v", username, clientIP)
+		}
+	}
 
 	if !allowed {
 		log.Printf("WEBSERVER: Unauthorized SSE connection attempt from IP %v", clientIP)
@@ -124,16 +224,41 @@ func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.Res
 	fmt.Fprintf(w, ":ok\n\n") // Flush headers
 	flusher.Flush()
 
-	state.Mutex.Lock()
-	state.WhitelistedIPs[clientIP] = true
-	state.Mutex.Unlock()
-
-	defer cleanupConnection(clientIP)
 	log.Printf("WEBSERVER: IP %v allowed to connect", clientIP)
 
+	//The stream lives as long as the login cookie, without a cookie (plain http) for one session_hours.
+	//The cookie also tells which of the users on this ip the stream belongs to
+	username := firewall.UserForIP(accessStore, clientIP)
+	token, expires := "", time.Now().Add(sessionDuration())
+	if cookie, err := r.Cookie(SessionCookieName); err == nil {
+		if session, ok := sessions.Lookup(cookie.Value); ok && firewall.HasLogin(accessStore, clientIP, session.Username) {
+			username, token, expires = session.Username, cookie.Value, session.ExpiresAt
+		}
+	}
+	if cancelCleanup(clientIP, username) {
+		log.Printf("WEBSERVER: IP %v reconnected within the grace period", clientIP)
+	}
+	session := registerSession(clientIP, username, UserGroup(username), token, expires)
+	endedByServer, shuttingDown := false, false
+	defer func() {
+		//Other tabs or clients on this ip keep the whitelist alive, on shutdown the whitelist gets saved for the next start instead
+		if unregisterSession(session) > 0 || shuttingDown {
+			return
+		}
+		if endedByServer {
+			cleanupNow(clientIP, username)
+		} else {
+			scheduleCleanup(clientIP, username)
+		}
+	}()
+
+	sendSessionTime(w, flusher, session)
+	sendHealth(w, flusher, session)
+
 	sseCTX := r.Context()
 	pingTicker := time.NewTicker(30 * time.Second)
 	defer pingTicker.Stop()
+	renewPrompted := false
 
 	// Send periodic pings
 	for {
@@ -141,9 +266,22 @@ func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.Res
 		//main loop context
 		case <-ctx.Done():
 			log.Printf("WEBSERVER: Shutdown detected sse session %v closed", clientIP)
-			closeSSE(w, flusher)
+			shuttingDown = true
+			closeSSE(w, flusher, "server shutdown")
+			return
+
+		case reason := <-session.end:
+			log.Printf("WEBSERVER: Session %v ended: %v", clientIP, reason)
+			endedByServer = true
+			closeSSE(w, flusher, reason)
 			return
 
+		case event := <-session.events:
+			if err := writeEvent(w, flusher, event.Name, event.Data); err != nil {
+				log.Printf("WEBSERVER: Failed to send %v to %v: %v", event.Name, clientIP, err)
+				return
+			}
+
 		case <-sseCTX.Done():
 			log.Printf("WEBSERVER: Session %v closed: %v", clientIP, sseCTX.Err())
 			return
@@ -153,12 +291,39 @@ func SseHandler(ctx context.Context, webConf *config.WebserverConfig, w http.Res
 				log.Printf("WEBSERVER: Failed to send ping to %v: %v", clientIP, err)
 				return
 			}
+
+			remaining := time.Until(session.expiresAt())
+			if remaining <= 0 {
+				log.Printf("WEBSERVER: Session %v expired", clientIP)
+				endedByServer = true
+				closeSSE(w, flusher, "session expired")
+				return
+			}
+			sendSessionTime(w, flusher, session)
+			if remaining < renewBefore && !renewPrompted {
+				renewPrompted = true
+				writeEvent(w, flusher, "renew", map[string]any{
+					"remaining_seconds": int(remaining.Seconds()),
+					"can_renew":         session.token != "",
+				})
+			} else if remaining >= renewBefore {
+				renewPrompted = false
+			}
 		}
 	}
 }
 
-func closeSSE(w http.ResponseWriter, flusher http.Flusher) {
-	_, err := fmt.Fprintf(w, "event: close\ndata: {\"reason\":\"server shutdown\"}\n\n")
+func sendSessionTime(w http.ResponseWriter, flusher http.Flusher, session *sseSession) {
+	expires := session.expiresAt()
+	writeEvent(w, flusher, "session", map[string]any{
+		"expires_at":        expires.UTC().Format(time.RFC3339),
+		"remaining_seconds": int(time.Until(expires).Seconds()),
+	})
+}
+
+func closeSSE(w http.ResponseWriter, flusher http.Flusher, reason string) {
+	data, _ := json.Marshal(map[string]string{"reason": reason})
+	_, err := fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
 	if err != nil {
 		return
 	}
@@ -167,16 +332,26 @@ func closeSSE(w http.ResponseWriter, flusher http.Flusher) {
 	time.Sleep(100 * time.Millisecond)
 }
 
-func cleanupConnection(ip string) {
-	state.Mutex.Lock()
-	defer state.Mutex.Unlock()
+// revokeUser logs a user out everywhere, cookies, whitelisted ips and open sse sessions
+func revokeUser(username, reason string) {
+	count := sessions.RevokeUser(username)
+	ips := firewall.RevokeUser(accessStore, username)
+	for _, ip := range ips {
+		cancelCleanup(ip, username)
+	}
+	endSessions(func(s *sseSession) bool { return s.user == username }, reason)
+	log.Printf("WEBSERVER: Revoked %v sessions and %v IPs of %v: %v", count, len(ips), username, reason)
+}
 
-	delete(state.WhitelistedIPs, ip)
-	for _, conn := range state.ActiveConns[ip] {
-		conn.Close()
+func cleanupConnection(ip, user string) {
+	//An api lease keeps the ip whitelisted on its own
+	if firewall.LeaseActive(ip, user) {
+		log.Printf("WEBSERVER: IP %v stays whitelisted for %v by an api lease", ip, user)
+		return
 	}
-	delete(state.ActiveConns, ip)
-	log.Printf("WEBSERVER: Removed IP %v from whitelist", ip)
+
+	firewall.RemoveLogin(accessStore, ip, user)
+	log.Printf("WEBSERVER: Removed %v on IP %v from whitelist", user, ip)
 }
 
 func sendPing(w http.ResponseWriter, flusher http.Flusher) error {
@@ -188,7 +363,25 @@ func sendPing(w http.ResponseWriter, flusher http.Flusher) error {
 	return nil
 }
 
-func Init(uD map[string]User) {
+func Init(uD map[string]User, webConf *config.WebserverConfig, store access.Store) {
+	usersMu.Lock()
 	userData = uD
+	keysModTime = keysFileModTime(webConf.KeysDir)
+	usersMu.Unlock()
+	webConfig = webConf
+	accessStore = store
+	loadInvites(webConf.KeysDir)
+
+	setUserRates(uD)
+	makeDummyHashes(uD)
+}
 
+func setUserRates(uD map[string]User) {
+	rates := make(map[string]int64)
+	for name, user := range uD {
+		if user.RateLimit != 0 {
+			rates[name] = user.RateLimit
+		}
+	}
+	throttle.SetUserRates(rates)
 }